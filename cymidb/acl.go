@@ -0,0 +1,176 @@
+package cymidb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ACLAction is a bitmask of the actions an ACL can allow or deny.
+type ACLAction uint32
+
+const (
+	ACLRead = ACLAction(1 << iota)
+	ACLWrite
+	ACLAdmin
+)
+
+// implied returns the actions including all actions implied by it: admin implies write, and write implies read.
+func (a ACLAction) implied() ACLAction {
+	if a&ACLAdmin > 0 {
+		a |= ACLWrite
+	}
+	if a&ACLWrite > 0 {
+		a |= ACLRead
+	}
+	return a
+}
+
+// ACL gives or denies rights to a principal on a node, and through its children on the subgraph below the node.
+// The ACL is linked from the ACL node to the node it protects.
+type ACL struct {
+	// Principal is the identity or group the rule applies to.
+	Principal NodeID
+	// Actions are the actions allowed or denied by this rule.
+	Actions ACLAction
+	// Deny makes this rule deny the actions. A deny always wins over an allow.
+	Deny bool
+	node Node
+}
+
+func NewACLFromNode(n Node) (acl ACL, err error) {
+	err = n.DecodeNodeType(NodeACL, &acl)
+	if err != nil {
+		return acl, fmt.Errorf("couldn't decode acl: %v", err)
+	}
+	acl.node = n
+	return
+}
+
+// NewACL returns a new rule allowing the actions to the principal.
+func NewACL(principal NodeID, actions ACLAction) (acl ACL) {
+	acl.node = NewNode(NodeACL)
+	acl.Principal = principal
+	acl.Actions = actions
+	return
+}
+
+// NewACLDeny returns a new rule denying the actions to the principal.
+func NewACLDeny(principal NodeID, actions ACLAction) (acl ACL) {
+	acl = NewACL(principal, actions)
+	acl.Deny = true
+	return
+}
+
+func (acl ACL) GetNode() (Node, error) {
+	err := acl.node.EncodeData(&acl)
+	return acl.node, err
+}
+
+// Protect saves the ACL and links it to the given node.
+func (acl ACL) Protect(db DB, n Noder) error {
+	if err := db.SaveNode(acl); err != nil {
+		return fmt.Errorf("couldn't save acl: %v", err)
+	}
+	return db.AddLink(acl, n)
+}
+
+// ACLEvaluator checks the ACL rules of the DB.
+type ACLEvaluator struct {
+	db DB
+}
+
+// NewACLEvaluator returns an evaluator for the ACLs in the given DB.
+func NewACLEvaluator(db DB) ACLEvaluator {
+	return ACLEvaluator{db: db}
+}
+
+// Can returns whether the identity is allowed to do the action on the node. All rules linked to the node and to
+// all its ancestors apply. If any rule denies the action, it is not allowed. Else, the action is allowed if any
+// rule allows it. Admin rights imply write rights, and write rights imply read rights.
+// Rules for a group apply to all identities of the group and of its nested groups.
+func (acl ACLEvaluator) Can(identity NodeID, action ACLAction, node NodeID) (bool, error) {
+	rules, err := acl.rules(node)
+	if err != nil {
+		return false, err
+	}
+	allowed := false
+	for _, r := range rules {
+		match, err := acl.matches(r.Principal, identity)
+		if err != nil {
+			return false, err
+		}
+		if !match {
+			continue
+		}
+		if r.Deny {
+			// Denying read also denies write and admin, as they imply read.
+			if action.implied()&r.Actions > 0 {
+				return false, nil
+			}
+			continue
+		}
+		if r.Actions.implied()&action == action {
+			allowed = true
+		}
+	}
+	return allowed, nil
+}
+
+// matches returns true if the principal of a rule is the identity, or a group containing the identity.
+// If the members of the group cannot be read, an error is returned, so that callers deny the action.
+func (acl ACLEvaluator) matches(principal, identity NodeID) (bool, error) {
+	if bytes.Compare(principal, identity) == 0 {
+		return true, nil
+	}
+	if !acl.db.isGroup(principal) {
+		return false, nil
+	}
+	ids, err := acl.db.GroupIdentities(principal)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get identities of group: %v", err)
+	}
+	for _, id := range ids {
+		if bytes.Compare(id, identity) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rules returns all ACLs that apply to the node, by searching all ancestors of the node.
+func (acl ACLEvaluator) rules(node NodeID) (rules []ACL, err error) {
+	visited := map[string]bool{string(node): true}
+	todo := []NodeID{node}
+	for len(todo) > 0 {
+		current := todo[0]
+		todo = todo[1:]
+		ancestors, err := acl.db.GetAncestors(current)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get ancestors: %v", err)
+		}
+		for _, id := range ancestors {
+			if visited[string(id)] {
+				continue
+			}
+			visited[string(id)] = true
+			// Only the type is needed for the ancestors, so they don't need to be decrypted.
+			a, err := acl.db.getLatest(id)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get ancestor: %v", err)
+			}
+			if a.Type == NodeACL {
+				if a, err = acl.db.GetLatest(id); err != nil {
+					return nil, fmt.Errorf("couldn't get acl: %v", err)
+				}
+				r, err := NewACLFromNode(a)
+				if err != nil {
+					return nil, err
+				}
+				rules = append(rules, r)
+				continue
+			}
+			todo = append(todo, id)
+		}
+	}
+	return
+}
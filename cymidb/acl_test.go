@@ -0,0 +1,76 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLEvaluator_Can(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "tmp", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	alice, err := NewIdentity("alice", nil)
+	require.NoError(t, err)
+	bob, err := NewIdentity("bob", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(alice, bob))
+	aliceID, bobID := alice.node.NodeID, bob.node.NodeID
+
+	root := NewDir("/", 0777)
+	docs := NewDir("Documents", 0777)
+	private := NewDir("Private", 0777)
+	todo := NewFile("TODO.md", 0777)
+	secret := NewFile("secret.txt", 0777)
+	require.NoError(t, db.SaveNode(root, docs, private, todo, secret))
+	require.NoError(t, root.AddSubdir(db, docs))
+	require.NoError(t, docs.AddSubdir(db, private))
+	require.NoError(t, docs.AddFile(db, todo))
+	require.NoError(t, private.AddFile(db, secret))
+	// A loop in the graph must not hang the evaluation.
+	require.NoError(t, db.AddLink(todo, docs))
+
+	require.NoError(t, NewACL(aliceID, ACLAdmin).Protect(db, root))
+	require.NoError(t, NewACL(bobID, ACLRead).Protect(db, docs))
+	require.NoError(t, NewACLDeny(bobID, ACLRead).Protect(db, private))
+	require.NoError(t, NewACLDeny(aliceID, ACLWrite).Protect(db, secret))
+
+	acl := NewACLEvaluator(db)
+	for _, c := range []struct {
+		identity NodeID
+		action   ACLAction
+		node     Noder
+		can      bool
+	}{
+		{aliceID, ACLAdmin, root, true},
+		{aliceID, ACLWrite, todo, true},
+		{aliceID, ACLRead, secret, true},
+		{aliceID, ACLWrite, secret, false},
+		{aliceID, ACLAdmin, secret, false},
+		{bobID, ACLRead, root, false},
+		{bobID, ACLRead, docs, true},
+		{bobID, ACLRead, todo, true},
+		{bobID, ACLWrite, todo, false},
+		{bobID, ACLRead, private, false},
+		{bobID, ACLRead, secret, false},
+		{RandomNodeID(), ACLRead, todo, false},
+	} {
+		n, err := c.node.GetNode()
+		require.NoError(t, err)
+		can, err := acl.Can(c.identity, c.action, n.NodeID)
+		require.NoError(t, err)
+		require.Equal(t, c.can, can, "%+v", c)
+	}
+
+	// If the members of a group cannot be read, the action is denied with an error.
+	group := NewGroup("friends")
+	group.Members = []NodeID{bobID}
+	require.NoError(t, db.SaveNode(group))
+	require.NoError(t, NewACLDeny(group.node.NodeID, ACLRead).Protect(db, todo))
+	require.NoError(t, db.gdb.Model(&Node{}).Where("node_id = ?", []byte(group.node.NodeID)).
+		Update("data", []byte("corrupt")).Error)
+	can, err := acl.Can(bobID, ACLRead, todo.node.NodeID)
+	require.Error(t, err)
+	require.False(t, can)
+}
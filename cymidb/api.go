@@ -0,0 +1,113 @@
+package cymidb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API is the HTTP interface of a device. It serves the REST interface of external hooks, described in
+// api_hooks.go, and nodes to holders of a capability:
+//
+//	GET /v1/capability/<token>
+//
+// returns the node of the capability. For a FileData it returns the data itself, for a File the data of its
+// latest FileData, and for a Dir a JSON listing of its entries.
+type API struct {
+	db       DB
+	mux      *http.ServeMux
+	registry hookRegistry
+}
+
+// apiEntry is one entry of a directory listing.
+type apiEntry struct {
+	ID   NodeID
+	Name string
+	Dir  bool
+}
+
+// NewAPI returns the API for the given DB.
+func NewAPI(db DB) *API {
+	api := &API{db: db, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/v1/capability/", api.handleCapability)
+	api.mux.HandleFunc("/v1/hooks", api.handleHooks)
+	api.mux.HandleFunc("/v1/hooks/", api.handleHooks)
+	return api
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *API) handleCapability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := ParseCapability(strings.TrimPrefix(r.URL.Path, "/v1/capability/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = api.db.VerifyCapability(c, ACLRead, c.Node); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	n, err := api.db.GetLatest(c.Node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err = api.serveNode(w, n); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveNode writes the content of a File, FileData or Dir node.
+func (api *API) serveNode(w http.ResponseWriter, n Node) error {
+	switch n.Type {
+	case NodeTypeFileData:
+		fd, err := NewFileDataFromNode(n)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(fd.Data)
+		return err
+	case NodeTypeFile:
+		children, err := api.db.GetChildrenNodes(n.NodeID)
+		if err != nil {
+			return fmt.Errorf("couldn't get file data: %v", err)
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			if children[i].Type == NodeTypeFileData {
+				return api.serveNode(w, children[i])
+			}
+		}
+		return fmt.Errorf("file has no data")
+	case NodeTypeDir:
+		d, err := NewDirFromNode(n)
+		if err != nil {
+			return err
+		}
+		var entries []apiEntry
+		dirs, err := d.GetDirs(api.db)
+		if err != nil {
+			return err
+		}
+		for _, sd := range dirs {
+			entries = append(entries, apiEntry{ID: sd.node.NodeID, Name: sd.Name, Dir: true})
+		}
+		files, err := d.GetFiles(api.db)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			entries = append(entries, apiEntry{ID: f.node.NodeID, Name: f.Name})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(entries)
+	}
+	return fmt.Errorf("nodes of this type cannot be served")
+}
@@ -0,0 +1,573 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The REST interface for hooks running out of process. A hook registers itself once with the secret given to
+// AllowHookRegistration, and then uses the returned token for all other requests:
+//
+//	GET    /v1/hooks                 list the HookHealth of all hooks, only with the registration secret
+//	POST   /v1/hooks                 register a hook, returns its ID and token
+//	GET    /v1/hooks/<id>            get the name, types and configuration of the hook
+//	GET    /v1/hooks/<id>/events     long-poll the events not yet acknowledged, ?wait=30s&max=100
+//	POST   /v1/hooks/<id>/ack        acknowledge all events up to a sequence number
+//	POST   /v1/hooks/<id>/nodes      save a node
+//	POST   /v1/hooks/<id>/links      add a link
+//	DELETE /v1/hooks/<id>/links      remove a link
+//
+// Hooks registered with a webhook URL get their events POSTed to that URL instead, by the "remote" hook module.
+// The requests carry the HMAC of their body in the WebhookSignatureHeader, so the service can check them with
+// VerifyWebhook. As the events are decrypted, only hooks whose Hook node is signed by the active device are run.
+// All writes go through the HookDB of the hook, so they're validated like the writes of in-process hooks.
+// The Hook node is not encrypted: its configuration, including the webhook URL, is readable by every DB the node is
+// synced with. Secrets like the webhook key are kept in local settings.
+
+// ModuleRemote is the name of the hook module used for hooks registered through the API.
+const ModuleRemote = "remote"
+
+// settingHookToken prefixes the local setting holding the hash of the token of a hook.
+const settingHookToken = "hook_token_"
+
+// settingWebhookKey prefixes the local setting holding the key to sign the webhook requests of a hook.
+const settingWebhookKey = "hook_webhook_key_"
+
+// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the body of a webhook request, keyed with the
+// WebhookKey of the hook.
+const WebhookSignatureHeader = "X-Cymidb-Signature"
+
+// Defaults for long-polling events.
+const (
+	apiDefaultWait = 30 * time.Second
+	apiMaxWait     = 5 * time.Minute
+	apiDefaultMax  = 100
+	// apiPollGrace is how long to wait for more events once an event has been received.
+	apiPollGrace = 10 * time.Millisecond
+)
+
+// HookRegistration is sent to register a hook.
+type HookRegistration struct {
+	Name  string
+	Types []NodeType
+	// Webhook is the URL the events are POSTed to. If it is empty, the hook has to poll for events.
+	Webhook string
+}
+
+// HookCredentials are returned when a hook is registered.
+type HookCredentials struct {
+	// ID is the NodeID of the hook, hex encoded as in the URLs.
+	ID    string
+	Token string
+}
+
+// APIHook describes a registered hook. Config holds its settings on the device of the API, and Root is the node
+// whose subgraph the hook can write.
+type APIHook struct {
+	ID     string
+	Name   string
+	Types  []NodeType
+	Config map[string]string
+	Root   NodeID
+}
+
+// APINode is a node as sent and received by hooks.
+type APINode struct {
+	NodeID  NodeID
+	Type    NodeType
+	Version uint64
+	Data    []byte
+}
+
+// APILink is a link as sent and received by hooks.
+type APILink struct {
+	From   NodeID
+	To     NodeID
+	Origin string `json:",omitempty"`
+}
+
+// APIEvent is an event as sent to hooks.
+type APIEvent struct {
+	Seq    uint
+	Kind   EventKind
+	Node   APINode
+	Old    *APINode `json:",omitempty"`
+	Link   *APILink `json:",omitempty"`
+	Device NodeID
+}
+
+// APIAck acknowledges the events up to Seq.
+type APIAck struct {
+	Seq uint
+}
+
+// hookRegistry holds the secret that allows hooks to register.
+type hookRegistry struct {
+	sync.Mutex
+	secret string
+}
+
+// AllowHookRegistration enables the registration of hooks for clients knowing the secret.
+// An empty secret disables the registration.
+func (api *API) AllowHookRegistration(secret string) {
+	api.registry.Lock()
+	defer api.registry.Unlock()
+	api.registry.secret = secret
+}
+
+func (api *API) handleHooks(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/hooks"), "/")
+	if path == "" {
+		api.handleRegister(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	h, err := api.authHook(r, parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		settings, err := h.Settings(api.db.Device.node.NodeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, APIHook{ID: parts[0], Name: h.Name, Types: h.Types, Config: settings, Root: h.Scope.Root})
+		return
+	}
+	switch {
+	case parts[1] == "events" && r.Method == http.MethodGet:
+		api.handleEvents(w, r, h)
+	case parts[1] == "ack" && r.Method == http.MethodPost:
+		api.handleAck(w, r, h)
+	case parts[1] == "nodes" && r.Method == http.MethodPost:
+		api.handleNode(w, r, h)
+	case parts[1] == "links" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		api.handleLink(w, r, h)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *API) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	api.registry.Lock()
+	secret := api.registry.secret
+	api.registry.Unlock()
+	if secret == "" || !checkBearer(r, []byte(secret)) {
+		http.Error(w, "registration not allowed", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		api.handleHealth(w)
+		return
+	}
+	var reg HookRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	creds, err := api.db.RegisterRemoteHook(reg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, creds)
+}
+
+func (api *API) handleHealth(w http.ResponseWriter) {
+	if api.db.Hooks() == nil {
+		http.Error(w, "hooks are not running", http.StatusServiceUnavailable)
+		return
+	}
+	health, err := api.db.Hooks().Health()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if health == nil {
+		health = []HookHealth{}
+	}
+	writeJSON(w, health)
+}
+
+// RegisterRemoteHook creates a hook running on the active device and implemented by an external service, and
+// returns the token the service uses to authenticate. The hook receives the events of its types and gets a new
+// directory as the root of its scope, but as the scope is set up by the user, it cannot write anything until the
+// user grants it types with GrantHookTypes. The user can link the directory wherever the nodes should show up.
+func (db DB) RegisterRemoteHook(reg HookRegistration) (creds HookCredentials, err error) {
+	if reg.Name == "" {
+		return creds, errors.New("hook needs a name")
+	}
+	root := NewDir(reg.Name, 0700)
+	if err = db.SaveNode(root); err != nil {
+		return creds, fmt.Errorf("couldn't save root of hook: %v", err)
+	}
+	h := NewHook(reg.Name, []NodeID{db.Device.node.NodeID}, reg.Types)
+	h.Module = ModuleRemote
+	h.Scope = HookScope{Root: root.node.NodeID}
+	if reg.Webhook != "" {
+		if err = h.SetSetting("webhook", reg.Webhook); err != nil {
+			return creds, err
+		}
+	}
+	token := make([]byte, 32)
+	if _, err = rand.Read(token); err != nil {
+		return creds, fmt.Errorf("couldn't create token: %v", err)
+	}
+	creds.ID = hex.EncodeToString(h.node.NodeID)
+	creds.Token = hex.EncodeToString(token)
+	hash := sha256.Sum256([]byte(creds.Token))
+	if err = db.setLocal(settingHookToken+creds.ID, hash[:]); err != nil {
+		return creds, err
+	}
+	if err = db.setLocal(settingWebhookKey+creds.ID, WebhookKey(creds.Token)); err != nil {
+		return creds, err
+	}
+	if err = db.SaveNode(h); err != nil {
+		return creds, fmt.Errorf("couldn't save hook: %v", err)
+	}
+	return creds, nil
+}
+
+// GrantHookTypes lets the hook with the given id create and modify nodes of the types in its scope. It is called
+// by the user, as a hook cannot extend its own scope.
+func (db DB) GrantHookTypes(id NodeID, types ...NodeType) error {
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return fmt.Errorf("couldn't get hook: %v", err)
+	}
+	h, err := NewHookFromNode(db, n)
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		if len(h.Scope.Types) == 0 || !t.Matches(h.Scope.Types) {
+			h.Scope.Types = append(h.Scope.Types, t)
+		}
+	}
+	if err = db.SaveNode(h); err != nil {
+		return fmt.Errorf("couldn't save hook: %v", err)
+	}
+	return nil
+}
+
+// WebhookKey returns the key used to sign the webhook requests of the hook with the given token.
+func WebhookKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("cymidb webhook"))
+	return mac.Sum(nil)
+}
+
+// VerifyWebhook returns true if the signature from the WebhookSignatureHeader matches the body of the request
+// sent to the hook with the given token.
+func VerifyWebhook(token string, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, webhookSignature(WebhookKey(token), body))
+}
+
+func webhookSignature(key, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// authHook returns the hook with the given hex ID if the request carries its token.
+func (api *API) authHook(r *http.Request, idHex string) (h Hook, err error) {
+	hash, err := api.db.getLocal(settingHookToken + idHex)
+	if err != nil {
+		return h, errors.New("unknown hook")
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(auth))
+	if subtle.ConstantTimeCompare(sum[:], hash) != 1 {
+		return h, errors.New("wrong token")
+	}
+	id, err := hex.DecodeString(idHex)
+	if err != nil {
+		return h, fmt.Errorf("invalid hook ID: %v", err)
+	}
+	n, err := api.db.GetLatest(id)
+	if err != nil {
+		return h, fmt.Errorf("couldn't get hook: %v", err)
+	}
+	return NewHookFromNode(api.db, n)
+}
+
+func (api *API) handleEvents(w http.ResponseWriter, r *http.Request, h Hook) {
+	wait, max := apiDefaultWait, apiDefaultMax
+	if s := r.URL.Query().Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 || d > apiMaxWait {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	if s := r.URL.Query().Get("max"); s != "" {
+		m, err := strconv.Atoi(s)
+		if err != nil || m < 1 {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+		max = m
+	}
+	sub, err := h.SubscribeDurable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	// Wait for the first event, then take all events that follow right away.
+	events := []APIEvent{}
+	deadline := time.Now().Add(wait)
+	for len(events) < max {
+		d := apiPollGrace
+		if rest := time.Until(deadline); len(events) == 0 && rest > d {
+			d = rest
+		}
+		select {
+		case e := <-sub.C:
+			events = append(events, NewAPIEvent(e))
+			continue
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+		break
+	}
+	writeJSON(w, events)
+}
+
+func (api *API) handleAck(w http.ResponseWriter, r *http.Request, h Hook) {
+	var ack APIAck
+	if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.ackHook(h.node.NodeID, ack.Seq); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (api *API) handleNode(w http.ResponseWriter, r *http.Request, h Hook) {
+	var an APINode
+	if err := json.NewDecoder(r.Body).Decode(&an); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := NewNode(an.Type)
+	if len(an.NodeID) > 0 {
+		n.NodeID = an.NodeID
+	}
+	n.Data = an.Data
+	if err := NewHookDB(api.db, h).SaveNode(n); err != nil {
+		writeHookError(w, err)
+		return
+	}
+	saved, err := api.db.GetLatest(n.NodeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, newAPINode(saved))
+}
+
+func (api *API) handleLink(w http.ResponseWriter, r *http.Request, h Hook) {
+	var al APILink
+	if err := json.NewDecoder(r.Body).Decode(&al); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to := Node{NodeID: al.From}, Node{NodeID: al.To}
+	var err error
+	if r.Method == http.MethodPost {
+		err = NewHookDB(api.db, h).AddLink(from, to)
+	} else {
+		err = NewHookDB(api.db, h).RemoveLink(from, to)
+	}
+	if err != nil {
+		writeHookError(w, err)
+	}
+}
+
+// NewAPIEvent converts the event to the form sent to hooks.
+func NewAPIEvent(e Event) APIEvent {
+	ae := APIEvent{Seq: e.Seq, Kind: e.Kind, Node: newAPINode(e.Node), Device: e.Device}
+	if len(e.Old.NodeID) > 0 {
+		old := newAPINode(e.Old)
+		ae.Old = &old
+	}
+	if e.Kind == EventLinkAdded || e.Kind == EventLinkRemoved {
+		ae.Link = &APILink{From: e.Link.From, To: e.Link.To, Origin: e.Link.Origin}
+	}
+	return ae
+}
+
+func newAPINode(n Node) APINode {
+	return APINode{NodeID: n.NodeID, Type: n.Type, Version: n.Version, Data: n.Data}
+}
+
+// ackHook moves the cursor of the hook.
+func (db DB) ackHook(hook NodeID, seq uint) error {
+	s := &Subscription{hook: hook, db: db}
+	return s.Ack(seq)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeHookError(w http.ResponseWriter, err error) {
+	if err == ErrHookScope {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func checkBearer(r *http.Request, secret []byte) bool {
+	auth := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	return subtle.ConstantTimeCompare(auth, secret) == 1
+}
+
+// webhook is the hook module for hooks registered through the API with a webhook URL. Every event is POSTed as
+// a JSON array with a single APIEvent, and acknowledged once the service answers with a 2xx status. Failed
+// deliveries are reported to the HookManager and retried until they succeed, or the hook is paused.
+type webhook struct {
+	db     DB
+	hook   Hook
+	url    string
+	key    []byte
+	client *http.Client
+	sub    *Subscription
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Failed deliveries are retried after webhookRetry, doubling the delay with every failure up to webhookRetryMax.
+var (
+	webhookRetry    = time.Second
+	webhookRetryMax = 5 * time.Minute
+)
+
+func init() {
+	RegisterHookSettings(ModuleRemote, SettingsSchema{
+		{Name: "webhook", Description: "URL the events are sent to, if the hook doesn't poll"},
+	})
+	RegisterHookModule(ModuleRemote, func(hdb HookDB) (HookModule, error) {
+		db, h := hdb.db, hdb.hook
+		s, err := hdb.Settings()
+		if err != nil {
+			return nil, err
+		}
+		wh := &webhook{db: db, hook: h, url: s.String("webhook"), client: &http.Client{Timeout: 30 * time.Second}}
+		if wh.url != "" {
+			if wh.key, err = db.getLocal(settingWebhookKey + hex.EncodeToString(h.node.NodeID)); err != nil {
+				return nil, errors.New("hook has not been registered on this device")
+			}
+		}
+		return wh, nil
+	})
+}
+
+func (wh *webhook) Start() (err error) {
+	if wh.url == "" {
+		// The hook polls for its events.
+		return nil
+	}
+	if wh.sub, err = wh.hook.SubscribeDurable(); err != nil {
+		return err
+	}
+	wh.stop = make(chan struct{})
+	wh.done = make(chan struct{})
+	go wh.run()
+	return nil
+}
+
+func (wh *webhook) Stop() error {
+	if wh.sub == nil {
+		return nil
+	}
+	close(wh.stop)
+	wh.sub.Close()
+	<-wh.done
+	return nil
+}
+
+func (wh *webhook) run() {
+	defer close(wh.done)
+	for e := range wh.sub.C {
+		backoff := webhookRetry
+		for {
+			err := wh.post(e)
+			wh.db.reportHook(wh.hook.node.NodeID, err)
+			if err == nil {
+				break
+			}
+			select {
+			case <-wh.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > webhookRetryMax {
+				backoff = webhookRetryMax
+			}
+		}
+		if err := wh.sub.Ack(e.Seq); err != nil {
+			return
+		}
+	}
+}
+
+func (wh *webhook) post(e Event) error {
+	body, err := json.Marshal([]APIEvent{NewAPIEvent(e)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, hex.EncodeToString(webhookSignature(wh.key, body)))
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package cymidb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hookClient does the requests of an external hook.
+type hookClient struct {
+	t     *testing.T
+	url   string
+	creds HookCredentials
+}
+
+func (hc hookClient) do(method, path string, in, out interface{}) int {
+	var body bytes.Buffer
+	if in != nil {
+		require.NoError(hc.t, json.NewEncoder(&body).Encode(in))
+	}
+	req, err := http.NewRequest(method, hc.url+"/v1/hooks/"+hc.creds.ID+path, &body)
+	require.NoError(hc.t, err)
+	req.Header.Set("Authorization", "Bearer "+hc.creds.Token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(hc.t, err)
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		require.NoError(hc.t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func register(t *testing.T, url, secret string, reg HookRegistration) (int, HookCredentials) {
+	body, err := json.Marshal(reg)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/hooks", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var creds HookCredentials
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&creds))
+	}
+	return resp.StatusCode, creds
+}
+
+func TestAPI_HookPoll(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	api := NewAPI(db)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	reg := HookRegistration{Name: "indexer", Types: []NodeType{NodeBlob}}
+	status, _ := register(t, srv.URL, "", reg)
+	require.Equal(t, http.StatusUnauthorized, status)
+	api.AllowHookRegistration("secret")
+	status, _ = register(t, srv.URL, "wrong", reg)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, creds := register(t, srv.URL, "secret", reg)
+	require.Equal(t, http.StatusOK, status)
+	hc := hookClient{t: t, url: srv.URL, creds: creds}
+	var info APIHook
+	require.Equal(t, http.StatusOK, hc.do(http.MethodGet, "", nil, &info))
+	require.Equal(t, "indexer", info.Name)
+	require.Equal(t, reg.Types, info.Types)
+	hooks, err := db.GetNodesByType(NodeHook)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(hooks))
+
+	// The directory created as the root of the hook comes first.
+	fd := NewFileData([]byte("hello"))
+	require.NoError(t, db.SaveNode(fd))
+	var events []APIEvent
+	require.Equal(t, http.StatusOK, hc.do(http.MethodGet, "/events?wait=1s", nil, &events))
+	require.Equal(t, 2, len(events))
+	require.Equal(t, info.Root, events[0].Node.NodeID)
+	require.Equal(t, fd.node.NodeID, events[1].Node.NodeID)
+	fdNode, err := fd.GetNode()
+	require.NoError(t, err)
+	require.Equal(t, fdNode.Data, events[1].Node.Data)
+
+	// Unacknowledged events are sent again, acknowledged events are not.
+	require.Equal(t, http.StatusOK, hc.do(http.MethodGet, "/events?wait=0s", nil, &events))
+	require.Equal(t, 2, len(events))
+	require.Equal(t, http.StatusOK, hc.do(http.MethodPost, "/ack", APIAck{Seq: events[1].Seq}, nil))
+	require.Equal(t, http.StatusOK, hc.do(http.MethodGet, "/events?wait=0s", nil, &events))
+	require.Equal(t, 0, len(events))
+
+	// Long-poll returns as soon as an event arrives.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, db.SaveNode(NewFileData([]byte("later"))))
+	}()
+	require.Equal(t, http.StatusOK, hc.do(http.MethodGet, "/events?wait=10s", nil, &events))
+	require.Equal(t, 1, len(events))
+
+	// Writes are validated, and the hook can only write the types granted by the user.
+	var saved APINode
+	require.Equal(t, http.StatusForbidden, hc.do(http.MethodPost, "/nodes",
+		APINode{Type: NodeTypeFileData, Data: []byte("summary")}, &saved))
+	id, err := hex.DecodeString(creds.ID)
+	require.NoError(t, err)
+	require.NoError(t, db.GrantHookTypes(id, NodeTypeFileData))
+	require.Equal(t, http.StatusOK, hc.do(http.MethodPost, "/nodes",
+		APINode{Type: NodeTypeFileData, Data: []byte("summary")}, &saved))
+	require.Equal(t, uint64(0), saved.Version)
+	require.Equal(t, http.StatusForbidden, hc.do(http.MethodPost, "/links",
+		APILink{From: fd.node.NodeID, To: saved.NodeID}, nil))
+	require.NoError(t, db.AddLink(Node{NodeID: info.Root}, fd))
+	require.Equal(t, http.StatusOK, hc.do(http.MethodPost, "/links", APILink{From: fd.node.NodeID, To: saved.NodeID},
+		nil))
+	children, err := db.GetChildren(fd.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, []NodeID{saved.NodeID}, children)
+	require.Equal(t, http.StatusOK, hc.do(http.MethodDelete, "/links",
+		APILink{From: fd.node.NodeID, To: saved.NodeID}, nil))
+	require.Equal(t, http.StatusForbidden, hc.do(http.MethodPost, "/nodes", APINode{Type: NodeACL}, nil))
+	require.Equal(t, http.StatusBadRequest, hc.do(http.MethodPost, "/links",
+		APILink{From: fd.node.NodeID, To: RandomNodeID()}, nil))
+
+	wrong := hc
+	wrong.creds.Token = "00"
+	require.Equal(t, http.StatusUnauthorized, wrong.do(http.MethodGet, "/events?wait=0s", nil, nil))
+}
+
+func TestAPI_HookWebhook(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	received := make(chan APIEvent, 10)
+	var token atomic.Value
+	token.Store("")
+	var failures int32 = 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if !VerifyWebhook(token.Load().(string), body, r.Header.Get(WebhookSignatureHeader)) {
+			http.Error(w, "wrong signature", http.StatusUnauthorized)
+			return
+		}
+		var events []APIEvent
+		require.NoError(t, json.Unmarshal(body, &events))
+		for _, e := range events {
+			received <- e
+		}
+	}))
+	defer receiver.Close()
+	defer func(d time.Duration) { webhookRetry = d }(webhookRetry)
+	webhookRetry = 10 * time.Millisecond
+
+	creds, err := db.RegisterRemoteHook(HookRegistration{Name: "notifier", Types: []NodeType{NodeBlob},
+		Webhook: receiver.URL})
+	require.NoError(t, err)
+	token.Store(creds.Token)
+	fd := NewFileData([]byte("hello"))
+	require.NoError(t, db.SaveNode(fd))
+
+	// The first event is the root directory of the hook.
+	for _, id := range []NodeID{nil, fd.node.NodeID} {
+		select {
+		case e := <-received:
+			if id != nil {
+				require.Equal(t, id, e.Node.NodeID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook didn't receive the event")
+		}
+	}
+	require.False(t, VerifyWebhook("wrong", []byte("[]"), hex.EncodeToString(webhookSignature(WebhookKey(creds.Token),
+		[]byte("[]")))))
+	id, err := hex.DecodeString(creds.ID)
+	require.NoError(t, err)
+	hook, err := db.GetLatest(id)
+	require.NoError(t, err)
+	h, err := NewHookFromNode(db, hook)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		lag, err := h.Lag()
+		return err == nil && lag.Pending == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,65 @@
+package cymidb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPI_Capability(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	dir := NewDir("Reports", 0777)
+	file := NewFile("report.txt", 0644)
+	fd := NewFileData([]byte("quarterly numbers"))
+	require.NoError(t, db.SaveNode(dir, file, fd))
+	require.NoError(t, dir.AddFile(db, file))
+	require.NoError(t, file.AddData(db, fd))
+
+	srv := httptest.NewServer(NewAPI(db))
+	defer srv.Close()
+	get := func(n Noder) (int, []byte) {
+		c, err := db.IssueCapability(n, ACLRead, time.Hour)
+		require.NoError(t, err)
+		token, err := c.Token()
+		require.NoError(t, err)
+		r, err := http.Get(srv.URL + "/v1/capability/" + token)
+		require.NoError(t, err)
+		defer r.Body.Close()
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		return r.StatusCode, body
+	}
+
+	status, body := get(file)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, fd.Data, body)
+
+	status, body = get(dir)
+	require.Equal(t, http.StatusOK, status)
+	var entries []apiEntry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "report.txt", entries[0].Name)
+
+	r, err := http.Get(srv.URL + "/v1/capability/invalid")
+	require.NoError(t, err)
+	r.Body.Close()
+	require.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	c, err := db.IssueCapability(file, ACLRead, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, db.RevokeCapability(c.ID))
+	token, err := c.Token()
+	require.NoError(t, err)
+	r, err = http.Get(srv.URL + "/v1/capability/" + token)
+	require.NoError(t, err)
+	r.Body.Close()
+	require.Equal(t, http.StatusForbidden, r.StatusCode)
+}
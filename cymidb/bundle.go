@@ -0,0 +1,234 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Bundle holds nodes and links that are transferred from one DB to another.
+type Bundle struct {
+	Nodes    []Node
+	Links    []Link
+	Removals []LinkRemoval
+}
+
+// Export returns a bundle with all versions of all nodes, all links and all link removals of this DB.
+func (db DB) Export() (b Bundle, err error) {
+	err = db.gdb.Order("id").Find(&b.Nodes).Error
+	if err != nil {
+		return b, fmt.Errorf("couldn't get nodes: %v", err)
+	}
+	err = db.gdb.Order("id").Find(&b.Links).Error
+	if err != nil {
+		return b, fmt.Errorf("couldn't get links: %v", err)
+	}
+	err = db.gdb.Order("id").Find(&b.Removals).Error
+	if err != nil {
+		return b, fmt.Errorf("couldn't get link removals: %v", err)
+	}
+	return
+}
+
+// Import stores all nodes, links and link removals of the bundle that are not yet in this DB. The nodes are stored
+// with their original signatures. The links to and from endorsements are imported before the other nodes are
+// verified, so that nodes of a device revoked in the same bundle are rejected. If any of the new nodes, links or
+// removals doesn't verify, the import fails and nothing is stored.
+// Links and removals are ordered by the time they have been signed: a removal removes the links of this DB that
+// have been signed before it, and a link is only added if it has been signed after all removals of this link.
+// Links that are older than a removal are skipped.
+func (db DB) Import(b Bundle) error {
+	return db.transaction(func(tx DB) (events []pendingEvent, err error) {
+		changes, err := tx.importBundle(b)
+		if err != nil {
+			return nil, err
+		}
+		for i, n := range changes.nodes {
+			e, err := tx.recordNode(EventNodeSaved, n, changes.old[i], n.Signer)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, e)
+		}
+		for _, l := range changes.removed {
+			e, err := tx.recordLink(EventLinkRemoved, l)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, e)
+		}
+		for _, l := range changes.added {
+			e, err := tx.recordLink(EventLinkAdded, l)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, e)
+		}
+		return events, nil
+	})
+}
+
+// importChanges holds what has been changed by an import, so it can be recorded in the timeline.
+type importChanges struct {
+	nodes []Node
+	// old holds the previous version of every imported node.
+	old            []Node
+	added, removed []Link
+}
+
+func (db DB) importBundle(b Bundle) (changes importChanges, err error) {
+	for _, n := range b.Nodes {
+		var count int
+		err = db.gdb.Model(&Node{}).Where("node_id = ? AND version = ?", []byte(n.NodeID), n.Version).
+			Count(&count).Error
+		if err != nil {
+			return changes, fmt.Errorf("couldn't search node: %v", err)
+		}
+		if count > 0 {
+			continue
+		}
+		old, _ := db.getLatest(n.NodeID)
+		n.Model = gorm.Model{}
+		if err = db.gdb.Create(&n).Error; err != nil {
+			return changes, fmt.Errorf("couldn't store node: %v", err)
+		}
+		changes.nodes = append(changes.nodes, n)
+		changes.old = append(changes.old, old)
+	}
+	// The endorsements are needed to verify the nodes.
+	var links []Link
+	for _, l := range b.Links {
+		if !db.endorsementLink(l) {
+			links = append(links, l)
+			continue
+		}
+		if err = db.importLink(l, &changes); err != nil {
+			return changes, err
+		}
+	}
+	for _, n := range changes.nodes {
+		if err = db.VerifyNode(n); err != nil {
+			return changes, fmt.Errorf("couldn't verify node %x: %v", n.NodeID, err)
+		}
+	}
+	for _, r := range b.Removals {
+		var count int
+		err = db.gdb.Model(&LinkRemoval{}).Where("signer = ? AND signed_at = ? AND \"from\" = ? AND \"to\" = ?",
+			[]byte(r.Signer), r.SignedAt, []byte(r.From), []byte(r.To)).Count(&count).Error
+		if err != nil {
+			return changes, fmt.Errorf("couldn't search link removal: %v", err)
+		}
+		if count > 0 {
+			continue
+		}
+		if err = db.verifyRemoval(r); err != nil {
+			return changes, fmt.Errorf("couldn't verify link removal: %v", err)
+		}
+		r.Model = gorm.Model{}
+		if err = db.gdb.Create(&r).Error; err != nil {
+			return changes, fmt.Errorf("couldn't store link removal: %v", err)
+		}
+		var existing []Link
+		err = db.gdb.Where(&Link{From: r.From, To: r.To}).Where("signed_at < ?", r.SignedAt).Find(&existing).Error
+		if err != nil {
+			return changes, fmt.Errorf("couldn't search link: %v", err)
+		}
+		for _, e := range existing {
+			if err = db.gdb.Delete(&e).Error; err != nil {
+				return changes, fmt.Errorf("couldn't remove link: %v", err)
+			}
+			changes.removed = append(changes.removed, e)
+		}
+	}
+	for _, l := range links {
+		if err = db.importLink(l, &changes); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// endorsementLink returns true if the link goes from or to an endorsement.
+func (db DB) endorsementLink(l Link) bool {
+	for _, id := range []NodeID{l.From, l.To} {
+		if n, err := db.getLatest(id); err == nil && n.Type == NodeTypeEndorsement {
+			return true
+		}
+	}
+	return false
+}
+
+// importLink verifies and stores the link, unless it is already stored or has been removed after it was signed.
+func (db DB) importLink(l Link, changes *importChanges) error {
+	var count int
+	err := db.gdb.Model(&Link{}).Where(&Link{From: l.From, To: l.To}).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("couldn't search link: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if err = db.verifyLink(l); err != nil {
+		return fmt.Errorf("couldn't verify link: %v", err)
+	}
+	err = db.gdb.Model(&LinkRemoval{}).Where("\"from\" = ? AND \"to\" = ? AND signed_at > ?",
+		[]byte(l.From), []byte(l.To), l.SignedAt).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("couldn't search link removal: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	link := Link{From: l.From, To: l.To, Origin: l.Origin, Signer: l.Signer, SignedAt: l.SignedAt,
+		Signature: l.Signature}
+	if err = db.gdb.Create(&link).Error; err != nil {
+		return fmt.Errorf("couldn't store link: %v", err)
+	}
+	changes.added = append(changes.added, link)
+	return nil
+}
+
+// verifyRemoval checks the signature of the link removal against the device that signed it.
+func (db DB) verifyRemoval(r LinkRemoval) error {
+	return db.verifyDeviceSignature(r.Signer, r.hash(), r.Signature)
+}
+
+// verifyLink checks the signature of the link against the device that signed it.
+func (db DB) verifyLink(l Link) error {
+	return db.verifyDeviceSignature(l.Signer, l.hash(), l.Signature)
+}
+
+// verifyDeviceSignature checks the signature of a link or a link removal against the device that signed it.
+// Devices whose endorsement has been revoked are rejected, as the SignedAt they sign cannot be trusted.
+func (db DB) verifyDeviceSignature(signer NodeID, hash, signature []byte) error {
+	dn, err := db.getLatest(signer)
+	if err != nil {
+		return fmt.Errorf("couldn't get signing device: %v", err)
+	}
+	if err = db.VerifyNode(dn); err != nil {
+		return fmt.Errorf("couldn't verify signing device: %v", err)
+	}
+	dev, err := NewDeviceFromNode(dn)
+	if err != nil {
+		return fmt.Errorf("signer is not a device: %v", err)
+	}
+	if bytes.Compare(dn.Signer, dn.NodeID) != 0 {
+		return errors.New("signing device is not self-signed")
+	}
+	if !ed25519.Verify(dev.PublicKey, hash, signature) {
+		return errors.New("invalid signature")
+	}
+	endorsements, err := db.GetEndorsements(signer)
+	if err != nil {
+		return err
+	}
+	for _, e := range endorsements {
+		if e.Revoked != 0 {
+			return errors.New("signing device has been revoked")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Capability is a token that allows whoever holds it to do the actions on a single node, until it expires.
+// It is signed by the device that issued it, so it can be handed to someone without an identity, and be verified
+// by the API of any device that trusts the issuing device. A capability is revoked by storing a CapabilityRevocation
+// node in the DB.
+type Capability struct {
+	// ID is a random id used to revoke the capability.
+	ID      NodeID
+	Node    NodeID
+	Actions ACLAction
+	// Expires is the unix time in seconds after which the capability is not valid anymore.
+	Expires int64
+	// Issuer is the device that signed the capability.
+	Issuer    NodeID
+	Signature []byte
+}
+
+// CapabilityRevocation marks the capability with the given ID as revoked.
+type CapabilityRevocation struct {
+	Capability NodeID
+	Date       int64
+	node       Node
+}
+
+var NodeTypeCapabilityRevocation = NodeACL.SubType("blue.gasser/cybermind/capability-revocation")
+
+var (
+	// ErrCapabilityExpired is returned for a capability that is past its expiry.
+	ErrCapabilityExpired = errors.New("capability expired")
+	// ErrCapabilityRevoked is returned for a capability that has been revoked.
+	ErrCapabilityRevoked = errors.New("capability revoked")
+)
+
+// IssueCapability returns a capability for the actions on the node, signed by the active device and valid for the
+// given duration.
+func (db DB) IssueCapability(n Noder, actions ACLAction, validity time.Duration) (c Capability, err error) {
+	if db.Device.privateKey == nil {
+		return c, errors.New("active device has no private key to sign capabilities")
+	}
+	node, err := n.GetNode()
+	if err != nil {
+		return c, fmt.Errorf("couldn't get node: %v", err)
+	}
+	c = Capability{
+		ID:      RandomNodeID(),
+		Node:    node.NodeID,
+		Actions: actions,
+		Expires: time.Now().Add(validity).Unix(),
+		Issuer:  db.Device.node.NodeID,
+	}
+	c.Signature = ed25519.Sign(db.Device.privateKey, c.hash())
+	return
+}
+
+func (c Capability) hash() []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{c.ID, c.Node, c.Issuer} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	_ = binary.Write(h, binary.LittleEndian, uint64(c.Actions))
+	_ = binary.Write(h, binary.LittleEndian, c.Expires)
+	return h.Sum(nil)
+}
+
+// Token returns the capability as a string that can be used in URLs.
+func (c Capability) Token() (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode capability: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// ParseCapability returns the capability of a token created by Capability.Token. The capability is not verified.
+func ParseCapability(token string) (c Capability, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, fmt.Errorf("couldn't decode token: %v", err)
+	}
+	if err = json.Unmarshal(buf, &c); err != nil {
+		return c, fmt.Errorf("couldn't decode capability: %v", err)
+	}
+	return
+}
+
+// VerifyCapability checks that the capability allows the action on the node. The capability must be signed by
+// the active device or by a device endorsed by a local identity, none of whose endorsements are revoked. It must
+// not be expired, and it must not be revoked.
+func (db DB) VerifyCapability(c Capability, action ACLAction, node NodeID) error {
+	if bytes.Compare(c.Node, node) != 0 {
+		return errors.New("capability is for another node")
+	}
+	if c.Actions.implied()&action != action {
+		return errors.New("capability doesn't allow this action")
+	}
+	if time.Now().Unix() > c.Expires {
+		return ErrCapabilityExpired
+	}
+	dn, err := db.GetLatest(c.Issuer)
+	if err != nil {
+		return fmt.Errorf("unknown issuer: %v", err)
+	}
+	if err = db.trustDevice(c.Issuer); err != nil {
+		return fmt.Errorf("untrusted issuer: %v", err)
+	}
+	dev, err := NewDeviceFromNode(dn)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(dev.PublicKey, c.hash(), c.Signature) {
+		return errors.New("invalid signature of capability")
+	}
+	es, err := db.GetEndorsements(c.Issuer)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if e.Revoked != 0 {
+			return errors.New("issuer of capability has been revoked")
+		}
+	}
+	revoked, err := db.capabilityRevoked(c.ID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrCapabilityRevoked
+	}
+	return nil
+}
+
+// RevokeCapability stores a revocation for the capability with the given ID.
+func (db DB) RevokeCapability(id NodeID) error {
+	cr := CapabilityRevocation{Capability: id, Date: time.Now().Unix(), node: NewNode(NodeTypeCapabilityRevocation)}
+	if err := db.SaveNode(cr); err != nil {
+		return fmt.Errorf("couldn't save revocation: %v", err)
+	}
+	return nil
+}
+
+func NewCapabilityRevocationFromNode(n Node) (cr CapabilityRevocation, err error) {
+	err = n.DecodeNodeType(NodeTypeCapabilityRevocation, &cr)
+	if err != nil {
+		return cr, fmt.Errorf("couldn't decode revocation: %v", err)
+	}
+	cr.node = n
+	return
+}
+
+func (cr CapabilityRevocation) GetNode() (Node, error) {
+	err := cr.node.EncodeData(&cr)
+	return cr.node, err
+}
+
+// capabilityRevoked returns true if there is a revocation for the capability.
+func (db DB) capabilityRevoked(id NodeID) (bool, error) {
+	nodes, err := db.GetNodesByType(NodeTypeCapabilityRevocation)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get revocations: %v", err)
+	}
+	for _, n := range nodes {
+		cr, err := NewCapabilityRevocationFromNode(n)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Compare(cr.Capability, id) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,57 @@
+package cymidb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_VerifyCapability(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	file := NewFile("report.pdf", 0644)
+	other := NewFile("other.pdf", 0644)
+	require.NoError(t, db.SaveNode(file, other))
+
+	c, err := db.IssueCapability(file, ACLRead, time.Hour)
+	require.NoError(t, err)
+	token, err := c.Token()
+	require.NoError(t, err)
+	c2, err := ParseCapability(token)
+	require.NoError(t, err)
+	require.NoError(t, db.VerifyCapability(c2, ACLRead, file.node.NodeID))
+	require.Error(t, db.VerifyCapability(c2, ACLWrite, file.node.NodeID))
+	require.Error(t, db.VerifyCapability(c2, ACLRead, other.node.NodeID))
+
+	c2.Actions = ACLAdmin
+	require.Error(t, db.VerifyCapability(c2, ACLWrite, file.node.NodeID))
+
+	expired, err := db.IssueCapability(file, ACLRead, -time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, ErrCapabilityExpired, db.VerifyCapability(expired, ACLRead, file.node.NodeID))
+
+	// A DB that doesn't know the issuer cannot verify the capability.
+	stranger, err := CreateDBFile(":memory:", "stranger", "")
+	require.NoError(t, err)
+	defer stranger.Close()
+	require.Error(t, stranger.VerifyCapability(c, ACLRead, file.node.NodeID))
+
+	// Knowing the issuer is not enough, it must be endorsed by a local identity.
+	b, err := stranger.ExportNodes(stranger.Device.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, db.Import(b))
+	foreign, err := stranger.IssueCapability(file, ACLRead, time.Hour)
+	require.NoError(t, err)
+	require.Error(t, db.VerifyCapability(foreign, ACLRead, file.node.NodeID))
+	ident, err := NewIdentity("me", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+	_, err = ident.Endorse(db, stranger.Device)
+	require.NoError(t, err)
+	require.NoError(t, db.VerifyCapability(foreign, ACLRead, file.node.NodeID))
+
+	require.NoError(t, db.RevokeCapability(c.ID))
+	require.Equal(t, ErrCapabilityRevoked, db.VerifyCapability(c, ACLRead, file.node.NodeID))
+}
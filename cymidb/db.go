@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -11,8 +13,13 @@ import (
 
 // DB represents one CyMiDB.
 type DB struct {
-	gdb    *gorm.DB
-	Device Device
+	gdb         *gorm.DB
+	Device      Device
+	keystore    *keystore
+	contentKeys *contentKeys
+	extractors  *extractors
+	events      *EventBus
+	hooks       *HookManager
 }
 
 // NewDBFile opens the DB with the given file and autoMigrates for MemoryLaneEntry and NodeVersions.
@@ -22,75 +29,311 @@ func NewDBFile(file string) (db DB, err error) {
 		return db, fmt.Errorf("coulnd't open sqlite3")
 	}
 	//db.gdb.LogMode(true)
-	db.gdb.AutoMigrate(&Node{}, &Link{})
+	// sqlite doesn't handle concurrent writes, and every new connection to ":memory:" creates a new DB.
+	db.gdb.DB().SetMaxOpenConns(1)
+	if err = migrateLinks(db.gdb); err != nil {
+		db.gdb.Close()
+		return db, err
+	}
+	db.gdb.AutoMigrate(&Node{}, &Link{}, &LocalKey{}, &LocalSetting{}, &KeywordCount{}, &Change{}, &HookCursor{},
+		&HookRun{}, &HookNode{}, &LinkRemoval{})
+	db.contentKeys = &contentKeys{keys: map[string]*[32]byte{}}
+	db.extractors = &extractors{}
+	db.events = &EventBus{}
 	return
 }
 
 // CreateDBFile creates a new DB in a given file and returns an initialized DB containing only the given device.
+// The private keys are stored without a passphrase, encrypted with a random key in the key file next to the DB.
 func CreateDBFile(file string, name, url string) (db DB, err error) {
+	return CreateDBFilePassphrase(file, name, url, "")
+}
+
+// CreateDBFilePassphrase creates a new DB in a given file and returns an initialized DB containing only the given
+// device. The private keys in the DB are protected by the passphrase.
+func CreateDBFilePassphrase(file string, name, url, passphrase string) (db DB, err error) {
 	db, err = NewDBFile(file)
 	if err != nil {
 		return db, err
 	}
+	if err = db.createKeystore(file, passphrase); err != nil {
+		return db, fmt.Errorf("couldn't create keystore: %v", err)
+	}
 
 	db.Device = NewDevice(name)
+	db.Device.URL = url
 	err = db.SaveNode(db.Device)
 	if err != nil {
 		return db, fmt.Errorf("couldn't create new node: %v", err)
 	}
-	return
+	err = db.setLocal(settingActiveDevice, db.Device.node.NodeID)
+	if err != nil {
+		return db, fmt.Errorf("couldn't store active device: %v", err)
+	}
+	return db, db.startHooks()
 }
 
 // OpenDBFile returns a db initialised with a file. It returns either the db, if successful,
 // or an error. If the db did not exist previously, the method will return an error.
+// The active device is the one stored locally when the DB has been created.
+// A DB in the baseline format, without keystore and active device, is migrated: its first node becomes the active
+// device with new keys, and all its nodes and links are signed by this device.
 func OpenDBFile(file string) (db DB, err error) {
+	return OpenDBFilePassphrase(file, "")
+}
+
+// OpenDBFilePassphrase opens the DB like OpenDBFile, and unlocks the private keys with the passphrase.
+func OpenDBFilePassphrase(file, passphrase string) (db DB, err error) {
 	db, err = NewDBFile(file)
 	if err != nil {
 		return db, err
 	}
+	if _, err = db.getLocal(settingKeystoreSalt); err != nil {
+		err = db.migrateBaseline(file, passphrase)
+	} else {
+		err = db.unlockKeystore(file, passphrase)
+	}
+	if err != nil {
+		db.Close()
+		return db, err
+	}
 
-	n := Node{}
-	err = db.gdb.First(&n).Error
+	id, err := db.getLocal(settingActiveDevice)
 	if err != nil {
-		return db, fmt.Errorf("couldn't get first node: %v", err)
+		db.Close()
+		return db, fmt.Errorf("couldn't get active device: %v", err)
+	}
+	if err = db.setDevice(id); err != nil {
+		db.Close()
+		return db, err
+	}
+	if db.Device.privateKey == nil {
+		db.Close()
+		return db, errors.New("couldn't get private key of active device")
 	}
-	node, err := db.GetLatest(n.NodeID)
+	if err = db.signLinks(); err != nil {
+		db.Close()
+		return db, err
+	}
+	if err = db.startHooks(); err != nil {
+		db.Close()
+		return db, err
+	}
+	return
+}
+
+// OpenDBFileAs opens the DB with the given device as active device, without changing the active device stored in
+// the DB. This is mostly useful for tests, where one copy of the DB is used by more than one device.
+// If the private key of the device is not available, the DB can be read, but no nodes can be saved.
+func OpenDBFileAs(file string, device NodeID, passphrase string) (db DB, err error) {
+	db, err = NewDBFile(file)
+	if err != nil {
+		return db, err
+	}
+	if err = db.unlockKeystore(file, passphrase); err != nil {
+		db.Close()
+		return db, err
+	}
+	if err = db.setDevice(device); err != nil {
+		db.Close()
+		return db, err
+	}
+	if err = db.startHooks(); err != nil {
+		db.Close()
+		return db, err
+	}
+	return
+}
+
+// startHooks starts the hooks of the active device.
+func (db *DB) startHooks() error {
+	db.hooks = NewHookManager(*db)
+	// The copy in the manager, given to the modules, needs to know the manager, too.
+	db.hooks.db.hooks = db.hooks
+	if err := db.hooks.Start(); err != nil {
+		return fmt.Errorf("couldn't start hooks: %v", err)
+	}
+	return nil
+}
+
+// Hooks returns the manager of the hooks running on the active device.
+func (db DB) Hooks() *HookManager {
+	return db.hooks
+}
+
+// setDevice sets the active device of this DB, including its private key, if it is available.
+func (db *DB) setDevice(id NodeID) error {
+	node, err := db.GetLatest(id)
 	if err != nil {
-		return db, fmt.Errorf("couldn't get latest node version: %v", err)
+		return fmt.Errorf("couldn't get latest device version: %v", err)
 	}
 	db.Device, err = NewDeviceFromNode(node)
 	if err != nil {
-		return db, fmt.Errorf("couldn't get device from node: %v", err)
+		return fmt.Errorf("couldn't get device from node: %v", err)
+	}
+	if priv, err := db.loadKey(id); err == nil {
+		db.Device.privateKey = priv
+	}
+	if box, err := db.loadBoxKey(id); err == nil {
+		db.Device.boxKey = box
+	}
+	return nil
+}
+
+// CreateDevice adds a new device with its private key to this DB, without changing the active device.
+// The new device can be used with OpenDBFileAs.
+func (db DB) CreateDevice(name, url string) (dev Device, err error) {
+	dev = NewDevice(name)
+	dev.URL = url
+	// Device nodes are always signed by the device itself.
+	dbDev := db
+	dbDev.Device = dev
+	if err = dbDev.SaveNode(dev); err != nil {
+		return dev, fmt.Errorf("couldn't save device: %v", err)
+	}
+	return
+}
+
+// GetDevices returns the latest version of all devices known to this DB.
+func (db DB) GetDevices() (devs []Device, err error) {
+	nodes, err := db.GetNodesByType(NodeDev)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get device nodes: %v", err)
+	}
+	for _, n := range nodes {
+		dev, err := NewDeviceFromNode(n)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get device: %v", err)
+		}
+		devs = append(devs, dev)
 	}
 	return
 }
 
 // Closes the connection to the database. No further action is possible after this call.
+// The running hooks are stopped first.
 func (db DB) Close() error {
+	if db.hooks != nil {
+		if err := db.hooks.Stop(); err != nil {
+			db.gdb.Close()
+			return err
+		}
+	}
 	return db.gdb.Close()
 }
 
-// NewNode takes a node and inserts it in the DB.
+// SaveNode takes nodes and inserts them as new versions in the DB. Every version is signed by the active device.
+// The Data of blob nodes is encrypted before it is stored, and the extractors are run on them once they are saved.
+// If extractors fail, all nodes are still saved, and the errors of the extractors are returned.
+// The type of an existing node cannot be changed, and new versions of an identity can only be saved by devices
+// the identity endorses.
 func (db DB) SaveNode(ns ...Noder) error {
+	if db.Device.privateKey == nil {
+		return errors.New("active device has no private key to sign nodes")
+	}
+	var extractErrs []string
 	for _, n := range ns {
 		node, err := n.GetNode()
 		if err != nil {
 			return fmt.Errorf("couldn't get node: %v", err)
 		}
-		var exist Node
-		db.gdb.Last(&exist, &Node{NodeID: node.NodeID})
+		// Always store a new version, even if the node has been read from the DB.
+		node.Model = gorm.Model{}
+		exist, _ := db.getLatest(node.NodeID)
 		if bytes.Compare(exist.NodeID, node.NodeID) == 0 {
+			var first Node
+			if err = db.gdb.Where(&Node{NodeID: node.NodeID}).Order("version").First(&first).Error; err != nil {
+				return fmt.Errorf("couldn't get first version: %v", err)
+			}
+			if first.Type != node.Type {
+				return errors.New("cannot change the type of a node")
+			}
 			node.Version = exist.Version + 1
 		}
-		err = db.gdb.Save(&node).Error
+		if node.Type == NodeIdentity && node.Version > 0 {
+			endorsements, err := db.GetEndorsements(db.Device.node.NodeID)
+			if err != nil {
+				return fmt.Errorf("couldn't get endorsements: %v", err)
+			}
+			if !endorsedBy(endorsements, node.NodeID) {
+				return errors.New("identity can only be changed by its endorsed devices")
+			}
+		}
+		plain := node
+		if node.Type.Encrypted() {
+			if err = db.encryptNode(&node, exist); err != nil {
+				return fmt.Errorf("couldn't encrypt node: %v", err)
+			}
+		}
+		node.sign(db.Device.node.NodeID, db.Device.privateKey)
+		c, err := db.saveVersion(node)
 		if err != nil {
-			return fmt.Errorf("couldn't create new node: %v", err)
+			return err
+		}
+		if kh, ok := n.(keyHolder); ok {
+			if err = db.storeKeys(node.NodeID, kh); err != nil {
+				return fmt.Errorf("couldn't store private keys: %v", err)
+			}
+		}
+		db.send(db.nodeEvent(c, node, exist))
+		// A failing extractor doesn't keep the other nodes from being saved.
+		if node.Type.Base() == NodeBlob {
+			plain.KeyID = node.KeyID
+			if err = db.extract(plain); err != nil {
+				extractErrs = append(extractErrs, err.Error())
+			}
 		}
 	}
+	if len(extractErrs) > 0 {
+		return fmt.Errorf("nodes saved, but extraction failed: %s", strings.Join(extractErrs, "; "))
+	}
 	return nil
 }
 
-// AddLink creates a new link between two nodes.
+// saveVersion stores the new version of the node together with its change in the timeline.
+func (db DB) saveVersion(node Node) (c Change, err error) {
+	tx := db.gdb.Begin()
+	if tx.Error != nil {
+		return c, fmt.Errorf("couldn't start transaction: %v", tx.Error)
+	}
+	if err = tx.Save(&node).Error; err != nil {
+		tx.Rollback()
+		return c, fmt.Errorf("couldn't create new node: %v", err)
+	}
+	c = nodeChange(EventNodeSaved, node, db.Device.node.NodeID)
+	if err = tx.Create(&c).Error; err != nil {
+		tx.Rollback()
+		return c, fmt.Errorf("couldn't record change: %v", err)
+	}
+	if err = tx.Commit().Error; err != nil {
+		return c, fmt.Errorf("couldn't commit node: %v", err)
+	}
+	return c, nil
+}
+
+// transaction runs f with a DB using a new transaction. The events returned by f are sent once the transaction is
+// committed, so the timeline always holds the changes of the stored data.
+func (db DB) transaction(f func(tx DB) ([]pendingEvent, error)) error {
+	tx := db.gdb.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("couldn't start transaction: %v", tx.Error)
+	}
+	txdb := db
+	txdb.gdb = tx
+	events, err := f(txdb)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+	db.send(events...)
+	return nil
+}
+
+// AddLink creates a new link between two nodes. If 'from' is shared with a content key, 'to' and its subgraph
+// are shared with the same key.
 func (db DB) AddLink(from, to Noder) error {
 	fromID, err := from.GetNode()
 	if err != nil {
@@ -100,22 +343,148 @@ func (db DB) AddLink(from, to Noder) error {
 	if err != nil {
 		return fmt.Errorf("couldn't get ID 'to': %v", err)
 	}
-	return db.gdb.Save(&Link{fromID.NodeID, toID.NodeID}).Error
+	err = db.transaction(func(tx DB) ([]pendingEvent, error) {
+		link := Link{From: fromID.NodeID, To: toID.NodeID}
+		tx.signLink(&link)
+		if err := tx.gdb.Save(&link).Error; err != nil {
+			return nil, fmt.Errorf("couldn't save link: %v", err)
+		}
+		e, err := tx.recordLink(EventLinkAdded, link)
+		return []pendingEvent{e}, err
+	})
+	if err != nil {
+		return err
+	}
+	return db.inheritContentKey(fromID.NodeID, toID.NodeID)
+}
+
+// signLink signs the link with the active device, if it can sign.
+func (db DB) signLink(l *Link) {
+	if db.Device.privateKey != nil {
+		l.sign(db.Device.node.NodeID, db.Device.privateKey)
+	}
+}
+
+// signLinks signs the links stored by versions of the DB that didn't sign links with the active device, so they
+// can be passed on to other DBs.
+func (db DB) signLinks() error {
+	var links []Link
+	if err := db.gdb.Where("signature IS NULL").Find(&links).Error; err != nil {
+		return fmt.Errorf("couldn't search unsigned links: %v", err)
+	}
+	for _, l := range links {
+		db.signLink(&l)
+		if err := db.gdb.Save(&l).Error; err != nil {
+			return fmt.Errorf("couldn't sign link: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoveLink removes the link between the two nodes.
+func (db DB) RemoveLink(from, to Noder) error {
+	fromID, err := from.GetNode()
+	if err != nil {
+		return fmt.Errorf("couldn't get ID 'from': %v", err)
+	}
+	toID, err := to.GetNode()
+	if err != nil {
+		return fmt.Errorf("couldn't get ID 'to': %v", err)
+	}
+	return db.removeLinks(Link{From: fromID.NodeID, To: toID.NodeID})
 }
 
-// GetNodes returns all nodes given by the ids.
+// removeLinks removes all links matching the given link and sends an event for each of them. If the active device
+// can sign, a LinkRemoval is stored for every removed link, so other DBs remove it when importing it.
+func (db DB) removeLinks(match Link) error {
+	return db.transaction(func(tx DB) ([]pendingEvent, error) {
+		return tx.deleteLinks(match)
+	})
+}
+
+// deleteLinks removes the links matching the given link and records their removal, and returns the events to send
+// once it is committed.
+func (db DB) deleteLinks(match Link) (events []pendingEvent, err error) {
+	var links []Link
+	if err = db.gdb.Where(&match).Find(&links).Error; err != nil {
+		return nil, fmt.Errorf("couldn't search links: %v", err)
+	}
+	for _, l := range links {
+		if err = db.gdb.Delete(&l).Error; err != nil {
+			return nil, fmt.Errorf("couldn't remove link: %v", err)
+		}
+		if db.Device.privateKey != nil {
+			r := LinkRemoval{From: l.From, To: l.To}
+			r.sign(db.Device.node.NodeID, db.Device.privateKey)
+			if err = db.gdb.Create(&r).Error; err != nil {
+				return nil, fmt.Errorf("couldn't store link removal: %v", err)
+			}
+		}
+		e, err := db.recordLink(EventLinkRemoved, l)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// DeleteNode removes all versions of the node and all its links from this DB.
+func (db DB) DeleteNode(n Noder) error {
+	node, err := n.GetNode()
+	if err != nil {
+		return fmt.Errorf("couldn't get node: %v", err)
+	}
+	latest, err := db.getLatest(node.NodeID)
+	if err != nil {
+		return err
+	}
+	return db.transaction(func(tx DB) ([]pendingEvent, error) {
+		events, err := tx.deleteLinks(Link{From: node.NodeID})
+		if err != nil {
+			return nil, err
+		}
+		to, err := tx.deleteLinks(Link{To: node.NodeID})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, to...)
+		if err = tx.gdb.Where(&Node{NodeID: node.NodeID}).Delete(&Node{}).Error; err != nil {
+			return nil, fmt.Errorf("couldn't delete node: %v", err)
+		}
+		e, err := tx.recordNode(EventNodeDeleted, latest, Node{}, db.Device.node.NodeID)
+		return append(events, e), err
+	})
+}
+
+// GetNodes returns all nodes given by the ids. The signature of every node is verified, and the Data is
+// decrypted. Nodes that cannot be verified or decrypted, like nodes of a revoked device or nodes that are not shared
+// with this DB, are skipped, so one of them doesn't hide all others.
 func (db DB) GetNodes(ids []NodeID) (nodes []Node, err error) {
 	for _, l := range ids {
-		var n Node
-		err = db.gdb.Last(&n, &Node{NodeID: l}).Error
+		n, err := db.getLatest(l)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't get node %x: %v", l, err)
 		}
+		if db.VerifyNode(n) != nil || db.decryptNode(&n) != nil {
+			continue
+		}
 		nodes = append(nodes, n)
 	}
 	return
 }
 
+// GetNodesByType returns the latest version of all nodes of the given type.
+func (db DB) GetNodesByType(t NodeType) (nodes []Node, err error) {
+	var ids []NodeID
+	err = db.gdb.Model(&Node{}).Where("type = ?", uint64(t)).Group("node_id").Order("min(id)").
+		Pluck("node_id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get nodes of type: %v", err)
+	}
+	return db.GetNodes(ids)
+}
+
 // GetChildren searches for nodes that have the given node as ancestor and returns their ids.
 func (db DB) GetChildren(from NodeID) (children []NodeID, err error) {
 	var links []Link
@@ -154,18 +523,49 @@ func (db DB) GetAncestorsNodes(to NodeID) (ancestors []Node, err error) {
 	return db.GetNodes(ids)
 }
 
-// GetNodeVersions gets the NodeVersions entry and also fetches all related MemoryLaneEntries.
+// GetNodeVersions returns all versions of the node with the given id, with their Data decrypted.
 func (db DB) GetNodeVersions(id NodeID) (nodes []Node, err error) {
-	err = db.gdb.Find(&nodes, &Node{NodeID: id}).Error
+	nodes, err = db.nodeVersions(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		if err = db.decryptNode(&nodes[i]); err != nil {
+			return nil, fmt.Errorf("couldn't decrypt version %d: %v", nodes[i].Version, err)
+		}
+	}
+	return
+}
+
+// nodeVersions returns all versions of the node as they are stored in the DB.
+func (db DB) nodeVersions(id NodeID) (nodes []Node, err error) {
+	err = db.gdb.Order("version").Find(&nodes, &Node{NodeID: id}).Error
 	if err != nil {
 		return nodes, fmt.Errorf("couldn't get NodeVersions: %v", err)
 	}
 	return
 }
 
-// GetLatest returns the latest version of the node with the given id.
+// GetLatest returns the latest version of the node with the given id. The signature of the node is verified,
+// and the Data is decrypted.
 func (db DB) GetLatest(id NodeID) (n Node, err error) {
-	nodes, err := db.GetNodeVersions(id)
+	n, err = db.getLatest(id)
+	if err != nil {
+		return n, err
+	}
+	if err = db.VerifyNode(n); err != nil {
+		return n, fmt.Errorf("couldn't verify node: %v", err)
+	}
+	if err = db.decryptNode(&n); err != nil {
+		return n, fmt.Errorf("couldn't decrypt node: %v", err)
+	}
+	return
+}
+
+// getLatest returns the latest version of the node with the given id as it is stored in the DB,
+// without verifying or decrypting it.
+func (db DB) getLatest(id NodeID) (n Node, err error) {
+	nodes, err := db.nodeVersions(id)
 	if err != nil {
 		return n, fmt.Errorf("couldn't get latest node: %v", err)
 	}
@@ -175,3 +575,71 @@ func (db DB) GetLatest(id NodeID) (n Node, err error) {
 	n = nodes[len(nodes)-1]
 	return
 }
+
+// VerifyNode checks the signature of the node against the public key of the device that signed it.
+// The signing device must be known to this DB and its latest version must be signed by the device itself.
+// If the device has been revoked by one of its identities, nodes signed after the revocation are rejected.
+// All versions of a node must have the same type.
+func (db DB) VerifyNode(n Node) error {
+	var count int
+	err := db.gdb.Model(&Node{}).Where("node_id = ? AND type != ?", []byte(n.NodeID), uint64(n.Type)).
+		Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("couldn't search node: %v", err)
+	}
+	if count > 0 {
+		return errors.New("cannot change the type of a node")
+	}
+	return db.verifyNode(n, map[string]bool{})
+}
+
+// verifyNode verifies the node. The verified map holds the devices whose revocations are being checked,
+// so that a revocation check doesn't loop when verifying the identity nodes.
+func (db DB) verifyNode(n Node, verified map[string]bool) error {
+	if err := db.verifySignature(n); err != nil {
+		return err
+	}
+	if verified[string(n.Signer)] {
+		return nil
+	}
+	verified[string(n.Signer)] = true
+	endorsements, err := db.getEndorsements(n.Signer, verified)
+	if err != nil {
+		return fmt.Errorf("couldn't get endorsements of signer: %v", err)
+	}
+	for _, e := range endorsements {
+		if e.Revoked == 0 {
+			continue
+		}
+		// Only nodes signed before the revocation has been signed are accepted.
+		if n.SignedAt >= e.revokedAt || time.Unix(0, n.SignedAt).Unix() > e.Revoked {
+			return errors.New("signing device has been revoked")
+		}
+	}
+	if n.Type == NodeIdentity && n.Version > 0 && !endorsedBy(endorsements, n.NodeID) {
+		return errors.New("identity can only be changed by its endorsed devices")
+	}
+	return nil
+}
+
+// verifySignature checks the signature of the node against the public key of the device that signed it.
+func (db DB) verifySignature(n Node) error {
+	if len(n.Signer) == 0 {
+		return errors.New("node is not signed")
+	}
+	dn, err := db.getLatest(n.Signer)
+	if err != nil {
+		return fmt.Errorf("couldn't get signing device: %v", err)
+	}
+	dev, err := NewDeviceFromNode(dn)
+	if err != nil {
+		return fmt.Errorf("signer is not a device: %v", err)
+	}
+	if bytes.Compare(dn.Signer, dn.NodeID) != 0 {
+		return errors.New("signing device is not self-signed")
+	}
+	if err = dn.verifySignature(dev.PublicKey); err != nil {
+		return fmt.Errorf("couldn't verify signing device: %v", err)
+	}
+	return n.verifySignature(dev.PublicKey)
+}
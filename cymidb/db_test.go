@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,6 +24,7 @@ func TestOpenDBFile(t *testing.T) {
 	require.NoError(t, err)
 	f.Close()
 	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
 	db1, err := CreateDBFile(f.Name(), "tmp", "http://")
 	require.NoError(t, err)
 	db1.Close()
@@ -33,11 +35,58 @@ func TestOpenDBFile(t *testing.T) {
 	db1.Close()
 }
 
+func TestOpenDBFile_Baseline(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+
+	// A DB in the baseline format has unsigned nodes and a links table without primary key.
+	gdb, err := gorm.Open("sqlite3", f.Name())
+	require.NoError(t, err)
+	require.NoError(t, gdb.Exec(`CREATE TABLE "nodes" ("id" integer primary key autoincrement,
+		"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"node_id" blob,"type" bigint,
+		"version" bigint,"date" bigint,"data" blob)`).Error)
+	require.NoError(t, gdb.Exec(`CREATE TABLE "links" ("from" blob,"to" blob)`).Error)
+	dev := Device{Name: "laptop", node: NewNode(NodeDev)}
+	dir := NewDir("docs", 0777)
+	file := NewFile("plan.txt", 0644)
+	for _, nr := range []Noder{dev, dir, file} {
+		n, err := nr.GetNode()
+		require.NoError(t, err)
+		require.NoError(t, gdb.Exec(`INSERT INTO nodes (node_id, type, version, date, data) VALUES (?, ?, 0, ?, ?)`,
+			[]byte(n.NodeID), uint64(n.Type), n.Date, n.Data).Error)
+	}
+	require.NoError(t, gdb.Exec(`INSERT INTO links ("from", "to") VALUES (?, ?)`, []byte(dir.node.NodeID),
+		[]byte(file.node.NodeID)).Error)
+	require.NoError(t, gdb.Close())
+
+	// The first node becomes the active device, and all nodes and links are signed and verify.
+	for i := 0; i < 2; i++ {
+		db, err := OpenDBFile(f.Name())
+		require.NoError(t, err)
+		require.Equal(t, dev.node.NodeID, db.Device.node.NodeID)
+		n, err := db.GetLatest(file.node.NodeID)
+		require.NoError(t, err)
+		require.NotEqual(t, 0, len(n.KeyID))
+		file2, err := NewFileFromNode(n)
+		require.NoError(t, err)
+		require.Equal(t, "plan.txt", file2.Name)
+		var links []Link
+		require.NoError(t, db.gdb.Find(&links).Error)
+		require.Equal(t, 1, len(links))
+		require.NoError(t, db.verifyLink(links[0]))
+		require.NoError(t, db.Close())
+	}
+}
+
 func TestDB_GetLatest(t *testing.T) {
 	f, err := ioutil.TempFile("/tmp", "db")
 	require.NoError(t, err)
 	f.Close()
 	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
 	db, err := CreateDBFile(f.Name(), "tmp", "http://")
 	require.NoError(t, err)
 
@@ -81,4 +130,120 @@ func TestDB_Links(t *testing.T) {
 	ancestors, err = db.GetAncestorsNodes(n1.NodeID)
 	require.NoError(t, err)
 	require.Equal(t, 0, len(ancestors))
+
+	// Links are signed by the active device, and links of older DBs are signed when they're opened.
+	var links []Link
+	require.NoError(t, db.gdb.Find(&links).Error)
+	require.Equal(t, 1, len(links))
+	require.NoError(t, db.verifyLink(links[0]))
+	require.NoError(t, db.gdb.Exec("UPDATE links SET signer = NULL, signed_at = 0, signature = NULL").Error)
+	require.NoError(t, db.gdb.Find(&links).Error)
+	require.Error(t, db.verifyLink(links[0]))
+	require.NoError(t, db.signLinks())
+	require.NoError(t, db.gdb.Find(&links).Error)
+	require.NoError(t, db.verifyLink(links[0]))
+}
+
+func TestDB_VerifyNode(t *testing.T) {
+	db1, err := CreateDBFile(":memory:", "tmp1", "")
+	require.NoError(t, err)
+	defer db1.Close()
+	db2, err := CreateDBFile(":memory:", "tmp2", "")
+	require.NoError(t, err)
+	defer db2.Close()
+
+	// Blobs would be encrypted with a content key unknown to db1.
+	n := NewNode(NodeTag)
+	n.Data = []byte("tag")
+	require.NoError(t, db2.SaveNode(n))
+	signed, err := db2.GetLatest(n.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, db2.Device.node.NodeID, signed.Signer)
+
+	// Unknown signing device
+	signed.Model = gorm.Model{}
+	require.NoError(t, db1.gdb.Create(&signed).Error)
+	_, err = db1.GetLatest(n.NodeID)
+	require.Error(t, err)
+
+	// Once the device is known, the node verifies
+	dev, err := db2.Device.GetNode()
+	require.NoError(t, err)
+	dev, err = db2.GetLatest(dev.NodeID)
+	require.NoError(t, err)
+	dev.Model = gorm.Model{}
+	require.NoError(t, db1.gdb.Create(&dev).Error)
+	_, err = db1.GetLatest(n.NodeID)
+	require.NoError(t, err)
+	_, err = db1.GetNodes([]NodeID{n.NodeID})
+	require.NoError(t, err)
+
+	// Forged data doesn't verify
+	forged := signed
+	forged.Model = gorm.Model{}
+	forged.Version++
+	forged.Data = []byte("forged")
+	require.NoError(t, db1.gdb.Create(&forged).Error)
+	_, err = db1.GetLatest(n.NodeID)
+	require.Error(t, err)
+	nodes, err := db1.GetNodes([]NodeID{n.NodeID})
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+}
+
+func TestOpenDBFileAs(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+	db, err := CreateDBFile(f.Name(), "laptop", "http://laptop")
+	require.NoError(t, err)
+	phone, err := db.CreateDevice("phone", "http://phone")
+	require.NoError(t, err)
+	devs, err := db.GetDevices()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(devs))
+	require.Equal(t, "laptop", devs[0].Name)
+	require.Equal(t, "phone", devs[1].Name)
+
+	// A device without private key in this DB.
+	other, err := CreateDBFile(":memory:", "other", "")
+	require.NoError(t, err)
+	otherNode, err := other.GetLatest(other.Device.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, db.Import(Bundle{Nodes: []Node{otherNode}}))
+	other.Close()
+	db.Close()
+
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, "laptop", db.Device.Name)
+	require.Equal(t, "http://laptop", db.Device.URL)
+	db.Close()
+
+	db, err = OpenDBFileAs(f.Name(), phone.node.NodeID, "")
+	require.NoError(t, err)
+	require.Equal(t, "phone", db.Device.Name)
+	n := NewNode(NodeBlob)
+	require.NoError(t, db.SaveNode(n))
+	n, err = db.GetLatest(n.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, phone.node.NodeID, n.Signer)
+	db.Close()
+
+	db, err = OpenDBFileAs(f.Name(), otherNode.NodeID, "")
+	require.NoError(t, err)
+	require.Equal(t, "other", db.Device.Name)
+	require.Error(t, db.SaveNode(NewNode(NodeBlob)))
+	db.Close()
+
+	_, err = OpenDBFileAs(f.Name(), RandomNodeID(), "")
+	require.Error(t, err)
+
+	// Opening the DB again still uses the stored active device.
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, "laptop", db.Device.Name)
+	db.Close()
 }
@@ -1,14 +1,26 @@
 package cymidb
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
 )
 
 // Device holds all information for a new device.
 type Device struct {
 	Name string
 	URL  string
-	node Node
+	// PublicKey is used to verify all node versions signed by this device.
+	PublicKey ed25519.PublicKey
+	// BoxKey is used to wrap content keys for this device.
+	BoxKey []byte
+	node   Node
+	// privateKey and boxKey are only available for devices that have been created in this DB.
+	// They are never stored in the node, but in the LocalKey table.
+	privateKey ed25519.PrivateKey
+	boxKey     *[32]byte
 }
 
 // NewDeviceFromNode takes a node and returns a device. If the node is not of the correct type,
@@ -26,9 +38,29 @@ func NewDeviceFromNode(n Node) (dev Device, err error) {
 func NewDevice(name string) (dev Device) {
 	dev.node = NewNode(NodeDev)
 	dev.Name = name
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("couldn't create keypair: " + err.Error())
+	}
+	dev.PublicKey = pub
+	dev.privateKey = priv
+	boxPub, boxPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("couldn't create box keypair: " + err.Error())
+	}
+	dev.BoxKey = boxPub[:]
+	dev.boxKey = boxPriv
 	return
 }
 
+func (dev Device) localKey() ed25519.PrivateKey {
+	return dev.privateKey
+}
+
+func (dev Device) localBoxKey() *[32]byte {
+	return dev.boxKey
+}
+
 // GetNode makes sure that the dataBuf of the node is updated and returns the updated node.
 func (dev Device) GetNode() (Node, error) {
 	err := dev.node.EncodeData(&dev)
@@ -0,0 +1,383 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Encryption at rest uses envelope encryption: the Data of all blob nodes is encrypted with a symmetric content
+// key. Every subgraph has its own content key: a new node uses the key of its parent, or a new key if it has no
+// encrypted parent. The content key itself is stored in a ContentKey node, wrapped for every device or identity
+// that is allowed to read the data. The private keys needed to unwrap the content keys are stored in the keystore
+// of the DB.
+
+// ErrNoContentKey is returned if a node cannot be decrypted, because none of its recipients is available.
+var ErrNoContentKey = errors.New("no content key available for this node")
+
+// ContentKey holds a symmetric key that encrypts the Data of one or more nodes.
+type ContentKey struct {
+	// Envelopes holds the key wrapped for every recipient.
+	Envelopes []KeyEnvelope
+	// Groups are the groups this key is shared with. It is updated when their members change.
+	Groups []NodeID
+	// Subgraph is the node this key has been created for, if it has been created when saving a new node. The nodes
+	// using such a key are encrypted again with the key of a shared parent, once they're linked to it.
+	Subgraph NodeID
+	node     Node
+	key      *[32]byte
+}
+
+// KeyEnvelope is a content key wrapped with the public box key of a recipient.
+type KeyEnvelope struct {
+	// Recipient is the device or identity that can unwrap the key with its private box key.
+	Recipient NodeID
+	Wrapped   []byte
+}
+
+var NodeTypeContentKey = NodeACL.SubType("blue.gasser/cybermind/contentkey")
+
+// Encrypted returns true if the Data of nodes of this type is encrypted in the DB. Only blobs are encrypted: the
+// Data of all other nodes, like the names of tags and projects or the configuration and settings of hooks,
+// including the URLs of webhooks, is stored in plain text and is readable by every DB it is exported to.
+func (nt NodeType) Encrypted() bool {
+	return nt >= NodeBlob && nt < NodeLink
+}
+
+// NewContentKey returns a new, random content key without any recipients.
+func NewContentKey() (ck ContentKey, err error) {
+	ck.node = NewNode(NodeTypeContentKey)
+	ck.key = new([32]byte)
+	if _, err = io.ReadFull(rand.Reader, ck.key[:]); err != nil {
+		return ck, fmt.Errorf("couldn't create key: %v", err)
+	}
+	return
+}
+
+func NewContentKeyFromNode(n Node) (ck ContentKey, err error) {
+	err = n.DecodeNodeType(NodeTypeContentKey, &ck)
+	if err != nil {
+		return ck, fmt.Errorf("couldn't decode content key: %v", err)
+	}
+	ck.node = n
+	return
+}
+
+func (ck ContentKey) GetNode() (Node, error) {
+	err := ck.node.EncodeData(&ck)
+	return ck.node, err
+}
+
+// HasRecipient returns true if the key is wrapped for the given recipient.
+func (ck ContentKey) HasRecipient(id NodeID) bool {
+	for _, e := range ck.Envelopes {
+		if bytes.Compare(e.Recipient, id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRecipient wraps the key for the recipient with the given public box key. The key must be unwrapped.
+func (ck *ContentKey) AddRecipient(recipient NodeID, boxKey []byte) error {
+	if ck.key == nil {
+		return errors.New("content key is not unwrapped")
+	}
+	if len(boxKey) != 32 {
+		return errors.New("recipient has no valid box key")
+	}
+	if ck.HasRecipient(recipient) {
+		return nil
+	}
+	var pub [32]byte
+	copy(pub[:], boxKey)
+	ephPub, ephPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("couldn't create ephemeral key: %v", err)
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return fmt.Errorf("couldn't create nonce: %v", err)
+	}
+	wrapped := append(ephPub[:], nonce[:]...)
+	wrapped = box.Seal(wrapped, ck.key[:], &nonce, &pub, ephPriv)
+	ck.Envelopes = append(ck.Envelopes, KeyEnvelope{Recipient: recipient, Wrapped: wrapped})
+	return nil
+}
+
+// RemoveRecipient removes the envelope of the recipient. As the recipient might have kept the key,
+// only data encrypted with a new content key is safe from the recipient.
+func (ck *ContentKey) RemoveRecipient(recipient NodeID) {
+	var envelopes []KeyEnvelope
+	for _, e := range ck.Envelopes {
+		if bytes.Compare(e.Recipient, recipient) != 0 {
+			envelopes = append(envelopes, e)
+		}
+	}
+	ck.Envelopes = envelopes
+}
+
+// unwrap opens the envelope of the recipient with its private box key.
+func (ck *ContentKey) unwrap(recipient NodeID, priv *[32]byte) error {
+	for _, e := range ck.Envelopes {
+		if bytes.Compare(e.Recipient, recipient) != 0 {
+			continue
+		}
+		if len(e.Wrapped) < 32+24+box.Overhead {
+			return errors.New("wrapped key too short")
+		}
+		var ephPub [32]byte
+		var nonce [24]byte
+		copy(ephPub[:], e.Wrapped)
+		copy(nonce[:], e.Wrapped[32:])
+		key, ok := box.Open(nil, e.Wrapped[32+24:], &nonce, &ephPub, priv)
+		if !ok || len(key) != 32 {
+			return errors.New("couldn't unwrap key")
+		}
+		ck.key = new([32]byte)
+		copy(ck.key[:], key)
+		return nil
+	}
+	return errors.New("no envelope for this recipient")
+}
+
+// contentKeys caches the unwrapped content keys.
+type contentKeys struct {
+	sync.Mutex
+	keys map[string]*[32]byte
+}
+
+// GetContentKey returns the content key with the given id, unwrapped with one of the private box keys of this DB.
+func (db DB) GetContentKey(id NodeID) (ck ContentKey, err error) {
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return ck, fmt.Errorf("couldn't get content key: %v", err)
+	}
+	ck, err = NewContentKeyFromNode(n)
+	if err != nil {
+		return ck, err
+	}
+	for _, e := range ck.Envelopes {
+		priv, err := db.loadBoxKey(e.Recipient)
+		if err != nil {
+			continue
+		}
+		if err = ck.unwrap(e.Recipient, priv); err == nil {
+			return ck, nil
+		}
+	}
+	return ck, ErrNoContentKey
+}
+
+// contentKey returns the symmetric key of the content key with the given id.
+func (db DB) contentKey(id NodeID) (*[32]byte, error) {
+	db.contentKeys.Lock()
+	key, ok := db.contentKeys.keys[string(id)]
+	db.contentKeys.Unlock()
+	if ok {
+		return key, nil
+	}
+	ck, err := db.GetContentKey(id)
+	if err != nil {
+		return nil, err
+	}
+	db.contentKeys.Lock()
+	db.contentKeys.keys[string(id)] = ck.key
+	db.contentKeys.Unlock()
+	return ck.key, nil
+}
+
+// newSubgraphContentKey creates and saves a new content key for the node, wrapped for the active device and for
+// all identities whose private keys are stored in this DB, so that their other devices can read the data, too.
+func (db DB) newSubgraphContentKey(id NodeID) (NodeID, error) {
+	ck, err := NewContentKey()
+	if err != nil {
+		return nil, err
+	}
+	ck.Subgraph = id
+	if err = ck.AddRecipient(db.Device.node.NodeID, db.Device.BoxKey); err != nil {
+		return nil, fmt.Errorf("couldn't wrap key for device: %v", err)
+	}
+	idents, err := db.GetNodesByType(NodeIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get identities: %v", err)
+	}
+	for _, in := range idents {
+		if _, err := db.loadBoxKey(in.NodeID); err != nil {
+			continue
+		}
+		ident, err := NewIdentityFromNode(in)
+		if err != nil {
+			return nil, err
+		}
+		if err = ck.AddRecipient(in.NodeID, ident.BoxKey); err != nil {
+			return nil, fmt.Errorf("couldn't wrap key for identity: %v", err)
+		}
+	}
+	if err = db.SaveNode(ck); err != nil {
+		return nil, fmt.Errorf("couldn't save content key: %v", err)
+	}
+	return ck.node.NodeID, nil
+}
+
+// GrantContentKeys wraps all content keys available in this DB for the recipient, so that it can decrypt all data.
+// This is used when pairing a new device.
+func (db DB) GrantContentKeys(recipient NodeID, boxKey []byte) error {
+	nodes, err := db.GetNodesByType(NodeTypeContentKey)
+	if err != nil {
+		return fmt.Errorf("couldn't get content keys: %v", err)
+	}
+	for _, n := range nodes {
+		ck, err := db.GetContentKey(n.NodeID)
+		if err == ErrNoContentKey || ck.HasRecipient(recipient) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = ck.AddRecipient(recipient, boxKey); err != nil {
+			return err
+		}
+		if err = db.SaveNode(ck); err != nil {
+			return fmt.Errorf("couldn't save content key: %v", err)
+		}
+	}
+	return nil
+}
+
+// encryptNode encrypts the Data of the node. The content key is the one of the node, if it has one, then the one
+// of the existing version of the node, then the one of a parent, and finally a new content key for the node.
+func (db DB) encryptNode(node *Node, exist Node) (err error) {
+	if len(node.KeyID) == 0 {
+		node.KeyID = exist.KeyID
+	}
+	if len(node.KeyID) == 0 {
+		// New nodes that are already linked use the content key of their parent, so they're shared with it.
+		if node.KeyID, err = db.parentContentKey(node.NodeID); err != nil {
+			return err
+		}
+	}
+	if len(node.KeyID) == 0 {
+		if node.KeyID, err = db.newSubgraphContentKey(node.NodeID); err != nil {
+			return err
+		}
+	}
+	key, err := db.contentKey(node.KeyID)
+	if err != nil {
+		return err
+	}
+	node.Data, err = sealSecret(key, node.Data)
+	return err
+}
+
+// decryptNode decrypts the Data of the node, if it has been encrypted.
+func (db DB) decryptNode(node *Node) error {
+	if len(node.KeyID) == 0 {
+		return nil
+	}
+	key, err := db.contentKey(node.KeyID)
+	if err != nil {
+		return err
+	}
+	node.Data, err = openSecret(key, node.Data)
+	if err != nil {
+		return fmt.Errorf("couldn't decrypt node: %v", err)
+	}
+	return nil
+}
+
+// parentContentKey returns the content key of the first encrypted parent of the node, or nil if there is none.
+func (db DB) parentContentKey(id NodeID) (NodeID, error) {
+	parents, err := db.GetAncestors(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get parents: %v", err)
+	}
+	for _, p := range parents {
+		n, err := db.getLatest(p)
+		if err == nil && len(n.KeyID) > 0 {
+			return n.KeyID, nil
+		}
+	}
+	return nil, nil
+}
+
+// isSubgraphContentKey returns true if the id is empty or a content key created for a new node, which has not
+// been shared.
+func (db DB) isSubgraphContentKey(id NodeID) bool {
+	if len(id) == 0 {
+		return true
+	}
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return false
+	}
+	ck, err := NewContentKeyFromNode(n)
+	return err == nil && len(ck.Subgraph) > 0
+}
+
+// inheritContentKey is called when the child is linked to the parent. If the parent is encrypted with a shared
+// content key, all nodes in the subgraph of the child that are encrypted with a subgraph content key are
+// encrypted again with the key of the parent.
+func (db DB) inheritContentKey(parent, child NodeID) error {
+	p, err := db.getLatest(parent)
+	if err != nil || db.isSubgraphContentKey(p.KeyID) {
+		return nil
+	}
+	ids, err := db.subgraph(child)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		n, err := db.getLatest(id)
+		if err != nil || !n.Type.Encrypted() || bytes.Compare(n.KeyID, p.KeyID) == 0 ||
+			!db.isSubgraphContentKey(n.KeyID) {
+			continue
+		}
+		if err = db.reencryptNode(id, p.KeyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptNode stores a new version of the node encrypted with the given content key.
+func (db DB) reencryptNode(id NodeID, key NodeID) error {
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return fmt.Errorf("couldn't get node: %v", err)
+	}
+	n.KeyID = key
+	if err = db.SaveNode(n); err != nil {
+		return fmt.Errorf("couldn't save node: %v", err)
+	}
+	return nil
+}
+
+// nodesWithKey returns the ids of all nodes whose latest version is encrypted with the given content key.
+func (db DB) nodesWithKey(key NodeID) (ids []NodeID, err error) {
+	var nodes []Node
+	err = db.gdb.Where("key_id = ?", []byte(key)).Find(&nodes).Error
+	if err != nil {
+		return nil, fmt.Errorf("couldn't search nodes: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		if seen[string(n.NodeID)] {
+			continue
+		}
+		seen[string(n.NodeID)] = true
+		latest, err := db.getLatest(n.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(latest.KeyID, key) == 0 {
+			ids = append(ids, n.NodeID)
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package cymidb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Encryption(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	secret := []byte("very secret mail content")
+
+	db, err := CreateDBFilePassphrase(f.Name(), "laptop", "", "passphrase")
+	require.NoError(t, err)
+	fd := NewFileData(secret)
+	require.NoError(t, db.SaveNode(fd))
+	fd.Data = append(secret, []byte(" - updated")...)
+	require.NoError(t, db.SaveNode(fd))
+	raw, err := db.getLatest(fd.node.NodeID)
+	require.NoError(t, err)
+	require.NotEmpty(t, raw.KeyID)
+	require.NotContains(t, string(raw.Data), string(secret))
+	bundle, err := db.Export()
+	require.NoError(t, err)
+	db.Close()
+
+	content, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.NotContains(t, string(content), string(secret))
+
+	_, err = OpenDBFile(f.Name())
+	require.Error(t, err)
+	_, err = OpenDBFilePassphrase(f.Name(), "wrong")
+	require.Error(t, err)
+	db, err = OpenDBFilePassphrase(f.Name(), "passphrase")
+	require.NoError(t, err)
+	defer db.Close()
+	versions, err := db.GetNodeVersions(fd.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(versions))
+	fd2, err := NewFileDataFromNode(versions[0])
+	require.NoError(t, err)
+	require.Equal(t, secret, fd2.Data)
+	n, err := db.GetLatest(fd.node.NodeID)
+	require.NoError(t, err)
+	fd2, err = NewFileDataFromNode(n)
+	require.NoError(t, err)
+	require.Equal(t, fd.Data, fd2.Data)
+
+	// Another DB can verify the nodes, but not decrypt them.
+	other, err := CreateDBFile(":memory:", "other", "")
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, other.Import(bundle))
+	_, err = other.GetLatest(fd.node.NodeID)
+	require.Error(t, err)
+	require.NoError(t, other.VerifyNode(raw))
+}
+
+func TestDB_SubgraphKeys(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+
+	db, err := CreateDBFile(f.Name(), "laptop", "")
+	require.NoError(t, err)
+	ident, err := NewIdentity("me", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+
+	// Every subgraph has its own key, wrapped for the device and the local identities.
+	dir := NewDir("mails", 0700)
+	other := NewDir("docs", 0700)
+	require.NoError(t, db.SaveNode(dir, other))
+	rawDir, err := db.getLatest(dir.node.NodeID)
+	require.NoError(t, err)
+	rawOther, err := db.getLatest(other.node.NodeID)
+	require.NoError(t, err)
+	require.NotEqual(t, rawDir.KeyID, rawOther.KeyID)
+	ck, err := db.GetContentKey(rawDir.KeyID)
+	require.NoError(t, err)
+	require.True(t, ck.HasRecipient(db.Device.node.NodeID))
+	require.True(t, ck.HasRecipient(ident.node.NodeID))
+
+	// A node that cannot be decrypted doesn't hide the others.
+	stranger, err := CreateDBFile(":memory:", "stranger", "")
+	require.NoError(t, err)
+	defer stranger.Close()
+	secret := NewDir("secret", 0700)
+	require.NoError(t, stranger.SaveNode(secret))
+	b, err := stranger.ExportNodes(stranger.Device.node.NodeID, secret.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, db.Import(b))
+	dirs, err := db.GetNodesByType(NodeTypeDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dirs))
+	db.Close()
+
+	// Without its key file, the DB cannot be opened.
+	key, err := ioutil.ReadFile(f.Name() + ".key")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(f.Name()+".key"))
+	_, err = OpenDBFile(f.Name())
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(f.Name()+".key", key, 0600))
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	db.Close()
+}
@@ -0,0 +1,229 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Endorsement is a certificate signed by an identity, stating that the device belongs to this identity.
+// It is linked from the identity to the device. If the device is lost, the endorsement can be revoked,
+// and all nodes signed by the device after the revocation are rejected.
+type Endorsement struct {
+	Identity NodeID
+	Device   NodeID
+	// DeviceKey is the public key of the device at the time of the endorsement.
+	DeviceKey ed25519.PublicKey
+	// IdentityKey is the public key of the identity used to sign this endorsement.
+	IdentityKey ed25519.PublicKey
+	Date        int64
+	// Revoked is the unix time in seconds of the revocation, or 0 if the endorsement is still valid.
+	Revoked   int64
+	Signature []byte
+	node      Node
+	// revokedAt is the SignedAt of the first revoked version, signed by the revoking device.
+	revokedAt int64
+}
+
+var NodeTypeEndorsement = NodeIdentity.SubType("blue.gasser/cybermind/endorsement")
+
+// NewEndorsement returns a new, unsigned endorsement of the device by the identity.
+func NewEndorsement(ident Identity, dev Device) (e Endorsement) {
+	e.node = NewNode(NodeTypeEndorsement)
+	e.Identity = ident.node.NodeID
+	e.Device = dev.node.NodeID
+	e.DeviceKey = dev.PublicKey
+	e.IdentityKey = ident.PublicKey
+	e.Date = time.Now().Unix()
+	return
+}
+
+func NewEndorsementFromNode(n Node) (e Endorsement, err error) {
+	err = n.DecodeNodeType(NodeTypeEndorsement, &e)
+	if err != nil {
+		return e, fmt.Errorf("couldn't decode endorsement: %v", err)
+	}
+	e.node = n
+	return
+}
+
+func (e Endorsement) GetNode() (Node, error) {
+	err := e.node.EncodeData(&e)
+	return e.node, err
+}
+
+func (e Endorsement) hash() []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{e.Identity, e.Device, e.DeviceKey, e.IdentityKey} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	_ = binary.Write(h, binary.LittleEndian, []int64{e.Date, e.Revoked})
+	return h.Sum(nil)
+}
+
+func (e *Endorsement) sign(priv ed25519.PrivateKey) {
+	e.IdentityKey = priv.Public().(ed25519.PublicKey)
+	e.Signature = ed25519.Sign(priv, e.hash())
+}
+
+// Verify checks that the endorsement has been signed by the current key of the given identity.
+func (e Endorsement) Verify(ident Identity) error {
+	if bytes.Compare(e.Identity, ident.node.NodeID) != 0 {
+		return errors.New("endorsement is from another identity")
+	}
+	if bytes.Compare(e.IdentityKey, ident.PublicKey) != 0 {
+		return errors.New("endorsement is not signed by the current key of the identity")
+	}
+	if !ed25519.Verify(ident.PublicKey, e.hash(), e.Signature) {
+		return errors.New("invalid signature of endorsement")
+	}
+	return nil
+}
+
+// GetEndorsements returns all endorsements of the given device that have a valid signature of their identity.
+func (db DB) GetEndorsements(dev NodeID) (es []Endorsement, err error) {
+	return db.getEndorsements(dev, map[string]bool{})
+}
+
+// getEndorsements returns the valid endorsements of the device.
+// The verified map is used to avoid loops when verifying the identities.
+func (db DB) getEndorsements(dev NodeID, verified map[string]bool) (es []Endorsement, err error) {
+	ancestors, err := db.GetAncestors(dev)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get ancestors: %v", err)
+	}
+	for _, id := range ancestors {
+		e, err := db.getEndorsement(id, verified)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil && bytes.Compare(e.Device, dev) == 0 {
+			es = append(es, *e)
+		}
+	}
+	return
+}
+
+// getEndorsement returns the endorsement stored in the node with the given id, or nil if the node doesn't
+// hold a valid endorsement. As a revocation must not be undone by storing an old version of the endorsement,
+// all versions are checked, and the endorsement is revoked if any version is revoked by a valid version of the
+// identity. Other versions must be signed by the latest valid version of the identity. Versions of another type
+// are skipped.
+func (db DB) getEndorsement(id NodeID, verified map[string]bool) (*Endorsement, error) {
+	versions, err := db.nodeVersions(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get endorsement: %v", err)
+	}
+	var valid, revoked *Endorsement
+	for _, v := range versions {
+		if v.Type != NodeTypeEndorsement {
+			continue
+		}
+		e, err := NewEndorsementFromNode(v)
+		if err != nil {
+			continue
+		}
+		idents, err := db.validIdentities(e.Identity, e.Device, verified)
+		if err != nil {
+			return nil, err
+		}
+		if len(idents) == 0 {
+			continue
+		}
+		if e.Revoked != 0 {
+			for _, ident := range idents {
+				if e.Verify(ident) != nil {
+					continue
+				}
+				// Versions signed again by Rotate keep the revocation, so the first revoked version tells when
+				// the revocation has been signed. Taking the earliest can only reject more nodes of the revoked
+				// device.
+				if revoked == nil || e.Revoked < revoked.Revoked {
+					r := e
+					r.revokedAt = v.SignedAt
+					revoked = &r
+				}
+				break
+			}
+		}
+		if e.Verify(idents[0]) == nil {
+			valid = &e
+		}
+	}
+	if revoked == nil {
+		return valid, nil
+	}
+	if valid == nil {
+		return revoked, nil
+	}
+	valid.Revoked, valid.revokedAt = revoked.Revoked, revoked.revokedAt
+	return valid, nil
+}
+
+// validIdentities returns the versions of the identity that verify and have a valid chain of keys, latest first.
+// Versions signed by the device whose endorsement is checked are skipped, so a device cannot change the identity
+// that vouches for it. Only the first version is always kept, as it holds the key all other keys start with.
+func (db DB) validIdentities(id, dev NodeID, verified map[string]bool) (idents []Identity, err error) {
+	versions, err := db.nodeVersions(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get identity: %v", err)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v.Type != NodeIdentity || (v.Version > 0 && bytes.Compare(v.Signer, dev) == 0) {
+			continue
+		}
+		if db.verifyNode(v, verified) != nil {
+			continue
+		}
+		ident, err := NewIdentityFromNode(v)
+		if err != nil || db.verifyKeys(ident) != nil {
+			continue
+		}
+		idents = append(idents, ident)
+	}
+	return
+}
+
+// endorsedBy returns true if one of the endorsements is a valid endorsement of the identity that is not revoked.
+func endorsedBy(endorsements []Endorsement, id NodeID) bool {
+	for _, e := range endorsements {
+		if e.Revoked == 0 && bytes.Compare(e.Identity, id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// trustDevice returns nil if the device is the active device, or if it is endorsed by an identity whose private
+// key is stored in this DB. Revoked endorsements are not trusted.
+func (db DB) trustDevice(dev NodeID) error {
+	if bytes.Compare(dev, db.Device.node.NodeID) == 0 {
+		return nil
+	}
+	endorsements, err := db.GetEndorsements(dev)
+	if err != nil {
+		return err
+	}
+	for _, e := range endorsements {
+		if e.Revoked != 0 {
+			continue
+		}
+		idents, err := db.validIdentities(e.Identity, dev, map[string]bool{})
+		if err != nil {
+			return err
+		}
+		if len(idents) == 0 {
+			continue
+		}
+		if _, err = idents[0].signer(db); err == nil {
+			return nil
+		}
+	}
+	return errors.New("device is not endorsed by a local identity")
+}
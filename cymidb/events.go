@@ -0,0 +1,257 @@
+package cymidb
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventKind is the kind of change an Event reports.
+type EventKind int
+
+const (
+	// EventNodeSaved is sent for every new version of a node, either saved or imported.
+	EventNodeSaved = EventKind(iota)
+	// EventNodeDeleted is sent when a node is deleted.
+	EventNodeDeleted
+	// EventLinkAdded is sent when a link is added.
+	EventLinkAdded
+	// EventLinkRemoved is sent when a link is removed.
+	EventLinkRemoved
+)
+
+// Event describes a change in the DB.
+type Event struct {
+	// Seq is the position of the event in the timeline of the DB.
+	Seq  uint
+	Kind EventKind
+	// Node is the changed node. For link events it is the node the link points to. The Data is decrypted if the
+	// content key is available.
+	Node Node
+	// Old is the previous version of the node, or empty for new nodes and link events.
+	Old Node
+	// Link is the added or removed link for link events.
+	Link Link
+	// Device is the device that did the change.
+	Device NodeID
+}
+
+// EventBus sends the events of a DB to all subscriptions.
+type EventBus struct {
+	sync.Mutex
+	subs []*Subscription
+}
+
+// subscriptionQueueMax is the maximum number of events waiting in the queue of a subscription.
+var subscriptionQueueMax = 10000
+
+// Subscription receives the events for the node types it has been created for.
+type Subscription struct {
+	// C receives the events. It is closed when the subscription is closed, or when more than
+	// subscriptionQueueMax events are waiting to be received. Durable subscriptions can subscribe again to get
+	// the missed events from the timeline.
+	C     <-chan Event
+	c     chan Event
+	types []NodeType
+	bus   *EventBus
+	// queue holds the events not yet received, so that the DB never waits for a slow subscriber.
+	queue []Event
+	// replay holds the events from the timeline of a durable subscription. They're delivered before the queue.
+	replay []Event
+	// replaying is set while the timeline is read page by page. Meanwhile new events are not queued, as they're
+	// read from the timeline, too.
+	replaying bool
+	cond      *sync.Cond
+	closed    bool
+	stopped   chan struct{}
+	// after is the position in the timeline up to which events are not delivered anymore, because they have been
+	// replayed already.
+	after uint
+	// hook is the hook whose cursor is moved by Ack, for durable subscriptions.
+	hook NodeID
+	db   DB
+}
+
+// Subscribe returns a subscription to the events of nodes of the given types. A general type like NodeBlob includes
+// all its sub-types. For link events, it is enough if one of the two nodes matches. Without types, all events are
+// received.
+func (db DB) Subscribe(types ...NodeType) *Subscription {
+	c := make(chan Event)
+	s := &Subscription{C: c, c: c, types: types, bus: db.events, stopped: make(chan struct{}), db: db}
+	s.cond = sync.NewCond(&sync.Mutex{})
+	db.events.Lock()
+	db.events.subs = append(db.events.subs, s)
+	db.events.Unlock()
+	go s.deliver()
+	return s
+}
+
+// Subscribe returns a subscription to the events of the types of the hook.
+func (h Hook) Subscribe() *Subscription {
+	return h.db.Subscribe(h.Types...)
+}
+
+// Close stops the subscription. Events that have not been received yet are dropped.
+func (s *Subscription) Close() {
+	s.bus.Lock()
+	for i, sub := range s.bus.subs {
+		if sub == s {
+			s.bus.subs = append(s.bus.subs[:i], s.bus.subs[i+1:]...)
+			break
+		}
+	}
+	s.bus.Unlock()
+	s.stop()
+}
+
+// stop closes the channel of the subscription, after all events have been dropped.
+func (s *Subscription) stop() {
+	s.cond.L.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stopped)
+	}
+	s.cond.L.Unlock()
+	s.cond.Signal()
+}
+
+// push adds the event to the queue of the subscription. If the queue is full, the subscription is stopped and
+// false is returned.
+func (s *Subscription) push(e Event) bool {
+	s.cond.L.Lock()
+	if s.replaying {
+		s.cond.L.Unlock()
+		return true
+	}
+	if len(s.queue) >= subscriptionQueueMax {
+		s.cond.L.Unlock()
+		s.stop()
+		return false
+	}
+	if e.Seq > s.after {
+		s.queue = append(s.queue, e)
+	}
+	s.cond.L.Unlock()
+	s.cond.Signal()
+	return true
+}
+
+// deliver sends the queued events to the channel, until the subscription is closed.
+func (s *Subscription) deliver() {
+	defer close(s.c)
+	for {
+		s.cond.L.Lock()
+		for len(s.replay) == 0 && len(s.queue) == 0 && !s.closed {
+			if !s.replaying {
+				s.cond.Wait()
+			} else if err := s.readTimeline(); err != nil {
+				s.closed = true
+				close(s.stopped)
+			}
+		}
+		if s.closed {
+			s.cond.L.Unlock()
+			return
+		}
+		var e Event
+		if len(s.replay) > 0 {
+			e = s.replay[0]
+			s.replay = s.replay[1:]
+		} else {
+			e = s.queue[0]
+			s.queue = s.queue[1:]
+		}
+		s.cond.L.Unlock()
+		select {
+		case s.c <- e:
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// publish sends the event to all subscriptions matching one of the types. Subscriptions with a full queue are
+// removed.
+func (bus *EventBus) publish(e Event, types ...NodeType) {
+	bus.Lock()
+	defer bus.Unlock()
+	subs := bus.subs[:0]
+	for _, s := range bus.subs {
+		keep := true
+		for _, t := range types {
+			if t.Matches(s.types) {
+				keep = s.push(e)
+				break
+			}
+		}
+		if keep {
+			subs = append(subs, s)
+		}
+	}
+	bus.subs = subs
+}
+
+// pendingEvent is an event whose change has been recorded in the timeline. It is sent once the change is committed.
+type pendingEvent struct {
+	event Event
+	types []NodeType
+}
+
+// send sends the events to the subscriptions matching their types.
+func (db DB) send(events ...pendingEvent) {
+	for _, pe := range events {
+		db.events.publish(pe.event, pe.types...)
+	}
+}
+
+// recordNode records the change of the node in the timeline and returns its event, with the new and the old
+// version decrypted if possible.
+func (db DB) recordNode(kind EventKind, n, old Node, device NodeID) (pendingEvent, error) {
+	c := nodeChange(kind, n, device)
+	if err := db.gdb.Create(&c).Error; err != nil {
+		return pendingEvent{}, fmt.Errorf("couldn't record change: %v", err)
+	}
+	return db.nodeEvent(c, n, old), nil
+}
+
+// nodeChange returns the entry of the timeline for the change of the node.
+func nodeChange(kind EventKind, n Node, device NodeID) Change {
+	return Change{Kind: kind, NodeID: n.NodeID, Version: n.Version, Type: n.Type, Device: device}
+}
+
+// nodeEvent returns the event for a change of a node that has been recorded in the timeline.
+func (db DB) nodeEvent(c Change, n, old Node) pendingEvent {
+	e := Event{Seq: c.ID, Kind: c.Kind, Node: db.tryDecrypt(n), Device: c.Device}
+	if old.NodeID != nil {
+		e.Old = db.tryDecrypt(old)
+	}
+	return pendingEvent{event: e, types: []NodeType{n.Type}}
+}
+
+// recordLink records the added or removed link in the timeline and returns its event.
+func (db DB) recordLink(kind EventKind, l Link) (pendingEvent, error) {
+	c := Change{Kind: kind, NodeID: l.To, From: l.From, Origin: l.Origin, Device: db.Device.node.NodeID}
+	pe := pendingEvent{event: Event{Kind: kind, Link: l, Device: db.Device.node.NodeID}}
+	if from, err := db.getLatest(l.From); err == nil {
+		c.FromType = from.Type
+		pe.types = append(pe.types, from.Type)
+	}
+	if to, err := db.getLatest(l.To); err == nil {
+		c.Type = to.Type
+		pe.event.Node = db.tryDecrypt(to)
+		pe.types = append(pe.types, to.Type)
+	}
+	if err := db.gdb.Create(&c).Error; err != nil {
+		return pe, fmt.Errorf("couldn't record change: %v", err)
+	}
+	pe.event.Seq = c.ID
+	return pe, nil
+}
+
+// tryDecrypt returns the node with its Data decrypted, or unchanged if it cannot be decrypted.
+func (db DB) tryDecrypt(n Node) Node {
+	d := n
+	if db.decryptNode(&d) != nil {
+		return n
+	}
+	return d
+}
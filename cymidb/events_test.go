@@ -0,0 +1,114 @@
+package cymidb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Subscribe(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := NewHook("files", nil, []NodeType{NodeTypeFileData})
+	n, err := h.GetNode()
+	require.NoError(t, err)
+	h, err = NewHookFromNode(db, n)
+	require.NoError(t, err)
+	sub := h.Subscribe()
+	defer sub.Close()
+	all := db.Subscribe()
+	recv := func(s *Subscription) Event {
+		select {
+		case e := <-s.C:
+			return e
+		case <-time.After(time.Second):
+			require.Fail(t, "no event received")
+		}
+		return Event{}
+	}
+
+	dir := NewDir("docs", 0777)
+	fd := NewFileData([]byte("first"))
+	require.NoError(t, db.SaveNode(dir, fd))
+	e := recv(sub)
+	require.Equal(t, EventNodeSaved, e.Kind)
+	require.Equal(t, fd.node.NodeID, e.Node.NodeID)
+	require.Nil(t, e.Old.NodeID)
+	require.Equal(t, db.Device.node.NodeID, e.Device)
+	// Every new encrypted node without parent gets its own content key.
+	require.Equal(t, NodeTypeContentKey, recv(all).Node.Type)
+	require.Equal(t, dir.node.NodeID, recv(all).Node.NodeID)
+	require.Equal(t, NodeTypeContentKey, recv(all).Node.Type)
+	require.Equal(t, fd.node.NodeID, recv(all).Node.NodeID)
+	all.Close()
+
+	fd.Data = []byte("second")
+	require.NoError(t, db.SaveNode(fd))
+	e = recv(sub)
+	fd2, err := NewFileDataFromNode(e.Node)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(fd2.Data))
+	fd2, err = NewFileDataFromNode(e.Old)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(fd2.Data))
+
+	require.NoError(t, db.AddLink(dir, fd))
+	e = recv(sub)
+	require.Equal(t, EventLinkAdded, e.Kind)
+	require.Equal(t, dir.node.NodeID, e.Link.From)
+	require.NoError(t, db.RemoveLink(dir, fd))
+	require.Equal(t, EventLinkRemoved, recv(sub).Kind)
+
+	// Events of other types are not received.
+	dir.Name = "documents"
+	require.NoError(t, db.SaveNode(dir))
+	require.NoError(t, db.DeleteNode(fd))
+	e = recv(sub)
+	require.Equal(t, EventNodeDeleted, e.Kind)
+	_, err = db.GetLatest(fd.node.NodeID)
+	require.Error(t, err)
+
+	// Imported nodes are sent with the device that signed them.
+	other, err := CreateDBFile(":memory:", "other", "")
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, other.SaveNode(NewFileData([]byte("remote"))))
+	b, err := other.Export()
+	require.NoError(t, err)
+	require.NoError(t, db.Import(b))
+	e = recv(sub)
+	require.Equal(t, other.Device.node.NodeID, e.Device)
+}
+
+func TestSubscription_Overflow(t *testing.T) {
+	defer func(max int) { subscriptionQueueMax = max }(subscriptionQueueMax)
+	subscriptionQueueMax = 2
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	sub := db.Subscribe(NodeTypeDir)
+	defer sub.Close()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.SaveNode(NewDir("docs", 0777)))
+	}
+	received := 0
+	for open := true; open; {
+		select {
+		case _, open = <-sub.C:
+			if open {
+				received++
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "subscription not closed")
+		}
+	}
+	require.True(t, received < 5)
+	db.events.Lock()
+	subs := db.events.subs
+	db.events.Unlock()
+	require.NotContains(t, subs, sub)
+}
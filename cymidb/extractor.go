@@ -0,0 +1,241 @@
+package cymidb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extractors find tags, dates and identities in blob nodes whenever they are saved, and link them to the node.
+// The links they create hold the name of the extractor as Origin, so automatic tags can be told apart from manual
+// ones, and can be removed and created again by RerunExtractors.
+
+// Extractor finds annotations in a blob node.
+type Extractor interface {
+	// Name identifies the extractor and is stored as the Origin of the links it creates.
+	Name() string
+	// Extract returns the annotations of the node. The Data of the node is decrypted.
+	Extract(db DB, n Node) ([]Annotation, error)
+}
+
+// AnnotationKind tells how an annotation is linked to the node.
+type AnnotationKind int
+
+const (
+	// AnnotationTag links the tag with the name given in Value, creating it if needed.
+	AnnotationTag = AnnotationKind(iota)
+	// AnnotationDate links a tag for the day given in Value as "2006-01-02", with parent tags for the month and
+	// the year.
+	AnnotationDate
+	// AnnotationIdentity links the identity whose alias or email is given in Value, if it exists in the DB.
+	AnnotationIdentity
+)
+
+// Annotation is something an extractor found in a node.
+type Annotation struct {
+	Kind  AnnotationKind
+	Value string
+}
+
+// extractors is the pipeline of extractors of a DB.
+type extractors struct {
+	sync.Mutex
+	list []Extractor
+	// owner is the owner of the tags created by the extractors.
+	owner NodeID
+}
+
+// SetExtractors sets the extractors that run whenever a blob node is saved. The tags they create belong to the
+// owner.
+func (db DB) SetExtractors(owner NodeID, es ...Extractor) {
+	db.extractors.Lock()
+	defer db.extractors.Unlock()
+	db.extractors.list = es
+	db.extractors.owner = owner
+}
+
+// extract runs all extractors on the node. A failing extractor doesn't stop the others, and all errors are
+// returned together.
+func (db DB) extract(n Node) error {
+	db.extractors.Lock()
+	list := db.extractors.list
+	owner := db.extractors.owner
+	db.extractors.Unlock()
+	var errs []string
+	for _, e := range list {
+		annotations, err := e.Extract(db, n)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("extractor %s failed: %v", e.Name(), err))
+			continue
+		}
+		for _, a := range annotations {
+			if err = db.annotate(n.NodeID, a, owner, e.Name()); err != nil {
+				errs = append(errs, fmt.Sprintf("couldn't add annotation of %s: %v", e.Name(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// annotate links the node of the annotation to the node with the given id.
+func (db DB) annotate(id NodeID, a Annotation, owner NodeID, origin string) error {
+	var from NodeID
+	switch a.Kind {
+	case AnnotationTag:
+		t, err := db.findOrCreateTag(a.Value, owner)
+		if err != nil {
+			return err
+		}
+		from = t.node.NodeID
+	case AnnotationDate:
+		day, err := time.Parse("2006-01-02", a.Value)
+		if err != nil {
+			return fmt.Errorf("invalid date: %v", err)
+		}
+		var parent *Tag
+		for _, name := range []string{day.Format("2006"), day.Format("2006-01"), day.Format("2006-01-02")} {
+			t, err := db.findOrCreateTag(name, owner)
+			if err != nil {
+				return err
+			}
+			if parent != nil {
+				if err = db.ensureLink(parent.node.NodeID, t.node.NodeID, origin); err != nil {
+					return err
+				}
+			}
+			parent = &t
+		}
+		from = parent.node.NodeID
+	case AnnotationIdentity:
+		ident, err := db.findIdentity(a.Value)
+		if err != nil {
+			// Only identities known to the DB are linked.
+			return nil
+		}
+		from = ident.node.NodeID
+	default:
+		return errors.New("unknown annotation")
+	}
+	return db.ensureLink(from, id, origin)
+}
+
+// ensureLink adds a link with the given origin, if the two nodes are not linked yet.
+func (db DB) ensureLink(from, to NodeID, origin string) error {
+	var count int
+	err := db.gdb.Model(&Link{}).Where(&Link{From: from, To: to}).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("couldn't search link: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	return db.transaction(func(tx DB) ([]pendingEvent, error) {
+		link := Link{From: from, To: to, Origin: origin}
+		tx.signLink(&link)
+		if err := tx.gdb.Save(&link).Error; err != nil {
+			return nil, fmt.Errorf("couldn't save link: %v", err)
+		}
+		e, err := tx.recordLink(EventLinkAdded, link)
+		return []pendingEvent{e}, err
+	})
+}
+
+func (db DB) findOrCreateTag(name string, owner NodeID) (Tag, error) {
+	if t, err := db.FindTag(name, owner); err == nil {
+		return t, nil
+	}
+	return db.CreateTag(name, owner)
+}
+
+// findIdentity returns the identity with the given alias or email.
+func (db DB) findIdentity(name string) (ident Identity, err error) {
+	nodes, err := db.GetNodesByType(NodeIdentity)
+	if err != nil {
+		return ident, fmt.Errorf("couldn't get identities: %v", err)
+	}
+	for _, n := range nodes {
+		ident, err := NewIdentityFromNode(n)
+		if err != nil {
+			return ident, err
+		}
+		if strings.EqualFold(ident.Alias, name) {
+			return ident, nil
+		}
+		for _, e := range ident.Emails {
+			if strings.EqualFold(e, name) {
+				return ident, nil
+			}
+		}
+	}
+	return ident, errors.New("no identity with this name")
+}
+
+// GetAnnotationLinks returns the links to the node that have been created by extractors.
+func (db DB) GetAnnotationLinks(id NodeID) (links []Link, err error) {
+	err = db.gdb.Where(&Link{To: id}).Where("origin != ''").Find(&links).Error
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get links: %v", err)
+	}
+	return
+}
+
+// RerunExtractors removes the links to the node created by the given extractors, or by all extractors if no names
+// are given, and runs the extractors again on the latest version of the node.
+func (db DB) RerunExtractors(id NodeID, names ...string) error {
+	links, err := db.GetAnnotationLinks(id)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if len(names) > 0 && !containsString(names, l.Origin) {
+			continue
+		}
+		if err = db.removeLinks(Link{From: l.From, To: l.To, Origin: l.Origin}); err != nil {
+			return err
+		}
+	}
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return db.extract(n)
+	}
+	db.extractors.Lock()
+	var list []Extractor
+	for _, e := range db.extractors.list {
+		if containsString(names, e.Name()) {
+			list = append(list, e)
+		}
+	}
+	dbSub := db
+	dbSub.extractors = &extractors{list: list, owner: db.extractors.owner}
+	db.extractors.Unlock()
+	return dbSub.extract(n)
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DateExtractor annotates every blob node with the day it has been created.
+type DateExtractor struct{}
+
+func (DateExtractor) Name() string {
+	return "date"
+}
+
+func (DateExtractor) Extract(db DB, n Node) ([]Annotation, error) {
+	day := time.Unix(n.Date, 0).Format("2006-01-02")
+	return []Annotation{{Kind: AnnotationDate, Value: day}}, nil
+}
@@ -0,0 +1,140 @@
+package cymidb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// wordExtractor tags file data with all words starting with '#', and links identities for words with '@'.
+type wordExtractor struct{}
+
+func (wordExtractor) Name() string {
+	return "words"
+}
+
+func (wordExtractor) Extract(db DB, n Node) (as []Annotation, err error) {
+	if n.Type != NodeTypeFileData {
+		return nil, nil
+	}
+	fd, err := NewFileDataFromNode(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range strings.Fields(string(fd.Data)) {
+		switch {
+		case strings.HasPrefix(w, "#"):
+			as = append(as, Annotation{Kind: AnnotationTag, Value: w[1:]})
+		case strings.Contains(w, "@"):
+			as = append(as, Annotation{Kind: AnnotationIdentity, Value: w})
+		}
+	}
+	return
+}
+
+func TestDB_Extractors(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	owner, err := NewIdentity("me", []string{"me@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(owner))
+	db.SetExtractors(owner.node.NodeID, DateExtractor{}, wordExtractor{})
+
+	manual, err := db.CreateTag("invoice", owner.node.NodeID)
+	require.NoError(t, err)
+	fd := NewFileData([]byte("#invoice #urgent from me@example.com and nobody@example.com"))
+	require.NoError(t, db.Tag(fd, manual))
+	require.NoError(t, db.SaveNode(fd))
+
+	tags, err := db.GetTags(fd.node.NodeID)
+	require.NoError(t, err)
+	var names []string
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	require.Equal(t, []string{"invoice", time.Now().Format("2006-01-02"), "urgent"}, names)
+	year, err := db.FindTag(time.Now().Format("2006"), owner.node.NodeID)
+	require.NoError(t, err)
+	tagged, err := db.GetTagged(year.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tagged))
+	ancestors, err := db.GetAncestors(fd.node.NodeID)
+	require.NoError(t, err)
+	require.True(t, containsID(ancestors, owner.node.NodeID))
+
+	// The manual tag is not recorded as automatic.
+	links, err := db.GetAnnotationLinks(fd.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(links))
+	origins := map[string]int{}
+	for _, l := range links {
+		origins[l.Origin]++
+	}
+	require.Equal(t, map[string]int{"date": 1, "words": 2}, origins)
+
+	// Rerunning the extractors removes the automatic tags that are not found anymore.
+	db.SetExtractors(owner.node.NodeID, DateExtractor{})
+	fd.Data = []byte("#done")
+	require.NoError(t, db.SaveNode(fd))
+	db.SetExtractors(owner.node.NodeID, DateExtractor{}, wordExtractor{})
+	require.NoError(t, db.RerunExtractors(fd.node.NodeID, "words"))
+	tags, err = db.GetTags(fd.node.NodeID)
+	require.NoError(t, err)
+	names = nil
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	require.Equal(t, []string{"invoice", time.Now().Format("2006-01-02"), "done"}, names)
+}
+
+// failingExtractor fails for every node.
+type failingExtractor struct{}
+
+func (failingExtractor) Name() string {
+	return "failing"
+}
+
+func (failingExtractor) Extract(db DB, n Node) ([]Annotation, error) {
+	return nil, errors.New("broken")
+}
+
+func TestDB_ExtractorError(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	owner, err := NewIdentity("me", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(owner))
+	db.SetExtractors(owner.node.NodeID, failingExtractor{}, DateExtractor{})
+	sub := db.Subscribe(NodeTypeFileData)
+	defer sub.Close()
+
+	// All nodes are saved and published, and the other extractors still run.
+	first, second := NewFileData([]byte("first")), NewFileData([]byte("second"))
+	err = db.SaveNode(first, second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "broken")
+	for _, fd := range []FileData{first, second} {
+		_, err = db.GetLatest(fd.node.NodeID)
+		require.NoError(t, err)
+		tags, err := db.GetTags(fd.node.NodeID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(tags))
+	}
+	var saved []NodeID
+	for len(saved) < 2 {
+		select {
+		case e := <-sub.C:
+			if e.Kind == EventNodeSaved {
+				saved = append(saved, e.Node.NodeID)
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "no event received")
+		}
+	}
+	require.Equal(t, []NodeID{first.node.NodeID, second.node.NodeID}, saved)
+}
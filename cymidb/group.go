@@ -0,0 +1,320 @@
+package cymidb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Group is a set of identities that can be used as the principal of an ACL, everywhere an identity is accepted.
+// Groups can contain other groups. Content keys shared with a group are wrapped for all its identities, and are
+// updated when the members of the group change.
+type Group struct {
+	Name string
+	// Members are the identities and groups in this group.
+	Members []NodeID
+	node    Node
+}
+
+var NodeTypeGroup = NodeIdentity.SubType("blue.gasser/cybermind/group")
+
+func NewGroupFromNode(n Node) (g Group, err error) {
+	err = n.DecodeNodeType(NodeTypeGroup, &g)
+	if err != nil {
+		return g, fmt.Errorf("couldn't decode group: %v", err)
+	}
+	g.node = n
+	return
+}
+
+// NewGroup returns a new group without members.
+func NewGroup(name string) (g Group) {
+	g.node = NewNode(NodeTypeGroup)
+	g.Name = name
+	return
+}
+
+func (g Group) GetNode() (Node, error) {
+	err := g.node.EncodeData(&g)
+	return g.node, err
+}
+
+// HasMember returns true if the identity or group is a direct member of this group.
+func (g Group) HasMember(id NodeID) bool {
+	for _, m := range g.Members {
+		if bytes.Compare(m, id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AddMember adds the identity or group to this group and saves it. All content keys shared with this group, or with
+// a group containing it, are wrapped for the new identities.
+func (g *Group) AddMember(db DB, id NodeID) error {
+	if g.HasMember(id) {
+		return nil
+	}
+	g.Members = append(g.Members, id)
+	if err := db.SaveNode(g); err != nil {
+		return fmt.Errorf("couldn't save group: %v", err)
+	}
+	return db.updateGroupKeys(g.node.NodeID, nil)
+}
+
+// RemoveMember removes the identity or group from this group and saves it. All content keys shared with this group,
+// or with a group containing it, are replaced by new content keys without the removed identities, and the nodes are
+// encrypted again. The removed identities can still read the versions they already have, but no new ones.
+func (g *Group) RemoveMember(db DB, id NodeID) error {
+	if !g.HasMember(id) {
+		return nil
+	}
+	before, err := db.GroupIdentities(g.node.NodeID)
+	if err != nil {
+		return err
+	}
+	var members []NodeID
+	for _, m := range g.Members {
+		if bytes.Compare(m, id) != 0 {
+			members = append(members, m)
+		}
+	}
+	g.Members = members
+	if err = db.SaveNode(g); err != nil {
+		return fmt.Errorf("couldn't save group: %v", err)
+	}
+	after, err := db.GroupIdentities(g.node.NodeID)
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, id := range before {
+		removed[string(id)] = true
+	}
+	for _, id := range after {
+		delete(removed, string(id))
+	}
+	return db.updateGroupKeys(g.node.NodeID, removed)
+}
+
+// GetGroup returns the group with the given id.
+func (db DB) GetGroup(id NodeID) (g Group, err error) {
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return g, fmt.Errorf("couldn't get group: %v", err)
+	}
+	return NewGroupFromNode(n)
+}
+
+// isGroup returns true if the node is a group.
+func (db DB) isGroup(id NodeID) bool {
+	n, err := db.getLatest(id)
+	return err == nil && n.Type == NodeTypeGroup
+}
+
+// GroupIdentities returns all identities of the group and of the groups it contains. If the id is not a group,
+// only the id itself is returned.
+func (db DB) GroupIdentities(id NodeID) (identities []NodeID, err error) {
+	_, identities, err = db.expandGroup(id)
+	return
+}
+
+// expandGroup returns all groups and identities reachable from the given id, including the id itself.
+func (db DB) expandGroup(id NodeID) (groups, identities []NodeID, err error) {
+	visited := map[string]bool{string(id): true}
+	todo := []NodeID{id}
+	for len(todo) > 0 {
+		current := todo[0]
+		todo = todo[1:]
+		if !db.isGroup(current) {
+			identities = append(identities, current)
+			continue
+		}
+		groups = append(groups, current)
+		g, err := db.GetGroup(current)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range g.Members {
+			if !visited[string(m)] {
+				visited[string(m)] = true
+				todo = append(todo, m)
+			}
+		}
+	}
+	return
+}
+
+// groupsContaining returns the group and all groups that contain it, directly or through other groups.
+func (db DB) groupsContaining(id NodeID) (groups []NodeID, err error) {
+	nodes, err := db.GetNodesByType(NodeTypeGroup)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get groups: %v", err)
+	}
+	var all []Group
+	for _, n := range nodes {
+		g, err := NewGroupFromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, g)
+	}
+	visited := map[string]bool{string(id): true}
+	groups = []NodeID{id}
+	for i := 0; i < len(groups); i++ {
+		for _, g := range all {
+			if g.HasMember(groups[i]) && !visited[string(g.node.NodeID)] {
+				visited[string(g.node.NodeID)] = true
+				groups = append(groups, g.node.NodeID)
+			}
+		}
+	}
+	return
+}
+
+// updateGroupKeys updates all content keys shared with the group or a group containing it. If identities have been
+// removed, the content keys are replaced, else they are wrapped for all current identities of their groups.
+func (db DB) updateGroupKeys(group NodeID, removed map[string]bool) error {
+	groups, err := db.groupsContaining(group)
+	if err != nil {
+		return err
+	}
+	affected := map[string]bool{}
+	for _, g := range groups {
+		affected[string(g)] = true
+	}
+	keys, err := db.GetNodesByType(NodeTypeContentKey)
+	if err != nil {
+		return fmt.Errorf("couldn't get content keys: %v", err)
+	}
+	for _, n := range keys {
+		ck, err := NewContentKeyFromNode(n)
+		if err != nil {
+			return err
+		}
+		shared := false
+		for _, g := range ck.Groups {
+			shared = shared || affected[string(g)]
+		}
+		if !shared {
+			continue
+		}
+		if ck, err = db.GetContentKey(n.NodeID); err != nil {
+			return err
+		}
+		if len(removed) > 0 {
+			err = db.replaceContentKey(ck, removed)
+		} else {
+			err = db.wrapForGroups(&ck)
+			if err == nil {
+				err = db.SaveNode(ck)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapForGroups wraps the content key for all identities of its groups.
+func (db DB) wrapForGroups(ck *ContentKey) error {
+	for _, g := range ck.Groups {
+		if err := db.wrapFor(ck, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapFor wraps the content key for the principal, which is an identity, a device or a group.
+func (db DB) wrapFor(ck *ContentKey, principal NodeID) error {
+	ids, err := db.GroupIdentities(principal)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		boxKey, err := db.boxKey(id)
+		if err != nil {
+			return err
+		}
+		if err = ck.AddRecipient(id, boxKey); err != nil {
+			return fmt.Errorf("couldn't wrap key for %x: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// replaceContentKey creates a new content key for all recipients of the old one, and encrypts all nodes using the
+// old key with the new key. Removed identities only get the new key if an ACL still lets them read one of the
+// nodes, for example through a direct share or another group. The groups of the old key are removed, so it isn't
+// wrapped for new members anymore.
+func (db DB) replaceContentKey(old ContentKey, removed map[string]bool) error {
+	ids, err := db.nodesWithKey(old.node.NodeID)
+	if err != nil {
+		return err
+	}
+	ck, err := NewContentKey()
+	if err != nil {
+		return err
+	}
+	ck.Groups = old.Groups
+	acl := NewACLEvaluator(db)
+	for _, e := range old.Envelopes {
+		if removed[string(e.Recipient)] {
+			access, err := db.canReadAny(acl, e.Recipient, ids)
+			if err != nil {
+				return err
+			}
+			if !access {
+				continue
+			}
+		}
+		if err = db.wrapFor(&ck, e.Recipient); err != nil {
+			return err
+		}
+	}
+	if err = db.wrapForGroups(&ck); err != nil {
+		return err
+	}
+	if err = db.SaveNode(ck); err != nil {
+		return fmt.Errorf("couldn't save content key: %v", err)
+	}
+	old.Groups = nil
+	if err = db.SaveNode(old); err != nil {
+		return fmt.Errorf("couldn't save retired content key: %v", err)
+	}
+	for _, id := range ids {
+		if err = db.reencryptNode(id, ck.node.NodeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canReadAny returns true if the ACLs let the identity read one of the nodes.
+func (db DB) canReadAny(acl ACLEvaluator, identity NodeID, ids []NodeID) (bool, error) {
+	for _, id := range ids {
+		can, err := acl.Can(identity, ACLRead, id)
+		if err != nil || can {
+			return can, err
+		}
+	}
+	return false, nil
+}
+
+// boxKey returns the public box key of an identity or a device.
+func (db DB) boxKey(id NodeID) ([]byte, error) {
+	n, err := db.GetLatest(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get recipient %x: %v", id, err)
+	}
+	switch n.Type {
+	case NodeIdentity:
+		ident, err := NewIdentityFromNode(n)
+		return ident.BoxKey, err
+	case NodeDev:
+		dev, err := NewDeviceFromNode(n)
+		return dev.BoxKey, err
+	}
+	return nil, fmt.Errorf("recipient %x has no box key", id)
+}
@@ -0,0 +1,104 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFriend creates a DB with a new identity and sends the identity to the other DB.
+func newFriend(t *testing.T, other DB, name string) (DB, Identity) {
+	db, err := CreateDBFile(":memory:", name, "")
+	require.NoError(t, err)
+	ident, err := NewIdentity(name, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+	b, err := db.ExportNodes(ident.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, other.Import(b))
+	return db, ident
+}
+
+func TestGroup(t *testing.T) {
+	alice, err := CreateDBFile(":memory:", "alice", "")
+	require.NoError(t, err)
+	defer alice.Close()
+	bob, bobIdent := newFriend(t, alice, "bob")
+	defer bob.Close()
+	carol, carolIdent := newFriend(t, alice, "carol")
+	defer carol.Close()
+	dave, daveIdent := newFriend(t, alice, "dave")
+	defer dave.Close()
+
+	kids := NewGroup("kids")
+	kids.Members = []NodeID{carolIdent.node.NodeID}
+	family := NewGroup("family")
+	family.Members = []NodeID{bobIdent.node.NodeID, kids.node.NodeID}
+	require.NoError(t, alice.SaveNode(kids, family))
+	ids, err := alice.GroupIdentities(family.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, []NodeID{bobIdent.node.NodeID, carolIdent.node.NodeID}, ids)
+
+	photos := NewDir("Photos", 0777)
+	photo := NewFileData([]byte("holidays"))
+	require.NoError(t, alice.SaveNode(photos, photo))
+	require.NoError(t, alice.AddLink(photos, photo))
+	ck, err := alice.Share(photos, family.node.NodeID, ACLRead)
+	require.NoError(t, err)
+	acl := NewACLEvaluator(alice)
+	for _, id := range []NodeID{bobIdent.node.NodeID, carolIdent.node.NodeID} {
+		can, err := acl.Can(id, ACLRead, photo.node.NodeID)
+		require.NoError(t, err)
+		require.True(t, can)
+	}
+	can, err := acl.Can(daveIdent.node.NodeID, ACLRead, photo.node.NodeID)
+	require.NoError(t, err)
+	require.False(t, can)
+
+	canRead := func(db DB, ident Identity) bool {
+		b, err := alice.ExportShared(ident.node.NodeID)
+		require.NoError(t, err)
+		require.NoError(t, db.Import(b))
+		_, err = db.GetLatest(photo.node.NodeID)
+		return err == nil
+	}
+	require.True(t, canRead(carol, carolIdent))
+
+	// New members of nested groups can decrypt the shared data.
+	require.NoError(t, kids.AddMember(alice, daveIdent.node.NodeID))
+	ck, err = alice.GetContentKey(ck.node.NodeID)
+	require.NoError(t, err)
+	require.True(t, ck.HasRecipient(daveIdent.node.NodeID))
+	require.True(t, canRead(dave, daveIdent))
+
+	// Removed members can't decrypt new versions of the shared data.
+	require.NoError(t, kids.RemoveMember(alice, carolIdent.node.NodeID))
+	raw, err := alice.getLatest(photo.node.NodeID)
+	require.NoError(t, err)
+	require.NotEqual(t, ck.node.NodeID, raw.KeyID)
+	newKey, err := alice.GetContentKey(raw.KeyID)
+	require.NoError(t, err)
+	require.False(t, newKey.HasRecipient(carolIdent.node.NodeID))
+	require.Equal(t, []NodeID{family.node.NodeID}, newKey.Groups)
+	b, err := alice.Export()
+	require.NoError(t, err)
+	require.NoError(t, carol.Import(b))
+	_, err = carol.GetLatest(photo.node.NodeID)
+	require.Error(t, err)
+	require.True(t, canRead(bob, bobIdent))
+	require.True(t, canRead(dave, daveIdent))
+	ck, err = alice.GetContentKey(ck.node.NodeID)
+	require.NoError(t, err)
+	require.Empty(t, ck.Groups)
+
+	// A removed member who can still read the data through a direct share keeps the key.
+	_, err = alice.Share(photos, daveIdent.node.NodeID, ACLRead)
+	require.NoError(t, err)
+	require.NoError(t, kids.RemoveMember(alice, daveIdent.node.NodeID))
+	raw, err = alice.getLatest(photo.node.NodeID)
+	require.NoError(t, err)
+	newKey, err = alice.GetContentKey(raw.KeyID)
+	require.NoError(t, err)
+	require.True(t, newKey.HasRecipient(daveIdent.node.NodeID))
+	require.True(t, canRead(dave, daveIdent))
+}
@@ -0,0 +1,257 @@
+package cymidb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HookStatus records the health of a hook on one device. It is linked to the Hook node, so the health of the
+// hooks of all devices can be seen on every device.
+type HookStatus struct {
+	Device NodeID
+	// LastError is the last error of the hook, and LastErrorAt its time.
+	LastError   string
+	LastErrorAt int64
+	// Failures counts the failures since the last success.
+	Failures int
+	// LastSuccess is stored at most once per hour while the hook is working, but the HookManager always has the
+	// latest one.
+	LastSuccess int64
+	// PausedUntil is set when the hook failed too often, and is not run until this time.
+	PausedUntil int64
+	node        Node
+}
+
+var NodeTypeHookStatus = NodeHook.SubType("blue.gasser/cybermind/hook-status")
+
+func NewHookStatusFromNode(n Node) (hs HookStatus, err error) {
+	err = n.DecodeNodeType(NodeTypeHookStatus, &hs)
+	if err != nil {
+		return hs, fmt.Errorf("couldn't decode hook status node: %v", err)
+	}
+	hs.node = n
+	return
+}
+
+// NewHookStatus returns an empty status for a hook on the device.
+func NewHookStatus(device NodeID) HookStatus {
+	return HookStatus{Device: device, node: NewNode(NodeTypeHookStatus)}
+}
+
+// GetNode is used to implement Noders.
+func (hs HookStatus) GetNode() (Node, error) {
+	err := hs.node.EncodeData(&hs)
+	return hs.node, err
+}
+
+// HookHealth is the health of a hook of the active device, as shown to the user.
+type HookHealth struct {
+	ID      NodeID
+	Name    string
+	Module  string
+	Running bool
+	Paused  bool
+	// Error is the last error of the hook, if it is failing.
+	Error  string
+	Status HookStatus
+}
+
+// Retries of failing hooks: a hook that failed to start is started again after a delay that doubles with every
+// failure. After too many failures in a row, the circuit breaker stops the hook and pauses it.
+var (
+	hookRetryMin     = time.Second
+	hookRetryMax     = 5 * time.Minute
+	hookMaxFailures  = 5
+	hookPause        = 10 * time.Minute
+	hookSaveInterval = time.Hour
+)
+
+// hookHealth is the health of a hook kept by the HookManager.
+type hookHealth struct {
+	status HookStatus
+	// retryAt is when a hook that is not running is started again.
+	retryAt time.Time
+	// startFailed is set if the last failure happened while starting the hook.
+	startFailed bool
+	saved       time.Time
+}
+
+// healthOf returns the health of the hook, reading its status from the DB the first time. The mutex must be held.
+func (hm *HookManager) healthOf(id NodeID) *hookHealth {
+	if hh, ok := hm.health[string(id)]; ok {
+		return hh
+	}
+	hh := &hookHealth{status: NewHookStatus(hm.db.Device.node.NodeID)}
+	children, _ := hm.db.GetChildrenNodes(id)
+	for _, c := range children {
+		if c.Type != NodeTypeHookStatus {
+			continue
+		}
+		if hs, err := NewHookStatusFromNode(c); err == nil && bytes.Compare(hs.Device, hh.status.Device) == 0 {
+			hh.status = hs
+		}
+	}
+	hm.health[string(id)] = hh
+	return hh
+}
+
+// Report records the result of some work of the hook, like delivering an event or polling a source. Modules call
+// it to report their failures and successes. Failures are stored in the HookStatus of the hook, and if the hook
+// fails too often, it is paused.
+func (hm *HookManager) Report(id NodeID, err error) {
+	hm.report(id, err, false, true)
+}
+
+// report records the result and returns the time to retry after a failure. Failures with retry unset, like
+// configuration errors, are not retried, as only a new version of the hook can fix them.
+func (hm *HookManager) report(id NodeID, err error, starting, retry bool) time.Time {
+	now := time.Now()
+	hm.mutex.Lock()
+	hh := hm.healthOf(id)
+	pause := false
+	if err != nil {
+		hm.errors[string(id)] = err
+		hh.status.LastError = err.Error()
+		hh.status.LastErrorAt = now.Unix()
+		hh.startFailed = starting
+		hh.retryAt = time.Time{}
+		if retry {
+			hh.status.Failures++
+			backoff := hookRetryMax
+			if hh.status.Failures < 20 {
+				backoff = hookRetryMin << uint(hh.status.Failures-1)
+			}
+			if backoff > hookRetryMax {
+				backoff = hookRetryMax
+			}
+			hh.retryAt = now.Add(backoff)
+			if hh.status.Failures >= hookMaxFailures {
+				hh.retryAt = now.Add(hookPause)
+				hh.status.PausedUntil = hh.retryAt.Unix()
+				pause = true
+			}
+		}
+		// Like successes, repeated failures are only stored from time to time.
+		if retry && !pause && hh.status.Failures > 1 && now.Sub(hh.saved) < hookSaveInterval {
+			retryAt := hh.retryAt
+			hm.mutex.Unlock()
+			return retryAt
+		}
+	} else {
+		delete(hm.errors, string(id))
+		recovered := hh.status.Failures > 0 || hh.status.PausedUntil != 0
+		hh.status.Failures = 0
+		hh.status.PausedUntil = 0
+		hh.status.LastSuccess = now.Unix()
+		hh.startFailed = false
+		hh.retryAt = time.Time{}
+		// Successes are only stored from time to time, to not create a new version for every event.
+		if !recovered && now.Sub(hh.saved) < hookSaveInterval {
+			hm.mutex.Unlock()
+			return time.Time{}
+		}
+	}
+	hh.saved = now
+	status, retryAt := hh.status, hh.retryAt
+	hm.mutex.Unlock()
+
+	if pause {
+		// Report may be called by the module itself, which cannot wait for its own stop.
+		go hm.stop(id)
+	}
+	if err := hm.saveStatus(id, status); err != nil {
+		hm.mutex.Lock()
+		hm.errors[string(id)] = err
+		hm.mutex.Unlock()
+	}
+	return retryAt
+}
+
+// saveStatus stores a new version of the status, and links it to the hook the first time.
+func (hm *HookManager) saveStatus(id NodeID, status HookStatus) error {
+	hm.statusMutex.Lock()
+	defer hm.statusMutex.Unlock()
+	hm.mutex.Lock()
+	stopped := hm.sub == nil
+	hm.mutex.Unlock()
+	if stopped {
+		return nil
+	}
+	_, err := hm.db.getLatest(status.node.NodeID)
+	first := err != nil
+	if err := hm.db.SaveNode(status); err != nil {
+		return fmt.Errorf("couldn't save hook status: %v", err)
+	}
+	if first {
+		if err := hm.db.AddLink(Node{NodeID: id}, status); err != nil {
+			return fmt.Errorf("couldn't link hook status: %v", err)
+		}
+	}
+	return nil
+}
+
+// paused returns true if the circuit breaker of the hook is open.
+func (hm *HookManager) paused(id NodeID) bool {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	hh, ok := hm.health[string(id)]
+	return ok && hh.status.PausedUntil > time.Now().Unix()
+}
+
+// retry starts the hooks whose retry is due.
+func (hm *HookManager) retry(now time.Time) {
+	hm.mutex.Lock()
+	var due []NodeID
+	for id, hh := range hm.health {
+		if hh.retryAt.IsZero() || now.Before(hh.retryAt) {
+			continue
+		}
+		hh.retryAt = time.Time{}
+		if _, running := hm.running[id]; !running {
+			due = append(due, NodeID(id))
+		}
+	}
+	hm.mutex.Unlock()
+	for _, id := range due {
+		if n, err := hm.db.GetLatest(id); err == nil {
+			hm.update(n)
+		}
+	}
+}
+
+// Health returns the health of all hooks of the active device, sorted by name.
+func (hm *HookManager) Health() (health []HookHealth, err error) {
+	nodes, err := hm.db.GetNodesByType(NodeHook)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get hooks: %v", err)
+	}
+	now := time.Now().Unix()
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	for _, n := range nodes {
+		h, err := NewHookFromNode(hm.db, n)
+		if err != nil || !h.ActiveOn(hm.db.Device.node.NodeID) {
+			continue
+		}
+		hh := HookHealth{ID: n.NodeID, Name: h.Name, Module: h.Module, Status: hm.healthOf(n.NodeID).status}
+		_, hh.Running = hm.running[string(n.NodeID)]
+		hh.Paused = hh.Status.PausedUntil > now
+		if err := hm.errors[string(n.NodeID)]; err != nil {
+			hh.Error = err.Error()
+		}
+		health = append(health, hh)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Name < health[j].Name
+	})
+	return health, nil
+}
+
+// reportHook passes the result of some work of a hook to the HookManager, if the DB has one.
+func (db DB) reportHook(id NodeID, err error) {
+	if db.hooks != nil {
+		db.hooks.Report(id, err)
+	}
+}
@@ -0,0 +1,205 @@
+package cymidb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyModule fails its runs while failing is set.
+type flakyModule struct {
+	failing *int32
+}
+
+func (fm flakyModule) Start() error { return nil }
+
+func (fm flakyModule) Stop() error { return nil }
+
+func (fm flakyModule) Run(stop <-chan struct{}) error {
+	if atomic.LoadInt32(fm.failing) != 0 {
+		return errors.New("source unreachable")
+	}
+	return nil
+}
+
+// setHealthTimings speeds up retries and pauses, and returns a function restoring them.
+func setHealthTimings() func() {
+	tick, min, max, pause := schedulerTick, hookRetryMin, hookMaxFailures, hookPause
+	restore := func() {
+		schedulerTick, hookRetryMin, hookMaxFailures, hookPause = tick, min, max, pause
+	}
+	schedulerTick = 5 * time.Millisecond
+	hookRetryMin = 10 * time.Millisecond
+	hookMaxFailures = 3
+	hookPause = 300 * time.Millisecond
+	return restore
+}
+
+// hookStatus returns the status stored in the DB for the hook.
+func hookStatus(t *testing.T, db DB, id NodeID) (hs HookStatus) {
+	children, err := db.GetChildrenNodes(id)
+	require.NoError(t, err)
+	for _, c := range children {
+		if c.Type == NodeTypeHookStatus {
+			hs, err = NewHookStatusFromNode(c)
+			require.NoError(t, err)
+		}
+	}
+	return
+}
+
+func TestHookManager_Health(t *testing.T) {
+	defer setHealthTimings()()
+	failing := int32(1)
+	RegisterHookModule("flaky", func(hdb HookDB) (HookModule, error) {
+		return flakyModule{failing: &failing}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	h := NewHook("mailbox", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "flaky"
+	h.Schedule = "@every 10ms"
+	require.NoError(t, db.SaveNode(h))
+	id := h.node.NodeID
+
+	// After too many failures the hook is paused, and the failures are stored.
+	var health []HookHealth
+	require.Eventually(t, func() bool {
+		health, err = db.Hooks().Health()
+		return err == nil && len(health) == 1 && health[0].Paused
+	}, 5*time.Second, 5*time.Millisecond)
+	require.Equal(t, "mailbox", health[0].Name)
+	require.Contains(t, health[0].Error, "source unreachable")
+	require.Eventually(t, func() bool { return len(db.Hooks().Running()) == 0 }, time.Second, 5*time.Millisecond)
+	status := hookStatus(t, db, id)
+	require.Equal(t, db.Device.node.NodeID, status.Device)
+	require.True(t, status.Failures >= 3)
+	require.Contains(t, status.LastError, "source unreachable")
+	require.NotZero(t, status.PausedUntil)
+	// Not every failure is stored.
+	versions, err := db.nodeVersions(status.node.NodeID)
+	require.NoError(t, err)
+	require.True(t, len(versions) < status.Failures)
+
+	// Once the pause is over, the hook is tried again, and a success resets the failures.
+	atomic.StoreInt32(&failing, 0)
+	require.Eventually(t, func() bool {
+		status = hookStatus(t, db, id)
+		return status.Failures == 0 && status.LastSuccess > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, status.PausedUntil)
+	require.Equal(t, 1, len(db.Hooks().Running()))
+	require.NoError(t, db.Hooks().Error(id))
+}
+
+func TestHookManager_Retry(t *testing.T) {
+	defer setHealthTimings()()
+	var attempts int32
+	RegisterHookModule("late", func(hdb HookDB) (HookModule, error) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return nil, errors.New("not ready")
+		}
+		return flakyModule{failing: new(int32)}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	h := NewHook("late", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "late"
+	require.NoError(t, db.SaveNode(h))
+
+	require.Eventually(t, func() bool { return len(db.Hooks().Running()) == 1 }, 5*time.Second,
+		5*time.Millisecond)
+	require.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	require.NoError(t, db.Hooks().Error(h.node.NodeID))
+	require.Equal(t, 0, hookStatus(t, db, h.node.NodeID).Failures)
+
+	api := NewAPI(db)
+	api.AllowHookRegistration("secret")
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/hooks", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var health []HookHealth
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	require.Equal(t, 1, len(health))
+	require.True(t, health[0].Running)
+}
+
+func TestHookManager_ConfigError(t *testing.T) {
+	defer setHealthTimings()()
+	failing := int32(0)
+	RegisterHookModule("flaky", func(hdb HookDB) (HookModule, error) {
+		return flakyModule{failing: &failing}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	h := NewHook("mailbox", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "flaky"
+	h.Schedule = "every minute"
+	require.NoError(t, db.SaveNode(h))
+	id := h.node.NodeID
+
+	// An invalid configuration is stored once, and not retried.
+	require.Eventually(t, func() bool { return db.Hooks().Error(id) != nil }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	status := hookStatus(t, db, id)
+	require.Contains(t, status.LastError, "every minute")
+	require.Zero(t, status.Failures)
+	versions, err := db.nodeVersions(status.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(versions))
+	require.Equal(t, 0, len(db.Hooks().Running()))
+
+	// A new version of the hook fixes it.
+	h.Schedule = "@every 10ms"
+	require.NoError(t, db.SaveNode(h))
+	require.Eventually(t, func() bool { return len(db.Hooks().Running()) == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, db.Hooks().Error(id))
+}
+
+// reportingModule reports its health while it is stopped.
+type reportingModule struct {
+	hdb HookDB
+}
+
+func (rm reportingModule) Start() error { return nil }
+
+func (rm reportingModule) Stop() error {
+	rm.hdb.Report(errors.New("stopped"))
+	return nil
+}
+
+func TestHookManager_ReportOnStop(t *testing.T) {
+	RegisterHookModule("reporting", func(hdb HookDB) (HookModule, error) {
+		return reportingModule{hdb: hdb}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	h := NewHook("reporting", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "reporting"
+	require.NoError(t, db.SaveNode(h))
+	require.Eventually(t, func() bool { return len(db.Hooks().Running()) == 1 }, time.Second, 5*time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "closing the DB hangs")
+	}
+}
@@ -0,0 +1,306 @@
+package cymidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// HookModule is the Go implementation of a hook. It is created by the factory registered for the Module of the
+// hook, and runs between Start and Stop.
+type HookModule interface {
+	// Start starts the hook. It must not block.
+	Start() error
+	// Stop stops the hook and waits until it is stopped.
+	Stop() error
+}
+
+// HookFactory creates the module for the hook of the HookDB. Modules only get the HookDB, so modules running in
+// the same process are limited to the HookScope of their hook, like external ones.
+type HookFactory func(hdb HookDB) (HookModule, error)
+
+var hookModules = struct {
+	sync.Mutex
+	factories map[string]HookFactory
+}{factories: map[string]HookFactory{}}
+
+// RegisterHookModule registers the factory for hooks with the given Module name.
+// It is usually called from the init function of the package implementing the hook.
+func RegisterHookModule(name string, factory HookFactory) {
+	hookModules.Lock()
+	defer hookModules.Unlock()
+	hookModules.factories[name] = factory
+}
+
+// HookModules returns the names of all registered hook modules.
+func HookModules() (names []string) {
+	hookModules.Lock()
+	defer hookModules.Unlock()
+	for name := range hookModules.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func hookFactory(name string) (HookFactory, error) {
+	hookModules.Lock()
+	defer hookModules.Unlock()
+	f, ok := hookModules.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("no hook module '%s' registered", name)
+	}
+	return f, nil
+}
+
+// HookManager runs the hooks that are linked to the active device. It is started when the DB is opened, and starts
+// and stops the hooks when they are added, removed or assigned to other devices.
+type HookManager struct {
+	db      DB
+	mutex   sync.Mutex
+	running map[string]runningHook
+	// errors holds the last error of every hook that couldn't be started or stopped.
+	errors map[string]error
+	sub    *Subscription
+	done   chan struct{}
+	// health holds the health of the hooks that failed or reported their state.
+	health      map[string]*hookHealth
+	statusMutex sync.Mutex
+	// scheduled holds the hooks with a schedule, run by the scheduler.
+	scheduled     map[string]*scheduledHook
+	schedulerStop chan struct{}
+	schedulerDone chan struct{}
+}
+
+type runningHook struct {
+	hook   Hook
+	module HookModule
+}
+
+// NewHookManager returns a manager for the hooks of the DB. It needs to be started.
+func NewHookManager(db DB) *HookManager {
+	return &HookManager{
+		db:        db,
+		running:   map[string]runningHook{},
+		errors:    map[string]error{},
+		scheduled: map[string]*scheduledHook{},
+		health:    map[string]*hookHealth{},
+	}
+}
+
+// Start starts all hooks of the active device and listens for changes of the hooks.
+func (hm *HookManager) Start() error {
+	hm.mutex.Lock()
+	if hm.sub != nil {
+		hm.mutex.Unlock()
+		return errors.New("hook manager is already running")
+	}
+	hm.sub = hm.db.Subscribe(NodeHook)
+	hm.done = make(chan struct{})
+	hm.schedulerStop = make(chan struct{})
+	hm.schedulerDone = make(chan struct{})
+	hm.mutex.Unlock()
+
+	nodes, err := hm.db.GetNodesByType(NodeHook)
+	if err != nil {
+		return fmt.Errorf("couldn't get hooks: %v", err)
+	}
+	for _, n := range nodes {
+		hm.update(n)
+	}
+	go hm.listen(hm.sub, hm.done)
+	go hm.scheduler(hm.schedulerStop, hm.schedulerDone)
+	return nil
+}
+
+// Stop stops all running hooks and doesn't listen for changes anymore.
+func (hm *HookManager) Stop() error {
+	hm.mutex.Lock()
+	sub, done := hm.sub, hm.done
+	hm.sub = nil
+	hm.mutex.Unlock()
+	if sub == nil {
+		return nil
+	}
+	sub.Close()
+	<-done
+	// Wait for a status being saved, later ones are dropped.
+	hm.statusMutex.Lock()
+	hm.statusMutex.Unlock()
+	close(hm.schedulerStop)
+	<-hm.schedulerDone
+	for _, h := range hm.Running() {
+		hm.unschedule(h.node.NodeID)
+	}
+
+	// The modules are stopped without holding the mutex, as they might report their health while stopping.
+	hm.mutex.Lock()
+	running := hm.running
+	hm.running = map[string]runningHook{}
+	hm.mutex.Unlock()
+	var errs []string
+	for _, rh := range running {
+		if err := rh.module.Stop(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rh.hook.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't stop hooks: %v", errs)
+	}
+	return nil
+}
+
+// Running returns the running hooks.
+func (hm *HookManager) Running() (hooks []Hook) {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	for _, rh := range hm.running {
+		hooks = append(hooks, rh.hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Name < hooks[j].Name
+	})
+	return
+}
+
+// Error returns the last error of the hook with the given id, or nil if it is working correctly.
+func (hm *HookManager) Error(id NodeID) error {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	return hm.errors[string(id)]
+}
+
+func (hm *HookManager) listen(sub *Subscription, done chan struct{}) {
+	defer close(done)
+	for e := range sub.C {
+		switch e.Kind {
+		case EventNodeSaved:
+			hm.update(e.Node)
+		case EventNodeDeleted:
+			hm.stop(e.Node.NodeID)
+		}
+	}
+}
+
+// update starts, stops or restarts the hook of the node, depending on whether it is active on this device.
+func (hm *HookManager) update(n Node) {
+	if n.Type != NodeHook {
+		return
+	}
+	h, err := NewHookFromNode(hm.db, n)
+	if err != nil {
+		hm.configError(n.NodeID, err)
+		return
+	}
+	hm.mutex.Lock()
+	rh, running := hm.running[string(n.NodeID)]
+	hm.mutex.Unlock()
+	if running && rh.hook.node.Version == h.node.Version {
+		return
+	}
+	if running {
+		hm.stop(n.NodeID)
+	}
+	if !h.ActiveOn(hm.db.Device.node.NodeID) {
+		return
+	}
+	// Hooks run with the rights of this device, so only trusted devices can set them up.
+	if err = hm.db.trustDevice(n.Signer); err != nil {
+		hm.configError(n.NodeID, fmt.Errorf("hook is not signed by a trusted device: %v", err))
+		return
+	}
+	hm.start(h)
+}
+
+// localModules run commands or send data out of the DB, so their settings are only trusted if the Hook node has
+// been signed by the active device itself.
+var localModules = map[string]bool{ModuleProcess: true, ModuleRemote: true}
+
+func (hm *HookManager) start(h Hook) {
+	if hm.paused(h.node.NodeID) {
+		return
+	}
+	factory, err := hookFactory(h.Module)
+	if err != nil {
+		hm.configError(h.node.NodeID, err)
+		return
+	}
+	if localModules[h.Module] && bytes.Compare(h.node.Signer, hm.db.Device.node.NodeID) != 0 {
+		hm.configError(h.node.NodeID, fmt.Errorf("hooks of module '%s' must be set up on this device", h.Module))
+		return
+	}
+	var schedule Schedule
+	if h.Schedule != "" {
+		if schedule, err = ParseSchedule(h.Schedule); err != nil {
+			hm.configError(h.node.NodeID, err)
+			return
+		}
+	}
+	if _, err = h.Settings(hm.db.Device.node.NodeID); err != nil {
+		hm.configError(h.node.NodeID, err)
+		return
+	}
+	module, err := factory(NewHookDB(hm.db, h))
+	if err == nil && h.Schedule != "" {
+		if _, ok := module.(HookRunner); !ok {
+			err = fmt.Errorf("module '%s' cannot be scheduled", h.Module)
+		}
+	}
+	if err == nil {
+		err = module.Start()
+	}
+	if err != nil {
+		hm.setError(h.node.NodeID, fmt.Errorf("couldn't start hook: %v", err))
+		return
+	}
+	hm.mutex.Lock()
+	hm.running[string(h.node.NodeID)] = runningHook{hook: h, module: module}
+	hh, failed := hm.health[string(h.node.NodeID)]
+	failed = failed && hh.startFailed
+	hm.mutex.Unlock()
+	if failed {
+		hm.report(h.node.NodeID, nil, true, true)
+	}
+	if h.Schedule != "" {
+		if err = hm.scheduleHook(h, module.(HookRunner), schedule); err != nil {
+			hm.setError(h.node.NodeID, err)
+		}
+	}
+}
+
+func (hm *HookManager) stop(id NodeID) {
+	hm.mutex.Lock()
+	rh, ok := hm.running[string(id)]
+	delete(hm.running, string(id))
+	hm.mutex.Unlock()
+	if !ok {
+		return
+	}
+	hm.unschedule(id)
+	if err := rh.module.Stop(); err != nil {
+		hm.setError(id, fmt.Errorf("couldn't stop hook: %v", err))
+	}
+}
+
+// setError records a failure to start or stop the hook, which is retried later.
+func (hm *HookManager) setError(id NodeID, err error) {
+	hm.report(id, err, true, true)
+}
+
+// configError records an error in the configuration of the hook. It is not retried, as the hook is started
+// again when its node is updated.
+func (hm *HookManager) configError(id NodeID, err error) {
+	hm.report(id, err, true, false)
+}
+
+// ActiveOn returns true if the hook is linked to the given device.
+func (h Hook) ActiveOn(device NodeID) bool {
+	for _, d := range h.Devices {
+		if bytes.Compare(d, device) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package cymidb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testModule counts how many instances of the hook are running.
+type testModule struct {
+	name    string
+	running *sync.Map
+}
+
+func (tm testModule) Start() error {
+	tm.running.Store(tm.name, true)
+	return nil
+}
+
+func (tm testModule) Stop() error {
+	tm.running.Delete(tm.name)
+	return nil
+}
+
+func TestHookManager(t *testing.T) {
+	running := &sync.Map{}
+	RegisterHookModule("test", func(hdb HookDB) (HookModule, error) {
+		return testModule{name: hdb.Hook().Name, running: running}, nil
+	})
+	require.Contains(t, HookModules(), "test")
+	isRunning := func(name string) bool {
+		_, ok := running.Load(name)
+		return ok
+	}
+
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+	db, err := CreateDBFile(f.Name(), "laptop", "")
+	require.NoError(t, err)
+	server, err := db.CreateDevice("server", "")
+	require.NoError(t, err)
+
+	local := NewHook("local", []NodeID{db.Device.node.NodeID}, nil)
+	local.Module = "test"
+	remote := NewHook("remote", []NodeID{server.node.NodeID}, nil)
+	remote.Module = "test"
+	missing := NewHook("missing", []NodeID{db.Device.node.NodeID}, nil)
+	missing.Module = "unknown"
+	require.NoError(t, db.SaveNode(local, remote, missing))
+	require.Eventually(t, func() bool { return isRunning("local") }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return db.Hooks().Error(missing.node.NodeID) != nil }, time.Second,
+		10*time.Millisecond)
+	require.False(t, isRunning("remote"))
+
+	// Reassigning the hooks stops and starts them.
+	local.Devices = []NodeID{server.node.NodeID}
+	remote.Devices = append(remote.Devices, db.Device.node.NodeID)
+	require.NoError(t, db.SaveNode(local, remote))
+	require.Eventually(t, func() bool { return !isRunning("local") && isRunning("remote") }, time.Second,
+		10*time.Millisecond)
+	require.NoError(t, db.Close())
+	require.False(t, isRunning("remote"))
+
+	// Hooks are started when the DB is opened, and stopped when they're deleted.
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	defer db.Close()
+	require.True(t, isRunning("remote"))
+	require.Equal(t, 1, len(db.Hooks().Running()))
+	require.NoError(t, db.DeleteNode(remote))
+	require.Eventually(t, func() bool { return !isRunning("remote") }, time.Second, 10*time.Millisecond)
+}
+
+func TestHookManager_ModuleDB(t *testing.T) {
+	hdbs := make(chan HookDB, 1)
+	RegisterHookModule("moduledb", func(hdb HookDB) (HookModule, error) {
+		hdbs <- hdb
+		return testModule{name: hdb.Hook().Name, running: &sync.Map{}}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	h := NewHook("moduledb", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "moduledb"
+	require.NoError(t, db.SaveNode(h))
+	// The module only gets the access of its hook, and can report its health.
+	hdb := <-hdbs
+	require.Equal(t, h.node.NodeID, hdb.Hook().node.NodeID)
+	require.Equal(t, ErrHookScope, hdb.SaveNode(NewFileData([]byte("outside"))))
+	hdb.Report(errors.New("broken"))
+	require.EqualError(t, db.Hooks().Error(h.node.NodeID), "broken")
+}
+
+func TestHookManager_Signer(t *testing.T) {
+	running := &sync.Map{}
+	RegisterHookModule("signer", func(hdb HookDB) (HookModule, error) {
+		return testModule{name: hdb.Hook().Name, running: running}, nil
+	})
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	phone, err := CreateDBFile(":memory:", "phone", "")
+	require.NoError(t, err)
+	defer phone.Close()
+	transfer := func() {
+		b, err := phone.Export()
+		require.NoError(t, err)
+		require.NoError(t, db.Import(b))
+	}
+
+	// A hook set up by an unknown device is not started.
+	h := NewHook("foreign", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "signer"
+	require.NoError(t, phone.SaveNode(h))
+	transfer()
+	require.Eventually(t, func() bool { return db.Hooks().Error(h.node.NodeID) != nil }, time.Second,
+		10*time.Millisecond)
+	_, ok := running.Load("foreign")
+	require.False(t, ok)
+
+	// Once the device is endorsed by the identity of this DB, its hooks are started.
+	ident, err := NewIdentity("me", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+	dn, err := db.GetLatest(phone.Device.node.NodeID)
+	require.NoError(t, err)
+	dev, err := NewDeviceFromNode(dn)
+	require.NoError(t, err)
+	_, err = ident.Endorse(db, dev)
+	require.NoError(t, err)
+	require.NoError(t, phone.SaveNode(h))
+	transfer()
+	require.Eventually(t, func() bool {
+		_, ok := running.Load("foreign")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,443 @@
+package cymidb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hooks can be executables that are started by the "process" hook module, configured in the settings of the Hook
+// node. As the command runs with the rights of the user, only Hook nodes signed by the active device are started.
+// The settings are:
+//
+//	"command" is the path of the executable
+//	"args" are its arguments, separated by spaces
+//
+// The process talks JSON-RPC 2.0 with one message per line on its stdin and stdout, and its stderr is passed on.
+// After starting the process, the DB sends a "handshake" request with a ProcessHandshake, and the process answers
+// with a ProcessHandshake, too. Then the process sends a "subscribe" request with a ProcessSubscribe, and receives
+// every event as an "event" request with an APIEvent. Answering an event request acknowledges the event, so events
+// that are not answered are sent again after a restart. Events answered with an error are sent again after a delay. At any time the process can send the following requests:
+//
+//	"createNode" with an APINode, returns the saved APINode
+//	"link" and "unlink" with an APILink
+//
+// The process is restarted with an increasing delay whenever it stops, until the hook is stopped.
+
+// ModuleProcess is the name of the hook module running executables.
+const ModuleProcess = "process"
+
+// ProcessProtocol is the version of the protocol between the DB and the processes.
+const ProcessProtocol = 1
+
+// Timings of the supervision of processes.
+var (
+	processMinBackoff = time.Second
+	processMaxBackoff = time.Minute
+	// processStable is how long a process must run for its restart delay to be reset.
+	processStable = time.Minute
+	// processTimeout is how long the DB waits for answers of the handshake and the stop.
+	processTimeout = 10 * time.Second
+)
+
+// ProcessHandshake is sent by both sides at the start.
+type ProcessHandshake struct {
+	Protocol int
+	// Hook is the hex encoded NodeID of the hook, only sent by the DB.
+	Hook string `json:",omitempty"`
+	Name string `json:",omitempty"`
+}
+
+// ProcessSubscribe asks for the events of the given types. If Types is empty, the types of the hook are used.
+type ProcessSubscribe struct {
+	Types []NodeType
+}
+
+// rpcMessage is a JSON-RPC 2.0 request or response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *uint64         `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Error codes of JSON-RPC 2.0.
+const (
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcInternalError  = -32603
+)
+
+// rpcConn sends and receives the messages of one process.
+type rpcConn struct {
+	sync.Mutex
+	w       io.Writer
+	nextID  uint64
+	pending map[uint64]chan rpcMessage
+	closed  chan struct{}
+}
+
+func newRPCConn(w io.Writer) *rpcConn {
+	return &rpcConn{w: w, pending: map[uint64]chan rpcMessage{}, closed: make(chan struct{})}
+}
+
+func (c *rpcConn) send(m rpcMessage) error {
+	m.JSONRPC = "2.0"
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	_, err = c.w.Write(append(buf, '\n'))
+	return err
+}
+
+// call sends a request and waits for the answer, which is decoded into result.
+func (c *rpcConn) call(method string, params, result interface{}, stop <-chan struct{}) error {
+	p, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	ch := make(chan rpcMessage, 1)
+	c.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+	}()
+	if err = c.send(rpcMessage{ID: &id, Method: method, Params: p}); err != nil {
+		return fmt.Errorf("couldn't send %s: %v", method, err)
+	}
+	select {
+	case m := <-ch:
+		if m.Error != nil {
+			return m.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, result)
+	case <-c.closed:
+		return errors.New("process stopped")
+	case <-stop:
+		return errors.New("call cancelled")
+	}
+}
+
+// read handles all messages from the process until it closes its output. Requests are passed to handle, whose
+// result or error is sent back.
+func (c *rpcConn) read(r io.Reader, handle func(method string, params json.RawMessage) (interface{}, error)) {
+	defer close(c.closed)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var m rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			continue
+		}
+		if m.Method == "" {
+			if m.ID != nil {
+				c.Lock()
+				ch := c.pending[*m.ID]
+				c.Unlock()
+				if ch != nil {
+					ch <- m
+				}
+			}
+			continue
+		}
+		result, err := handle(m.Method, m.Params)
+		if m.ID == nil {
+			continue
+		}
+		answer := rpcMessage{ID: m.ID}
+		if err != nil {
+			answer.Error = toRPCError(err)
+		} else if answer.Result, err = json.Marshal(result); err != nil {
+			answer.Error = toRPCError(err)
+		}
+		c.send(answer)
+	}
+}
+
+func toRPCError(err error) *rpcError {
+	if re, ok := err.(*rpcError); ok {
+		return re
+	}
+	return &rpcError{Code: rpcInternalError, Message: err.Error()}
+}
+
+// processHook supervises the process of a hook.
+type processHook struct {
+	hook    Hook
+	hdb     HookDB
+	command string
+	args    []string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func init() {
+	RegisterHookSettings(ModuleProcess, SettingsSchema{
+		{Name: "command", Kind: SettingPath, Description: "path of the executable", Required: true, PerDevice: true},
+		{Name: "args", Description: "arguments separated by spaces", PerDevice: true},
+	})
+	RegisterHookModule(ModuleProcess, func(hdb HookDB) (HookModule, error) {
+		s, err := hdb.Settings()
+		if err != nil {
+			return nil, err
+		}
+		return &processHook{hook: hdb.hook, hdb: hdb, command: s.String("command"),
+			args: strings.Fields(s.String("args"))}, nil
+	})
+}
+
+func (ph *processHook) Start() error {
+	ph.stop = make(chan struct{})
+	ph.done = make(chan struct{})
+	go ph.supervise()
+	return nil
+}
+
+func (ph *processHook) Stop() error {
+	close(ph.stop)
+	<-ph.done
+	return nil
+}
+
+// supervise runs the process and restarts it with an increasing delay until the hook is stopped, or paused by the
+// HookManager after too many failures.
+func (ph *processHook) supervise() {
+	defer close(ph.done)
+	backoff := processMinBackoff
+	for {
+		started := time.Now()
+		err := ph.run()
+		select {
+		case <-ph.stop:
+			return
+		default:
+		}
+		// Every stop is a failure, which is recorded in the status of the hook.
+		if err == nil {
+			err = errors.New("process stopped")
+		}
+		ph.hdb.Report(fmt.Errorf("process failed: %v", err))
+		if time.Since(started) > processStable {
+			backoff = processMinBackoff
+		}
+		select {
+		case <-ph.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > processMaxBackoff {
+			backoff = processMaxBackoff
+		}
+	}
+}
+
+// run starts the process and returns once it stopped, or kills it when the hook is stopped.
+func (ph *processHook) run() error {
+	cmd := exec.Command(ph.command, ph.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start process: %v", err)
+	}
+	conn := newRPCConn(stdin)
+	pc := &processConn{ph: ph, conn: conn, stop: make(chan struct{})}
+	go conn.read(stdout, pc.handle)
+
+	err = pc.handshake()
+	if err == nil {
+		ph.hdb.Report(nil)
+		select {
+		case <-conn.closed:
+			err = errors.New("process closed its output")
+		case <-ph.stop:
+		}
+	}
+	pc.close()
+	stdin.Close()
+	select {
+	case <-conn.closed:
+	case <-time.After(processTimeout):
+		cmd.Process.Kill()
+	}
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
+
+// processConn is one run of a process.
+type processConn struct {
+	ph   *processHook
+	conn *rpcConn
+	stop chan struct{}
+
+	mutex sync.Mutex
+	sub   *Subscription
+	done  chan struct{}
+}
+
+func (pc *processConn) handshake() error {
+	var answer ProcessHandshake
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(processTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	err := pc.conn.call("handshake", ProcessHandshake{Protocol: ProcessProtocol,
+		Hook: hex.EncodeToString(pc.ph.hook.node.NodeID), Name: pc.ph.hook.Name}, &answer, timeout)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+	if answer.Protocol != ProcessProtocol {
+		return fmt.Errorf("process uses protocol %d instead of %d", answer.Protocol, ProcessProtocol)
+	}
+	return nil
+}
+
+func (pc *processConn) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "subscribe":
+		var ps ProcessSubscribe
+		if err := json.Unmarshal(params, &ps); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		return nil, pc.subscribe(ps.Types)
+	case "createNode":
+		var an APINode
+		if err := json.Unmarshal(params, &an); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		n := NewNode(an.Type)
+		if len(an.NodeID) > 0 {
+			n.NodeID = an.NodeID
+		}
+		n.Data = an.Data
+		if err := pc.ph.hdb.SaveNode(n); err != nil {
+			return nil, err
+		}
+		saved, err := pc.ph.hdb.GetLatest(n.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		return newAPINode(saved), nil
+	case "link", "unlink":
+		var al APILink
+		if err := json.Unmarshal(params, &al); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		from, to := Node{NodeID: al.From}, Node{NodeID: al.To}
+		if method == "link" {
+			return nil, pc.ph.hdb.AddLink(from, to)
+		}
+		return nil, pc.ph.hdb.RemoveLink(from, to)
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "unknown method " + method}
+}
+
+// subscribe starts to send the events to the process. The types must be types of the hook.
+func (pc *processConn) subscribe(types []NodeType) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.sub != nil {
+		return errors.New("already subscribed")
+	}
+	select {
+	case <-pc.stop:
+		return errors.New("process is stopping")
+	default:
+	}
+	h := pc.ph.hook
+	for _, t := range types {
+		if !t.Matches(h.Types) {
+			return ErrHookScope
+		}
+	}
+	if len(types) > 0 {
+		h.Types = types
+	}
+	sub, err := h.SubscribeDurable()
+	if err != nil {
+		return err
+	}
+	pc.sub = sub
+	pc.done = make(chan struct{})
+	go pc.deliver()
+	return nil
+}
+
+// deliver sends the events one by one, and acknowledges them once the process answered. An event the process
+// answers with an error is recorded as a failure of the hook and sent again with an increasing delay.
+func (pc *processConn) deliver() {
+	defer close(pc.done)
+	for e := range pc.sub.C {
+		backoff := processMinBackoff
+		for {
+			err := pc.conn.call("event", NewAPIEvent(e), nil, pc.stop)
+			if err == nil {
+				pc.ph.hdb.Report(nil)
+				break
+			}
+			if _, ok := err.(*rpcError); !ok {
+				return
+			}
+			pc.ph.hdb.Report(fmt.Errorf("process refused event: %v", err))
+			select {
+			case <-pc.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > processMaxBackoff {
+				backoff = processMaxBackoff
+			}
+		}
+		if err := pc.sub.Ack(e.Seq); err != nil {
+			return
+		}
+	}
+}
+
+func (pc *processConn) close() {
+	close(pc.stop)
+	pc.mutex.Lock()
+	sub, done := pc.sub, pc.done
+	pc.mutex.Unlock()
+	if sub != nil {
+		sub.Close()
+		<-done
+	}
+}
@@ -0,0 +1,162 @@
+package cymidb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestProcessHelper is not a test, but the process of the hook when the test binary is started by a process hook
+// with the arguments "-- plugin <dir>". It answers every new FileData with a linked FileData containing "reply".
+// The first time it receives an event, it exits without answering, to test the restart, and the second time it
+// answers with an error, to test the redelivery.
+func TestProcessHelper(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 3 || args[1] != "plugin" {
+		return
+	}
+	crashed := filepath.Join(args[2], "crashed")
+	refused := filepath.Join(args[2], "refused")
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	var id uint64
+	call := func(method string, params, result interface{}) {
+		id++
+		p, _ := json.Marshal(params)
+		reqID := id
+		out.Encode(rpcMessage{JSONRPC: "2.0", ID: &reqID, Method: method, Params: p})
+		for in.Scan() {
+			var m rpcMessage
+			json.Unmarshal(in.Bytes(), &m)
+			if m.Method == "" && m.ID != nil && *m.ID == reqID {
+				if result != nil {
+					json.Unmarshal(m.Result, result)
+				}
+				return
+			}
+		}
+		os.Exit(1)
+	}
+
+	subscribed := false
+	for in.Scan() {
+		var m rpcMessage
+		json.Unmarshal(in.Bytes(), &m)
+		switch m.Method {
+		case "handshake":
+			res, _ := json.Marshal(ProcessHandshake{Protocol: ProcessProtocol})
+			out.Encode(rpcMessage{JSONRPC: "2.0", ID: m.ID, Result: res})
+			if !subscribed {
+				subscribed = true
+				call("subscribe", ProcessSubscribe{}, nil)
+			}
+		case "event":
+			if _, err := os.Stat(crashed); err != nil {
+				ioutil.WriteFile(crashed, nil, 0600)
+				os.Exit(1)
+			}
+			if _, err := os.Stat(refused); err != nil {
+				ioutil.WriteFile(refused, nil, 0600)
+				out.Encode(rpcMessage{JSONRPC: "2.0", ID: m.ID, Error: &rpcError{Code: rpcInternalError,
+					Message: "not ready"}})
+				continue
+			}
+			var e APIEvent
+			json.Unmarshal(m.Params, &e)
+			fd, err := NewFileDataFromNode(Node{NodeID: e.Node.NodeID, Type: e.Node.Type, Data: e.Node.Data})
+			if err == nil && e.Kind == EventNodeSaved && !bytes.Equal(fd.Data, []byte("reply")) {
+				reply, _ := NewFileData([]byte("reply")).GetNode()
+				var saved APINode
+				call("createNode", APINode{Type: reply.Type, Data: reply.Data}, &saved)
+				call("link", APILink{From: e.Node.NodeID, To: saved.NodeID}, nil)
+			}
+			out.Encode(rpcMessage{JSONRPC: "2.0", ID: m.ID, Result: json.RawMessage("null")})
+		}
+	}
+	os.Exit(0)
+}
+
+func TestHook_Process(t *testing.T) {
+	defer func(d time.Duration) { processMinBackoff = d }(processMinBackoff)
+	processMinBackoff = 10 * time.Millisecond
+	dir, err := ioutil.TempDir("", "process")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	// The question is already there when the hook starts, and is replayed from the timeline.
+	root := NewDir("Questions", 0777)
+	fd := NewFileData([]byte("question"))
+	require.NoError(t, db.SaveNode(root, fd))
+	require.NoError(t, db.AddLink(root, fd))
+	h := NewHook("reply", []NodeID{db.Device.node.NodeID}, []NodeType{NodeTypeFileData})
+	h.Module = ModuleProcess
+	h.Config = map[string]string{"command": os.Args[0], "args": "-test.run=TestProcessHelper -- plugin " + dir}
+	h.Scope = HookScope{Types: []NodeType{NodeTypeFileData}, Root: root.node.NodeID}
+	require.NoError(t, db.SaveNode(h))
+
+	require.Eventually(t, func() bool {
+		children, err := db.GetChildren(fd.node.NodeID)
+		return err == nil && len(children) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "crashed"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "refused"))
+	require.NoError(t, err)
+
+	// The event of the reply is answered, too, so nothing is pending anymore.
+	n, err := db.GetLatest(h.node.NodeID)
+	require.NoError(t, err)
+	h, err = NewHookFromNode(db, n)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		lag, err := h.Lag()
+		return err == nil && lag.Pending == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Hooks().Stop())
+	require.Nil(t, db.Hooks().Error(h.node.NodeID))
+}
+
+func TestHook_ProcessSigner(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	phone, err := CreateDBFile(":memory:", "phone", "")
+	require.NoError(t, err)
+	defer phone.Close()
+	ident, err := NewIdentity("me", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+	b, err := phone.ExportNodes(phone.Device.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, db.Import(b))
+	_, err = ident.Endorse(db, phone.Device)
+	require.NoError(t, err)
+
+	// Even a trusted device cannot set up commands to run on this device.
+	h := NewHook("remote command", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = ModuleProcess
+	h.Config = map[string]string{"command": "/bin/true"}
+	require.NoError(t, phone.SaveNode(h))
+	b, err = phone.ExportNodes(h.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, db.Import(b))
+	require.Eventually(t, func() bool {
+		err := db.Hooks().Error(h.node.NodeID)
+		return err != nil && strings.Contains(err.Error(), "must be set up on this device")
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, len(db.Hooks().Running()))
+}
@@ -0,0 +1,160 @@
+package cymidb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// HookRunner is implemented by the modules of hooks that run on a schedule.
+type HookRunner interface {
+	// Run does one run of the hook, like polling a mailbox. It should return early once stop is closed.
+	Run(stop <-chan struct{}) error
+}
+
+// HookRun holds the last and next run of a scheduled hook on this device. Like the HookCursor, it is local to this
+// copy of the DB.
+type HookRun struct {
+	gorm.Model
+	Hook NodeID
+	// Schedule is the schedule NextRun has been calculated with.
+	Schedule string
+	LastRun  time.Time
+	NextRun  time.Time
+}
+
+// schedulerTick is how often the scheduler looks for hooks to run.
+var schedulerTick = time.Second
+
+// scheduledHook is a hook waiting for its next run.
+type scheduledHook struct {
+	hook     Hook
+	runner   HookRunner
+	schedule Schedule
+	next     time.Time
+	// running is set during a run, so that runs never overlap.
+	running bool
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// RunState returns the last and next run of the hook on the active device.
+func (h Hook) RunState() (HookRun, error) {
+	return h.db.hookRun(h.node.NodeID)
+}
+
+func (db DB) hookRun(hook NodeID) (run HookRun, err error) {
+	err = db.gdb.Where(&HookRun{Hook: hook}).First(&run).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return run, fmt.Errorf("couldn't get hook run: %v", err)
+	}
+	run.Hook = hook
+	return run, nil
+}
+
+func (db DB) saveHookRun(run HookRun) error {
+	var stored HookRun
+	err := db.gdb.Where(&HookRun{Hook: run.Hook}).First(&stored).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("couldn't get hook run: %v", err)
+	}
+	run.Model = stored.Model
+	if err := db.gdb.Save(&run).Error; err != nil {
+		return fmt.Errorf("couldn't store hook run: %v", err)
+	}
+	return nil
+}
+
+// scheduleHook adds the hook to the scheduler. If the hook missed runs while the DB was closed, it runs once
+// right away.
+func (hm *HookManager) scheduleHook(h Hook, runner HookRunner, s Schedule) error {
+	run, err := hm.db.hookRun(h.node.NodeID)
+	if err != nil {
+		return err
+	}
+	if run.NextRun.IsZero() || run.Schedule != h.Schedule {
+		run.Schedule = h.Schedule
+		run.NextRun = s.Next(time.Now())
+		if err = hm.db.saveHookRun(run); err != nil {
+			return err
+		}
+	}
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	hm.scheduled[string(h.node.NodeID)] = &scheduledHook{hook: h, runner: runner, schedule: s, next: run.NextRun,
+		stop: make(chan struct{})}
+	return nil
+}
+
+// unschedule removes the hook from the scheduler, and waits for a running run to finish.
+func (hm *HookManager) unschedule(id NodeID) {
+	hm.mutex.Lock()
+	sh := hm.scheduled[string(id)]
+	delete(hm.scheduled, string(id))
+	hm.mutex.Unlock()
+	if sh != nil {
+		close(sh.stop)
+		sh.done.Wait()
+	}
+}
+
+// scheduler starts the runs of the hooks when they're due.
+func (hm *HookManager) scheduler(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			hm.runDue(now)
+			hm.retry(now)
+		}
+	}
+}
+
+func (hm *HookManager) runDue(now time.Time) {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	for id, sh := range hm.scheduled {
+		if sh.running || sh.next.IsZero() || now.Before(sh.next) {
+			continue
+		}
+		// Paused hooks are being stopped.
+		if hh, ok := hm.health[id]; ok && hh.status.PausedUntil > now.Unix() {
+			continue
+		}
+		sh.running = true
+		sh.done.Add(1)
+		go hm.run(sh)
+	}
+}
+
+// run does one run of the hook. The next run is calculated from the end of this run.
+func (hm *HookManager) run(sh *scheduledHook) {
+	defer sh.done.Done()
+	id := sh.hook.node.NodeID
+	started := time.Now()
+	err := sh.runner.Run(sh.stop)
+	next := sh.schedule.Next(time.Now())
+	if err != nil {
+		// Failed runs are retried with a backoff, unless the schedule runs the hook earlier anyway.
+		retry := hm.report(id, fmt.Errorf("run failed: %v", err), false, true)
+		if retry.Before(next) || next.IsZero() {
+			next = retry
+		}
+	} else {
+		hm.report(id, nil, false, true)
+	}
+	hm.mutex.Lock()
+	sh.running = false
+	sh.next = next
+	hm.mutex.Unlock()
+	err = hm.db.saveHookRun(HookRun{Hook: id, Schedule: sh.hook.Schedule, LastRun: started, NextRun: next})
+	if err != nil {
+		hm.setError(id, err)
+	}
+}
@@ -0,0 +1,100 @@
+package cymidb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runModule counts its runs and how many of them overlap.
+type runModule struct {
+	runs, active, overlaps *int32
+}
+
+func (rm runModule) Start() error { return nil }
+
+func (rm runModule) Stop() error { return nil }
+
+func (rm runModule) Run(stop <-chan struct{}) error {
+	if atomic.AddInt32(rm.active, 1) > 1 {
+		atomic.AddInt32(rm.overlaps, 1)
+	}
+	defer atomic.AddInt32(rm.active, -1)
+	select {
+	case <-time.After(30 * time.Millisecond):
+	case <-stop:
+	}
+	atomic.AddInt32(rm.runs, 1)
+	return nil
+}
+
+func TestHookManager_Schedule(t *testing.T) {
+	defer func(d time.Duration) { schedulerTick = d }(schedulerTick)
+	schedulerTick = 5 * time.Millisecond
+	var runs, active, overlaps int32
+	RegisterHookModule("scheduled", func(hdb HookDB) (HookModule, error) {
+		return runModule{runs: &runs, active: &active, overlaps: &overlaps}, nil
+	})
+	RegisterHookModule("unscheduled", func(hdb HookDB) (HookModule, error) {
+		return testModule{name: hdb.Hook().Name, running: &sync.Map{}}, nil
+	})
+
+	f, err := ioutil.TempFile("", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+	db, err := CreateDBFile(f.Name(), "laptop", "")
+	require.NoError(t, err)
+
+	h := NewHook("poller", []NodeID{db.Device.node.NodeID}, nil)
+	h.Module = "scheduled"
+	h.Schedule = "@every 10ms"
+	invalid := NewHook("invalid", []NodeID{db.Device.node.NodeID}, nil)
+	invalid.Module = "scheduled"
+	invalid.Schedule = "every minute"
+	events := NewHook("events", []NodeID{db.Device.node.NodeID}, nil)
+	events.Module = "unscheduled"
+	events.Schedule = "@hourly"
+	require.NoError(t, db.SaveNode(h, invalid, events))
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&overlaps))
+	require.Error(t, db.Hooks().Error(invalid.node.NodeID))
+	require.Error(t, db.Hooks().Error(events.node.NodeID))
+	require.NoError(t, db.Hooks().Error(h.node.NodeID))
+
+	n, err := db.GetLatest(h.node.NodeID)
+	require.NoError(t, err)
+	h, err = NewHookFromNode(db, n)
+	require.NoError(t, err)
+	run, err := h.RunState()
+	require.NoError(t, err)
+	require.False(t, run.LastRun.IsZero())
+	require.True(t, run.NextRun.After(run.LastRun))
+
+	// A changed schedule is used right away, and the state survives a restart.
+	h.Schedule = "@yearly"
+	require.NoError(t, db.SaveNode(h))
+	require.Eventually(t, func() bool {
+		run, err = h.RunState()
+		return err == nil && run.Schedule == "@yearly"
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Close())
+	stopped := atomic.LoadInt32(&runs)
+
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	defer db.Close()
+	h.db = db
+	reopened, err := h.RunState()
+	require.NoError(t, err)
+	require.Equal(t, run.NextRun.Unix(), reopened.NextRun.Unix())
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, atomic.LoadInt32(&runs))
+}
@@ -0,0 +1,220 @@
+package cymidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrHookScope is returned when a hook tries to write outside of what hooks are allowed to write.
+var ErrHookScope = errors.New("hook is not allowed to write this")
+
+// HookDB is the access to the DB given to hooks, both in-process and external ones. All writes are validated:
+// hooks can never write devices, identities, ACLs or hooks, cannot change the type of an existing node, and
+// cannot write outside of their HookScope.
+type HookDB struct {
+	db   DB
+	hook Hook
+}
+
+// NewHookDB returns the validating access to the DB for the hook.
+func NewHookDB(db DB, h Hook) HookDB {
+	return HookDB{db: db, hook: h}
+}
+
+// Hook returns the hook of this access.
+func (hdb HookDB) Hook() Hook {
+	return hdb.hook
+}
+
+// reservedType returns true for the types that are never written by hooks.
+func reservedType(t NodeType) bool {
+	switch t.Base() {
+	case NodeDev, NodeIdentity, NodeHook, NodeACL:
+		return true
+	}
+	return false
+}
+
+// HookNode records a node created by a hook, so the hook can link it into its subgraph. Like the timeline, it is
+// local to this copy of the DB.
+type HookNode struct {
+	gorm.Model
+	Hook   NodeID
+	NodeID NodeID
+}
+
+// canWrite returns true if the hook can write nodes of the type. Without types in the scope, nothing can be
+// written.
+func (hdb HookDB) canWrite(t NodeType) bool {
+	return len(hdb.hook.Scope.Types) > 0 && t.Matches(hdb.hook.Scope.Types)
+}
+
+// owns returns true if the node is in the subgraph owned by the hook. Without a root, the hook owns nothing.
+func (hdb HookDB) owns(id NodeID) (bool, error) {
+	if len(hdb.hook.Scope.Root) == 0 {
+		return false, nil
+	}
+	return hdb.db.inSubgraph(hdb.hook.Scope.Root, id)
+}
+
+// created returns true if the node has been created by the hook.
+func (hdb HookDB) created(id NodeID) bool {
+	var hn HookNode
+	return hdb.db.gdb.Where(&HookNode{Hook: hdb.hook.node.NodeID, NodeID: id}).First(&hn).Error == nil
+}
+
+// checkNode returns an error if the hook is not allowed to write the node.
+func (hdb HookDB) checkNode(n Node) error {
+	if reservedType(n.Type) || !hdb.canWrite(n.Type) {
+		return ErrHookScope
+	}
+	exist, err := hdb.db.getLatest(n.NodeID)
+	if err != nil {
+		// New nodes are only owned once they're linked.
+		return nil
+	}
+	if exist.Type != n.Type {
+		return errors.New("cannot change the type of a node")
+	}
+	if owned, err := hdb.owns(n.NodeID); err != nil || !owned {
+		return ErrHookScope
+	}
+	return nil
+}
+
+// checkLink returns an error if the hook is not allowed to add or remove the link between the two nodes.
+func (hdb HookDB) checkLink(from, to NodeID, add bool) error {
+	var types [2]NodeType
+	for i, id := range []NodeID{from, to} {
+		n, err := hdb.db.getLatest(id)
+		if err != nil {
+			return fmt.Errorf("unknown node %x: %v", id, err)
+		}
+		if reservedType(n.Type) {
+			return ErrHookScope
+		}
+		types[i] = n.Type
+	}
+	if len(hdb.hook.Scope.Links) > 0 {
+		allowed := false
+		for _, lk := range hdb.hook.Scope.Links {
+			if types[0].Matches([]NodeType{lk.From}) && types[1].Matches([]NodeType{lk.To}) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrHookScope
+		}
+	}
+	if owned, err := hdb.owns(from); err != nil || !owned {
+		return ErrHookScope
+	}
+	owned, err := hdb.owns(to)
+	if err != nil {
+		return ErrHookScope
+	}
+	// Only nodes created by the hook can be linked into the owned subgraph.
+	if !owned && (!add || !hdb.created(to)) {
+		return ErrHookScope
+	}
+	return nil
+}
+
+// SaveNode validates and saves the nodes. If any node is not valid, nothing is saved.
+func (hdb HookDB) SaveNode(ns ...Noder) error {
+	var created []NodeID
+	for _, n := range ns {
+		node, err := n.GetNode()
+		if err != nil {
+			return fmt.Errorf("couldn't get node: %v", err)
+		}
+		if err = hdb.checkNode(node); err != nil {
+			return err
+		}
+		if _, err = hdb.db.getLatest(node.NodeID); err != nil {
+			created = append(created, node.NodeID)
+		}
+	}
+	err := hdb.db.SaveNode(ns...)
+	// Even if the extractors failed, the nodes have been saved.
+	for _, id := range created {
+		if _, errLatest := hdb.db.getLatest(id); errLatest != nil {
+			continue
+		}
+		if errCreate := hdb.db.gdb.Create(&HookNode{Hook: hdb.hook.node.NodeID, NodeID: id}).Error; errCreate != nil {
+			return fmt.Errorf("couldn't record created node: %v", errCreate)
+		}
+	}
+	return err
+}
+
+// AddLink validates and adds the link.
+func (hdb HookDB) AddLink(from, to Noder) error {
+	fromNode, toNode, err := linkNodes(from, to)
+	if err != nil {
+		return err
+	}
+	if err = hdb.checkLink(fromNode.NodeID, toNode.NodeID, true); err != nil {
+		return err
+	}
+	return hdb.db.AddLink(from, to)
+}
+
+// RemoveLink validates and removes the link.
+func (hdb HookDB) RemoveLink(from, to Noder) error {
+	fromNode, toNode, err := linkNodes(from, to)
+	if err != nil {
+		return err
+	}
+	if err = hdb.checkLink(fromNode.NodeID, toNode.NodeID, false); err != nil {
+		return err
+	}
+	return hdb.db.RemoveLink(from, to)
+}
+
+// Settings returns the settings of the hook on the active device.
+func (hdb HookDB) Settings() (Settings, error) {
+	return hdb.hook.Settings(hdb.db.Device.node.NodeID)
+}
+
+// Report records the result of some work of the hook, like delivering an event, in the health of the hook.
+func (hdb HookDB) Report(err error) {
+	hdb.db.reportHook(hdb.hook.node.NodeID, err)
+}
+
+// GetLatest returns the latest version of the node.
+func (hdb HookDB) GetLatest(id NodeID) (Node, error) {
+	return hdb.db.GetLatest(id)
+}
+
+// GetChildren returns the ids of the children of the node.
+func (hdb HookDB) GetChildren(id NodeID) ([]NodeID, error) {
+	return hdb.db.GetChildren(id)
+}
+
+// GetAncestors returns the ids of the ancestors of the node.
+func (hdb HookDB) GetAncestors(id NodeID) ([]NodeID, error) {
+	return hdb.db.GetAncestors(id)
+}
+
+// GetNodesByType returns the latest version of all nodes of the type.
+func (hdb HookDB) GetNodesByType(t NodeType) ([]Node, error) {
+	return hdb.db.GetNodesByType(t)
+}
+
+func linkNodes(from, to Noder) (fromNode, toNode Node, err error) {
+	if fromNode, err = from.GetNode(); err != nil {
+		return fromNode, toNode, fmt.Errorf("couldn't get node 'from': %v", err)
+	}
+	if toNode, err = to.GetNode(); err != nil {
+		return fromNode, toNode, fmt.Errorf("couldn't get node 'to': %v", err)
+	}
+	if bytes.Compare(fromNode.NodeID, toNode.NodeID) == 0 {
+		return fromNode, toNode, errors.New("cannot link a node to itself")
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookDB(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	root := NewDir("Index", 0777)
+	require.NoError(t, db.SaveNode(root))
+	h := NewHook("indexer", []NodeID{db.Device.node.NodeID}, []NodeType{NodeBlob, NodeTag})
+	h.Scope = HookScope{Types: []NodeType{NodeBlob, NodeTag}, Root: root.node.NodeID}
+	require.NoError(t, db.SaveNode(h))
+	hdb := NewHookDB(db, h)
+
+	fd := NewFileData([]byte("some text"))
+	require.NoError(t, hdb.SaveNode(fd))
+	tag := NewNode(NodeTag)
+	require.NoError(t, hdb.SaveNode(tag))
+	require.NoError(t, hdb.AddLink(root, tag))
+	require.NoError(t, hdb.AddLink(tag, fd))
+	children, err := hdb.GetChildren(tag.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(children))
+	require.NoError(t, hdb.RemoveLink(tag, fd))
+
+	// Without a scope, a hook cannot write anything.
+	unscoped := NewHookDB(db, NewHook("unscoped", nil, []NodeType{NodeBlob}))
+	require.Equal(t, ErrHookScope, unscoped.SaveNode(NewFileData([]byte("text"))))
+	require.Equal(t, ErrHookScope, unscoped.AddLink(tag, fd))
+
+	// Types outside of the hook, and reserved types, are refused.
+	require.Equal(t, ErrHookScope, hdb.SaveNode(NewNode(NodeLink)))
+	require.Equal(t, ErrHookScope, hdb.SaveNode(NewACL(db.Device.node.NodeID, ACLRead)))
+	require.Equal(t, ErrHookScope, NewHookDB(db, NewHook("all", nil, nil)).SaveNode(NewHook("other", nil, nil)))
+	require.Equal(t, ErrHookScope, hdb.AddLink(h, fd))
+
+	// Existing nodes keep their type, and nodes must exist to be linked.
+	changed := tag
+	changed.Type = NodeTypeFileData
+	require.Error(t, hdb.SaveNode(changed))
+	require.Error(t, hdb.AddLink(tag, NewNode(NodeTag)))
+	require.Error(t, hdb.AddLink(tag, tag))
+}
+
+func TestHookDB_Scope(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	files := NewDir("Files", 0777)
+	mails := NewDir("Mails", 0777)
+	inbox := NewDir("Inbox", 0777)
+	report := NewFileData([]byte("report"))
+	require.NoError(t, db.SaveNode(files, mails, inbox, report))
+	require.NoError(t, db.AddLink(files, report))
+	require.NoError(t, db.AddLink(mails, inbox))
+
+	h := NewHook("mail", []NodeID{db.Device.node.NodeID}, []NodeType{NodeBlob})
+	h.Scope = HookScope{
+		Types: []NodeType{NodeTypeDir, NodeTypeFileData},
+		Links: []LinkKind{{From: NodeTypeDir, To: NodeTypeFileData}},
+		Root:  mails.node.NodeID,
+	}
+	require.NoError(t, db.SaveNode(h))
+	hdb := NewHookDB(db, h)
+
+	// New nodes can be written and linked into the owned subgraph, and modified afterwards.
+	mail := NewFileData([]byte("mail"))
+	require.NoError(t, hdb.SaveNode(mail))
+	require.NoError(t, hdb.AddLink(inbox, mail))
+	mail.Data = []byte("mail, edited")
+	require.NoError(t, hdb.SaveNode(mail))
+	inbox.Name = "Incoming"
+	require.NoError(t, hdb.SaveNode(inbox))
+
+	// Nodes outside of the subgraph, or of other types, cannot be written or linked.
+	report.Data = []byte("corrupted")
+	require.Equal(t, ErrHookScope, hdb.SaveNode(report))
+	files.Name = "Corrupted"
+	require.Equal(t, ErrHookScope, hdb.SaveNode(files))
+	require.Equal(t, ErrHookScope, hdb.SaveNode(NewNode(NodeTag)))
+	require.Equal(t, ErrHookScope, hdb.AddLink(inbox, report))
+	require.Equal(t, ErrHookScope, hdb.RemoveLink(files, report))
+	require.Equal(t, ErrHookScope, hdb.AddLink(files, mail))
+	sub := NewDir("Archive", 0777)
+	require.NoError(t, hdb.SaveNode(sub))
+	require.Equal(t, ErrHookScope, hdb.AddLink(inbox, sub))
+
+	// Existing top-level nodes cannot be adopted into the subgraph.
+	top := NewDir("Photos", 0777)
+	require.NoError(t, db.SaveNode(top))
+	require.Equal(t, ErrHookScope, hdb.AddLink(inbox, files))
+	require.Equal(t, ErrHookScope, hdb.AddLink(inbox, top))
+
+	// Nodes created by the hook can be linked in again after they've been removed.
+	require.NoError(t, hdb.RemoveLink(inbox, mail))
+	require.NoError(t, hdb.AddLink(inbox, mail))
+}
@@ -13,8 +13,38 @@ type Hook struct {
 	Devices []NodeID
 	// Types is an array of types which will create events when they change
 	Types []NodeType
-	node  Node
-	db    DB
+	// Module is the name of the registered HookModule implementing this hook
+	Module string
+	// Config holds the settings of the module for all devices, like the URL of a webhook
+	Config map[string]string
+	// DeviceConfig holds the settings that are different on some devices, indexed by the hex encoded device ID
+	DeviceConfig map[string]map[string]string
+	// Scope limits the nodes and links the hook can write
+	Scope HookScope
+	// Schedule is the cron expression of the runs of the hook, or empty for hooks only reacting to events
+	Schedule string
+	node     Node
+	db       DB
+}
+
+// HookScope describes what a hook is allowed to write. It is set up by the user, never by the hook itself.
+// A hook without Types or Root cannot write anything.
+type HookScope struct {
+	// Types are the types of the nodes the hook can create and modify.
+	Types []NodeType
+	// Links are the kinds of links the hook can add and remove. If it is empty, all kinds of links are allowed
+	// inside the subgraph of the hook.
+	Links []LinkKind
+	// Root is the node whose subgraph is owned by the hook. The hook can only modify nodes in the subgraph, and
+	// only link nodes it created itself into it.
+	Root NodeID
+}
+
+// LinkKind is a link from a node of type From to a node of type To. Like everywhere else, a base type also
+// matches all its subtypes.
+type LinkKind struct {
+	From NodeType
+	To   NodeType
 }
 
 func NewHookFromNode(db DB, n Node) (h Hook, err error) {
@@ -2,15 +2,40 @@ package cymidb
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
 )
 
 // Identity holds all information for an identity.
 type Identity struct {
 	Alias  string
 	Emails []string
+	// PublicKey is the current key of the identity, used to sign the endorsements of its devices.
+	PublicKey ed25519.PublicKey
+	// RetiredKeys holds all previous public keys of this identity.
+	RetiredKeys []RetiredKey
+	// BoxKey is used to wrap content keys for this identity.
+	BoxKey []byte
 	node   Node
+	// privateKey and boxKey are only available for identities that have been created in this DB.
+	privateKey ed25519.PrivateKey
+	boxKey     *[32]byte
+}
+
+// RetiredKey is a public key that has been replaced by Identity.Rotate.
+type RetiredKey struct {
+	PublicKey ed25519.PublicKey
+	// Retired is the unix time in seconds when the key has been replaced.
+	Retired int64
+	// Signature is the signature of the key that replaced this key, done with this key.
+	Signature []byte
 }
 
 // NewIdentityFromNode takes a node and returns an Identity. If the node is not of the correct type,
@@ -28,6 +53,16 @@ func NewIdentity(a string, emails []string) (ident Identity, err error) {
 	ident.node = NewNode(NodeIdentity)
 	ident.Alias = a
 	ident.Emails = emails
+	ident.PublicKey, ident.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return ident, fmt.Errorf("couldn't create keypair: %v", err)
+	}
+	boxPub, boxPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return ident, fmt.Errorf("couldn't create box keypair: %v", err)
+	}
+	ident.BoxKey = boxPub[:]
+	ident.boxKey = boxPriv
 	return
 }
 
@@ -40,6 +75,192 @@ func (ident Identity) GetNode() (Node, error) {
 	return ident.node, nil
 }
 
+func (ident Identity) localKey() ed25519.PrivateKey {
+	return ident.privateKey
+}
+
+func (ident Identity) localBoxKey() *[32]byte {
+	return ident.boxKey
+}
+
+// signer returns the private key of the identity, either from the identity itself, or from the DB.
+func (ident Identity) signer(db DB) (ed25519.PrivateKey, error) {
+	if ident.privateKey != nil {
+		return ident.privateKey, nil
+	}
+	priv, err := db.loadKey(ident.node.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("identity has no private key in this DB: %v", err)
+	}
+	if bytes.Compare(priv.Public().(ed25519.PublicKey), ident.PublicKey) != 0 {
+		return nil, errors.New("private key in DB doesn't match identity")
+	}
+	return priv, nil
+}
+
+// Endorse creates a signed certificate for the given device and links it between the identity and the device.
+func (ident Identity) Endorse(db DB, dev Device) (e Endorsement, err error) {
+	priv, err := ident.signer(db)
+	if err != nil {
+		return e, err
+	}
+	e = NewEndorsement(ident, dev)
+	e.sign(priv)
+	if err = db.SaveNode(e); err != nil {
+		return e, fmt.Errorf("couldn't save endorsement: %v", err)
+	}
+	if err = db.AddLink(ident, e); err != nil {
+		return e, fmt.Errorf("couldn't link identity: %v", err)
+	}
+	if err = db.AddLink(e, dev); err != nil {
+		return e, fmt.Errorf("couldn't link device: %v", err)
+	}
+	return
+}
+
+// Revoke marks all endorsements of the given device as revoked. Nodes signed by the device after the revocation
+// will be rejected. Unless the active device revokes itself, it must be endorsed by the identity, as it signs the
+// current version of the identity again.
+func (ident Identity) Revoke(db DB, dev NodeID) error {
+	priv, err := ident.signer(db)
+	if err != nil {
+		return err
+	}
+	endorsements, err := ident.GetEndorsements(db)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, e := range endorsements {
+		if bytes.Compare(e.Device, dev) != 0 {
+			continue
+		}
+		found = true
+		if e.Revoked == 0 {
+			e.Revoked = time.Now().Unix()
+		}
+		e.sign(priv)
+		if err = db.SaveNode(e); err != nil {
+			return fmt.Errorf("couldn't save revocation: %v", err)
+		}
+	}
+	if !found {
+		return errors.New("device is not endorsed by this identity")
+	}
+	if bytes.Compare(dev, db.Device.node.NodeID) == 0 {
+		return nil
+	}
+	// The versions of the identity signed by the revoked device are not used to verify its revocation.
+	idents, err := db.validIdentities(ident.node.NodeID, nil, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	if len(idents) == 0 {
+		return errors.New("no valid version of the identity")
+	}
+	if err = db.SaveNode(idents[0]); err != nil {
+		return fmt.Errorf("couldn't save identity: %v", err)
+	}
+	return nil
+}
+
+// Rotate replaces the key of the identity with a new key and signs all endorsements again with the new key.
+// The new key is signed with the old key, so the keys of the identity form a chain that starts with its first key.
+// Endorsements signed with a retired key are not valid anymore.
+func (ident *Identity) Rotate(db DB) error {
+	endorsements, err := ident.GetEndorsements(db)
+	if err != nil {
+		return err
+	}
+	old, err := ident.signer(db)
+	if err != nil {
+		return err
+	}
+	rk := RetiredKey{PublicKey: ident.PublicKey, Retired: time.Now().Unix()}
+	ident.PublicKey, ident.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("couldn't create keypair: %v", err)
+	}
+	rk.Signature = ed25519.Sign(old, rotationHash(ident.node.NodeID, ident.PublicKey, rk.Retired))
+	ident.RetiredKeys = append(ident.RetiredKeys, rk)
+	if err = db.SaveNode(ident); err != nil {
+		return fmt.Errorf("couldn't save identity: %v", err)
+	}
+	for _, e := range endorsements {
+		e.sign(ident.privateKey)
+		if err = db.SaveNode(e); err != nil {
+			return fmt.Errorf("couldn't save endorsement: %v", err)
+		}
+	}
+	return nil
+}
+
+func rotationHash(id NodeID, next ed25519.PublicKey, retired int64) []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{id, next} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	_ = binary.Write(h, binary.LittleEndian, retired)
+	return h.Sum(nil)
+}
+
+// verifyKeys checks that the keys of the identity start with the first key of the first version stored in this
+// DB, and that every key has been signed by the key it replaced.
+func (db DB) verifyKeys(ident Identity) error {
+	versions, err := db.nodeVersions(ident.node.NodeID)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errors.New("identity is not stored in this DB")
+	}
+	first, err := NewIdentityFromNode(versions[0])
+	if err != nil {
+		return err
+	}
+	genesis := first.PublicKey
+	if len(first.RetiredKeys) > 0 {
+		genesis = first.RetiredKeys[0].PublicKey
+	}
+	current := ident.PublicKey
+	if len(ident.RetiredKeys) > 0 {
+		current = ident.RetiredKeys[0].PublicKey
+	}
+	if bytes.Compare(genesis, current) != 0 {
+		return errors.New("identity doesn't start with its first key")
+	}
+	for i, rk := range ident.RetiredKeys {
+		next := ident.PublicKey
+		if i+1 < len(ident.RetiredKeys) {
+			next = ident.RetiredKeys[i+1].PublicKey
+		}
+		if len(rk.PublicKey) != ed25519.PublicKeySize ||
+			!ed25519.Verify(rk.PublicKey, rotationHash(ident.node.NodeID, next, rk.Retired), rk.Signature) {
+			return errors.New("key of identity is not signed by the previous key")
+		}
+	}
+	return nil
+}
+
+// GetEndorsements returns all valid endorsements issued by this identity.
+func (ident Identity) GetEndorsements(db DB) (es []Endorsement, err error) {
+	children, err := db.GetChildren(ident.node.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get children: %v", err)
+	}
+	for _, child := range children {
+		e, err := db.getEndorsement(child, map[string]bool{})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get endorsement: %v", err)
+		}
+		if e != nil && bytes.Compare(e.Identity, ident.node.NodeID) == 0 {
+			es = append(es, *e)
+		}
+	}
+	return
+}
+
 // CompareTo returns nil if the two identities are equal, or an error otherwise.
 func (ident Identity) Equals(other Identity) error {
 	if bytes.Compare(ident.node.NodeID, other.node.NodeID) != 0 {
@@ -59,5 +280,8 @@ func (ident Identity) Equals(other Identity) error {
 			return errors.New("different email")
 		}
 	}
+	if bytes.Compare(ident.PublicKey, other.PublicKey) != 0 {
+		return errors.New("not the same public key")
+	}
 	return nil
 }
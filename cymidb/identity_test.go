@@ -1,8 +1,12 @@
 package cymidb
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
 	"testing"
 
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,3 +31,136 @@ func TestNewIdentity(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, ident.Equals(ident2))
 }
+
+func TestIdentity_Endorse(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	ident, err := NewIdentity("test", []string{"one@test.com"})
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(ident))
+	_, err = ident.Endorse(db, db.Device)
+	require.NoError(t, err)
+
+	// The phone writes its own nodes in the same DB.
+	phone := NewDevice("phone")
+	phoneDB := db
+	phoneDB.Device = phone
+	require.NoError(t, phoneDB.SaveNode(phone))
+
+	e, err := ident.Endorse(db, phone)
+	require.NoError(t, err)
+	require.NoError(t, e.Verify(ident))
+	es, err := db.GetEndorsements(phone.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(es))
+	require.Equal(t, int64(0), es[0].Revoked)
+
+	before := NewNode(NodeBlob)
+	require.NoError(t, phoneDB.SaveNode(before))
+	_, err = db.GetLatest(before.NodeID)
+	require.NoError(t, err)
+
+	// Revoking the phone rejects all later writes, even if the phone tries to write the old endorsement again.
+	require.NoError(t, ident.Revoke(db, phone.node.NodeID))
+	require.NoError(t, phoneDB.SaveNode(e))
+	after := NewNode(NodeTag)
+	require.NoError(t, phoneDB.SaveNode(after))
+	_, err = db.GetLatest(before.NodeID)
+	require.NoError(t, err)
+	_, err = db.GetLatest(after.NodeID)
+	require.Error(t, err)
+
+	// Nodes are compared with the signed time of the revocation, not with the time they have been stored, so a
+	// node signed before the revocation is still valid when it arrives later.
+	late := NewNode(NodeHook)
+	late.sign(phone.node.NodeID, phone.privateKey)
+	late.SignedAt = before.SignedAt + 1
+	late.Signature = ed25519.Sign(phone.privateKey, late.hash())
+	_, err = phoneDB.saveVersion(late)
+	require.NoError(t, err)
+	_, err = db.GetLatest(late.NodeID)
+	require.NoError(t, err)
+
+	// The revocation is imported before the nodes are verified, so the nodes of the phone signed after it are
+	// rejected by other DBs, too.
+	other, err := CreateDBFile(":memory:", "other", "")
+	require.NoError(t, err)
+	defer other.Close()
+	b, err := db.Export()
+	require.NoError(t, err)
+	nodes := b.Nodes[:0]
+	for _, n := range b.Nodes {
+		if n.Type != NodeTypeEndorsement || bytes.Compare(n.Signer, phone.node.NodeID) != 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	b.Nodes = nodes
+	err = other.Import(b)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("%x", after.NodeID))
+
+	// Rotating the key keeps the endorsements, but the old key is not valid anymore.
+	in, err := db.GetLatest(ident.node.NodeID)
+	require.NoError(t, err)
+	ident, err = NewIdentityFromNode(in)
+	require.NoError(t, err)
+	oldKey := ident.PublicKey
+	require.NoError(t, ident.Rotate(db))
+	require.Equal(t, 1, len(ident.RetiredKeys))
+	require.Equal(t, oldKey, ident.RetiredKeys[0].PublicKey)
+	require.Error(t, e.Verify(ident))
+	es, err = db.GetEndorsements(phone.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(es))
+	require.NotEqual(t, int64(0), es[0].Revoked)
+	require.NoError(t, es[0].Verify(ident))
+	_, err = db.GetLatest(before.NodeID)
+	require.NoError(t, err)
+	_, err = db.GetLatest(after.NodeID)
+	require.Error(t, err)
+
+	// The revoked phone can neither change the identity, nor the type of its endorsement.
+	in, err = db.GetLatest(ident.node.NodeID)
+	require.NoError(t, err)
+	require.Error(t, phoneDB.SaveNode(ident))
+	bogus := in
+	bogus.Model = gorm.Model{}
+	bogus.Version++
+	bogus.sign(phone.node.NodeID, phone.privateKey)
+	_, err = phoneDB.saveVersion(bogus)
+	require.NoError(t, err)
+	require.Error(t, db.VerifyNode(bogus))
+	tag, err := db.getLatest(e.node.NodeID)
+	require.NoError(t, err)
+	tag.Type = NodeTag
+	require.Error(t, phoneDB.SaveNode(tag))
+	tag.Model = gorm.Model{}
+	tag.Version++
+	tag.sign(phone.node.NodeID, phone.privateKey)
+	_, err = phoneDB.saveVersion(tag)
+	require.NoError(t, err)
+	require.Error(t, db.VerifyNode(tag))
+	es, err = db.GetEndorsements(phone.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(es))
+	require.NotEqual(t, int64(0), es[0].Revoked)
+
+	// A new key that is not signed by the previous key is ignored, and the revocation is kept.
+	forged, err := NewIdentityFromNode(in)
+	require.NoError(t, err)
+	var forgedKey ed25519.PrivateKey
+	forged.PublicKey, forgedKey, err = ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(forged))
+	es[0].Revoked = 0
+	es[0].sign(forgedKey)
+	require.NoError(t, db.SaveNode(es[0]))
+	es, err = db.GetEndorsements(phone.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(es))
+	require.NotEqual(t, int64(0), es[0].Revoked)
+	_, err = db.GetLatest(after.NodeID)
+	require.Error(t, err)
+}
@@ -0,0 +1,243 @@
+package cymidb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// LocalKey holds a private key of a node created in this DB. It is stored in its own table, so that it is never part
+// of the nodes that are synchronised with other devices. The key is encrypted with the keystore key, which is
+// derived from the passphrase of the DB. A DB without passphrase uses a random keystore key stored in a key file
+// next to the DB file, so that a copy of the DB file alone doesn't give access to the private keys.
+type LocalKey struct {
+	gorm.Model
+	NodeID NodeID
+	Kind   string
+	Key    []byte
+}
+
+const (
+	// keySign is an ed25519 private key used to sign nodes or endorsements.
+	keySign = "sign"
+	// keyBox is a curve25519 private key used to unwrap content keys.
+	keyBox = "box"
+)
+
+const (
+	// settingKeystoreSalt is the salt used to derive the keystore key from the passphrase.
+	settingKeystoreSalt = "keystore_salt"
+	// settingKeystoreCheck holds a known value encrypted with the keystore key, to detect a wrong passphrase.
+	settingKeystoreCheck = "keystore_check"
+)
+
+var keystoreCheck = []byte("cymidb keystore")
+
+// keyHolder is implemented by nodes that can hold private keys. When such a node is saved,
+// its private keys are stored in the LocalKey table.
+type keyHolder interface {
+	localKey() ed25519.PrivateKey
+	localBoxKey() *[32]byte
+}
+
+// keystore holds the key used to encrypt the LocalKeys.
+type keystore struct {
+	key [32]byte
+}
+
+// deriveKeystoreKey returns the key for the passphrase.
+func deriveKeystoreKey(passphrase string, salt []byte) (key [32]byte, err error) {
+	buf, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return key, fmt.Errorf("couldn't derive key: %v", err)
+	}
+	copy(key[:], buf)
+	return
+}
+
+// keyFile returns the file holding the keystore key of a DB without passphrase, or "" for a DB in memory, whose
+// key is only kept in memory.
+func keyFile(file string) string {
+	if file == "" || strings.Contains(file, ":memory:") || strings.Contains(file, "mode=memory") {
+		return ""
+	}
+	return file + ".key"
+}
+
+// createKeystore sets up a new keystore protected by the passphrase. Without a passphrase, a random key is
+// stored in the key file of the DB.
+func (db *DB) createKeystore(file, passphrase string) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("couldn't create salt: %v", err)
+	}
+	var key [32]byte
+	var err error
+	if passphrase == "" {
+		if _, err = rand.Read(key[:]); err != nil {
+			return fmt.Errorf("couldn't create key: %v", err)
+		}
+		if kf := keyFile(file); kf != "" {
+			if err = ioutil.WriteFile(kf, key[:], 0600); err != nil {
+				return fmt.Errorf("couldn't write key file: %v", err)
+			}
+		}
+	} else if key, err = deriveKeystoreKey(passphrase, salt); err != nil {
+		return err
+	}
+	db.keystore = &keystore{key: key}
+	if err = db.setLocal(settingKeystoreSalt, salt); err != nil {
+		return err
+	}
+	check, err := db.keystore.seal(keystoreCheck)
+	if err != nil {
+		return err
+	}
+	return db.setLocal(settingKeystoreCheck, check)
+}
+
+// unlockKeystore derives the keystore key from the passphrase, or reads it from the key file if the passphrase is
+// empty, and returns an error if the key is wrong.
+func (db *DB) unlockKeystore(file, passphrase string) error {
+	salt, err := db.getLocal(settingKeystoreSalt)
+	if err != nil {
+		return fmt.Errorf("DB has no keystore: %v", err)
+	}
+	check, err := db.getLocal(settingKeystoreCheck)
+	if err != nil {
+		return fmt.Errorf("DB has no keystore: %v", err)
+	}
+	var key [32]byte
+	if passphrase == "" {
+		buf, err := ioutil.ReadFile(keyFile(file))
+		if err != nil || len(buf) != len(key) {
+			return errors.New("couldn't read key file, the DB might need a passphrase")
+		}
+		copy(key[:], buf)
+	} else if key, err = deriveKeystoreKey(passphrase, salt); err != nil {
+		return err
+	}
+	ks := &keystore{key: key}
+	if plain, err := ks.open(check); err != nil || bytes.Compare(plain, keystoreCheck) != 0 {
+		return errors.New("wrong passphrase")
+	}
+	db.keystore = ks
+	return nil
+}
+
+func (ks *keystore) seal(plain []byte) ([]byte, error) {
+	return sealSecret(&ks.key, plain)
+}
+
+func (ks *keystore) open(sealed []byte) ([]byte, error) {
+	return openSecret(&ks.key, sealed)
+}
+
+// sealSecret encrypts the plain text with the key. The random nonce is prepended to the cipher text.
+func sealSecret(key *[32]byte, plain []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, fmt.Errorf("couldn't create nonce: %v", err)
+	}
+	return secretbox.Seal(nonce[:], plain, &nonce, key), nil
+}
+
+// openSecret decrypts a cipher text created by sealSecret.
+func openSecret(key *[32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < 24+secretbox.Overhead {
+		return nil, errors.New("cipher text too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	plain, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("couldn't decrypt")
+	}
+	return plain, nil
+}
+
+// storeKey stores the private key of the given kind for the node, if it is not already the latest stored key.
+func (db DB) storeKey(id NodeID, kind string, key []byte) error {
+	if stored, err := db.loadLocalKey(id, kind); err == nil && bytes.Compare(stored, key) == 0 {
+		return nil
+	}
+	if db.keystore == nil {
+		return errors.New("keystore is locked")
+	}
+	sealed, err := db.keystore.seal(key)
+	if err != nil {
+		return fmt.Errorf("couldn't encrypt key: %v", err)
+	}
+	err = db.gdb.Save(&LocalKey{NodeID: id, Kind: kind, Key: sealed}).Error
+	if err != nil {
+		return fmt.Errorf("couldn't store key: %v", err)
+	}
+	return nil
+}
+
+// storeKeys stores all private keys of the key holder.
+func (db DB) storeKeys(id NodeID, kh keyHolder) error {
+	if priv := kh.localKey(); priv != nil {
+		if err := db.storeKey(id, keySign, priv); err != nil {
+			return err
+		}
+	}
+	if box := kh.localBoxKey(); box != nil {
+		if err := db.storeKey(id, keyBox, box[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLocalKey returns the latest private key of the given kind for the node.
+func (db DB) loadLocalKey(id NodeID, kind string) ([]byte, error) {
+	if db.keystore == nil {
+		return nil, errors.New("keystore is locked")
+	}
+	var lk LocalKey
+	err := db.gdb.Where(&LocalKey{NodeID: id, Kind: kind}).Last(&lk).Error
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load key: %v", err)
+	}
+	key, err := db.keystore.open(lk.Key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt key: %v", err)
+	}
+	return key, nil
+}
+
+// loadKey returns the private signing key for the given node, or an error if no private key is available.
+func (db DB) loadKey(id NodeID) (ed25519.PrivateKey, error) {
+	key, err := db.loadLocalKey(id, keySign)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("stored key has wrong size")
+	}
+	return key, nil
+}
+
+// loadBoxKey returns the private box key for the given node, or an error if no private key is available.
+func (db DB) loadBoxKey(id NodeID) (*[32]byte, error) {
+	key, err := db.loadLocalKey(id, keyBox)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("stored key has wrong size")
+	}
+	var box [32]byte
+	copy(box[:], key)
+	return &box, nil
+}
@@ -0,0 +1,346 @@
+package cymidb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// KeywordExtractor tags text FileData with its most relevant terms. The relevance is the TF-IDF score of a term:
+// how often it appears in the text, weighted by how rare it is in all texts of the DB. Stopwords of the detected
+// language are ignored, and the terms are stemmed, so "invoice" and "invoices" count as the same term.
+// As the scores change when new texts are added, Refresh runs the extractor again on all texts.
+// As tags are not encrypted, only the existing tags of the owner are linked, unless CreateTags is set.
+type KeywordExtractor struct {
+	// Top is the maximum number of keywords linked to a text. If it is 0, DefaultKeywords is used.
+	Top int
+	// CreateTags creates a tag for keywords that are not a tag of the owner yet. The names of these tags are
+	// stored in plain text, so they leak the words of encrypted texts.
+	CreateTags bool
+}
+
+// DefaultKeywords is the number of keywords linked to a text if KeywordExtractor.Top is not set.
+const DefaultKeywords = 5
+
+// KeywordCount holds how often a term appears in a text. It is a local table used to calculate the scores, and is
+// not synchronised with other devices. As the texts are encrypted, the index doesn't store the words in plain text.
+type KeywordCount struct {
+	gorm.Model
+	NodeID NodeID
+	// Term is a keyed hash of the stemmed word, so the same terms of different texts can be counted together.
+	Term string
+	// Word is the most frequent form of the term in the text, encrypted with the content key of the text.
+	Word  []byte
+	Count int
+}
+
+// KeywordScore is the TF-IDF score of a term in a text.
+type KeywordScore struct {
+	// Term is the keyed hash of the stemmed word.
+	Term string
+	// Word is the decrypted most frequent form of the term in the text.
+	Word  string
+	Score float64
+}
+
+// termCount is the count of a term in a text, before it is stored in the index.
+type termCount struct {
+	term  string
+	word  string
+	count int
+}
+
+func (ke KeywordExtractor) Name() string {
+	return "keywords"
+}
+
+// Extract indexes the text of the node and returns its top keywords as tags.
+func (ke KeywordExtractor) Extract(db DB, n Node) ([]Annotation, error) {
+	if n.Type != NodeTypeFileData {
+		return nil, nil
+	}
+	fd, err := NewFileDataFromNode(n)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.indexKeywords(n.NodeID, fd.Data); err != nil {
+		return nil, err
+	}
+	scores, err := db.KeywordScores(n.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	top := ke.Top
+	if top == 0 {
+		top = DefaultKeywords
+	}
+	db.extractors.Lock()
+	owner := db.extractors.owner
+	db.extractors.Unlock()
+	var as []Annotation
+	for i := 0; i < len(scores) && len(as) < top; i++ {
+		word := scores[i].Word
+		if t, err := db.FindTag(word, owner); err == nil {
+			word = t.Name
+		} else if !ke.CreateTags {
+			continue
+		}
+		as = append(as, Annotation{Kind: AnnotationTag, Value: word})
+	}
+	return as, nil
+}
+
+// Refresh runs the extractor again on all indexed texts, so their keywords follow the changed scores.
+func (ke KeywordExtractor) Refresh(db DB) error {
+	var ids []NodeID
+	if err := db.gdb.Model(&KeywordCount{}).Group("node_id").Pluck("node_id", &ids).Error; err != nil {
+		return fmt.Errorf("couldn't get indexed texts: %v", err)
+	}
+	for _, id := range ids {
+		if err := db.RerunExtractors(id, ke.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKeywords replaces the counts of the terms of the node. The terms are hashed with a key of the device, and
+// the words are encrypted with the content key of the node.
+func (db DB) indexKeywords(id NodeID, data []byte) error {
+	indexKey, err := db.keywordIndexKey()
+	if err != nil {
+		return err
+	}
+	key, err := db.nodeContentKey(id)
+	if err != nil {
+		return err
+	}
+	err = db.gdb.Unscoped().Where(&KeywordCount{NodeID: id}).Delete(&KeywordCount{}).Error
+	if err != nil {
+		return fmt.Errorf("couldn't remove old counts: %v", err)
+	}
+	for _, tc := range countTerms(data) {
+		kc := KeywordCount{NodeID: id, Term: hashTerm(indexKey, tc.term), Word: []byte(tc.word), Count: tc.count}
+		if key != nil {
+			if kc.Word, err = sealSecret(key, kc.Word); err != nil {
+				return fmt.Errorf("couldn't encrypt word: %v", err)
+			}
+		}
+		if err = db.gdb.Create(&kc).Error; err != nil {
+			return fmt.Errorf("couldn't store counts: %v", err)
+		}
+	}
+	return nil
+}
+
+// keywordIndexKey returns the key used to hash the terms of the keyword index. It is derived from the private box
+// key of the device, so it never leaves the device.
+func (db DB) keywordIndexKey() ([]byte, error) {
+	box := db.Device.localBoxKey()
+	if box == nil {
+		return nil, errors.New("active device has no private key to index keywords")
+	}
+	h := hmac.New(sha256.New, box[:])
+	h.Write([]byte("cymidb keyword index"))
+	return h.Sum(nil), nil
+}
+
+func hashTerm(key []byte, term string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(term))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// nodeContentKey returns the content key of the latest version of the node, or nil if it is not encrypted.
+func (db DB) nodeContentKey(id NodeID) (*[32]byte, error) {
+	n, err := db.getLatest(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get node: %v", err)
+	}
+	if len(n.KeyID) == 0 {
+		return nil, nil
+	}
+	return db.contentKey(n.KeyID)
+}
+
+// KeywordScores returns the scores of all terms of the node, sorted with the best score first.
+func (db DB) KeywordScores(id NodeID) (scores []KeywordScore, err error) {
+	var counts []KeywordCount
+	if err = db.gdb.Where(&KeywordCount{NodeID: id}).Find(&counts).Error; err != nil {
+		return nil, fmt.Errorf("couldn't get counts: %v", err)
+	}
+	key, err := db.nodeContentKey(id)
+	if err != nil {
+		return nil, err
+	}
+	var docs int
+	if err = db.gdb.Model(&KeywordCount{}).Select("count(distinct node_id)").Row().Scan(&docs); err != nil {
+		return nil, fmt.Errorf("couldn't count texts: %v", err)
+	}
+	df, err := db.documentFrequencies(id)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, c := range counts {
+		total += c.Count
+	}
+	for _, c := range counts {
+		word := c.Word
+		if key != nil {
+			if word, err = openSecret(key, word); err != nil {
+				return nil, fmt.Errorf("couldn't decrypt word: %v", err)
+			}
+		}
+		tf := float64(c.Count) / float64(total)
+		idf := math.Log(float64(1+docs) / float64(df[c.Term]))
+		scores = append(scores, KeywordScore{Term: c.Term, Word: string(word), Score: tf * idf})
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Score == scores[j].Score {
+			return scores[i].Word < scores[j].Word
+		}
+		return scores[i].Score > scores[j].Score
+	})
+	return
+}
+
+// documentFrequencies returns, for every term of the node, the number of texts it appears in.
+func (db DB) documentFrequencies(id NodeID) (map[string]int, error) {
+	rows, err := db.gdb.Model(&KeywordCount{}).Select("term, count(distinct node_id)").
+		Where("term IN (?)", db.gdb.Model(&KeywordCount{}).Select("term").Where(&KeywordCount{NodeID: id}).QueryExpr()).
+		Group("term").Rows()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count terms: %v", err)
+	}
+	defer rows.Close()
+	df := map[string]int{}
+	for rows.Next() {
+		var term string
+		var count int
+		if err = rows.Scan(&term, &count); err != nil {
+			return nil, fmt.Errorf("couldn't read term count: %v", err)
+		}
+		df[term] = count
+	}
+	return df, rows.Err()
+}
+
+// countTerms splits the text into words, removes the stopwords of its language and counts the stemmed terms.
+// Data that is not text returns no terms.
+func countTerms(data []byte) (counts []termCount) {
+	if !isText(data) {
+		return nil
+	}
+	words := strings.FieldsFunc(strings.ToLower(string(data)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	lang := detectLanguage(words)
+	terms := map[string]map[string]int{}
+	var order []string
+	for _, w := range words {
+		if utf8.RuneCountInString(w) < 3 || lang.stopwords[w] || strings.IndexFunc(w, unicode.IsLetter) < 0 {
+			continue
+		}
+		t := lang.stem(w)
+		if terms[t] == nil {
+			terms[t] = map[string]int{}
+			order = append(order, t)
+		}
+		terms[t][w]++
+	}
+	for _, t := range order {
+		tc := termCount{term: t}
+		best := 0
+		for w, c := range terms[t] {
+			tc.count += c
+			if c > best || (c == best && w < tc.word) {
+				best = c
+				tc.word = w
+			}
+		}
+		counts = append(counts, tc)
+	}
+	return
+}
+
+// isText returns true if the data is UTF-8 with only few control characters.
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	control := 0
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			control++
+		}
+	}
+	return control*100 <= len(data)
+}
+
+// language holds the stopwords and suffixes used to stem words of one language.
+type language struct {
+	stopwords map[string]bool
+	// suffixes are removed from the words, the longest first.
+	suffixes []string
+}
+
+// stem removes the first matching suffix, if at least three letters stay.
+func (l language) stem(word string) string {
+	for _, s := range l.suffixes {
+		if strings.HasSuffix(word, s) && utf8.RuneCountInString(word)-utf8.RuneCountInString(s) >= 3 {
+			return strings.TrimSuffix(word, s)
+		}
+	}
+	return word
+}
+
+func newLanguage(stopwords string, suffixes ...string) language {
+	l := language{stopwords: map[string]bool{}, suffixes: suffixes}
+	for _, w := range strings.Fields(stopwords) {
+		l.stopwords[w] = true
+	}
+	return l
+}
+
+var languages = []language{
+	newLanguage(`the and for are but not you all any can had her was one our out has have him his how its may
+		new now old see two who did get let say she too use that with this from they will would there their what
+		about which when make like than been into some could them other then these your were also more only over
+		such after most very just where should because between through each those here while both before`,
+		"ational", "ations", "ation", "ings", "ing", "edly", "ies", "ied", "ers", "er", "ed", "es", "ly", "s", "e"),
+	newLanguage(`der die das und ist nicht ein eine einer eines einem einen sie ich wir ihr mit von für auf
+		aus bei dem den des als auch wie noch nach aber oder wenn dass sich sind war wird werden hat haben kann
+		nur schon über unter vor zum zur mehr sehr hier dort diese dieser dieses jetzt wurde durch`,
+		"ungen", "ung", "heit", "keit", "lich", "isch", "en", "er", "em", "es", "e", "n", "s"),
+	newLanguage(`les des une est pas que qui dans pour par sur avec mais ou donc car son ses leur leurs nous
+		vous ils elle elles aux ces cette sont été être avoir fait plus moins comme tout tous très aussi bien
+		entre sans sous chez`,
+		"issements", "issement", "ements", "ement", "ations", "ation", "euses", "euse", "eux", "es", "e", "s"),
+}
+
+// detectLanguage returns the language with the most stopwords in the words.
+func detectLanguage(words []string) language {
+	best, hits := 0, -1
+	for i, l := range languages {
+		h := 0
+		for _, w := range words {
+			if l.stopwords[w] {
+				h++
+			}
+		}
+		if h > hits {
+			best, hits = i, h
+		}
+	}
+	return languages[best]
+}
@@ -0,0 +1,73 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountTerms(t *testing.T) {
+	counts := countTerms([]byte("The invoices and the invoice: we paid the invoice with the bank."))
+	words := map[string]int{}
+	for _, c := range counts {
+		words[c.word] = c.count
+	}
+	require.Equal(t, map[string]int{"invoice": 3, "paid": 1, "bank": 1}, words)
+
+	counts = countTerms([]byte("Die Rechnungen sind bezahlt, und die Rechnung ist nicht mehr offen."))
+	words = map[string]int{}
+	for _, c := range counts {
+		words[c.word] = c.count
+	}
+	require.Equal(t, map[string]int{"rechnung": 2, "bezahlt": 1, "offen": 1}, words)
+
+	require.Nil(t, countTerms([]byte{0xff, 0xfe, 0x00}))
+}
+
+func TestKeywordExtractor(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	owner := RandomNodeID()
+	ke := KeywordExtractor{Top: 2, CreateTags: true}
+	db.SetExtractors(owner, ke)
+
+	keywords := func(fd FileData) (names []string) {
+		tags, err := db.GetTags(fd.node.NodeID)
+		require.NoError(t, err)
+		for _, t := range tags {
+			names = append(names, t.Name)
+		}
+		return
+	}
+	roof := NewFileData([]byte("The roof offer: the roof needs new tiles, and the tiles are red."))
+	require.NoError(t, db.SaveNode(roof))
+	require.Equal(t, []string{"roof", "tiles"}, keywords(roof))
+
+	// Terms found in all texts get a lower score, once the extractor is refreshed.
+	for _, text := range []string{"The tiles of the kitchen project.", "Tiles for the bathroom project."} {
+		require.NoError(t, db.SaveNode(NewFileData([]byte(text))))
+	}
+	require.NoError(t, ke.Refresh(db))
+	require.Equal(t, []string{"roof", "needs"}, keywords(roof))
+	scores, err := db.KeywordScores(roof.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, "roof", scores[0].Word)
+	require.True(t, scores[0].Score > scores[len(scores)-1].Score)
+
+	// The index doesn't hold the words of the encrypted texts.
+	var counts []KeywordCount
+	require.NoError(t, db.gdb.Where(&KeywordCount{NodeID: roof.node.NodeID}).Find(&counts).Error)
+	for _, c := range counts {
+		require.NotContains(t, string(c.Word), "roof")
+		require.NotContains(t, c.Term, "roof")
+	}
+
+	// Without CreateTags, only the existing tags of the owner are linked.
+	db.SetExtractors(owner, KeywordExtractor{Top: 2})
+	_, err = db.CreateTag("Chimney", owner)
+	require.NoError(t, err)
+	chimney := NewFileData([]byte("The chimney of the house, the chimney is old, the walls are white."))
+	require.NoError(t, db.SaveNode(chimney))
+	require.Equal(t, []string{"Chimney"}, keywords(chimney))
+}
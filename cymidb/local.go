@@ -0,0 +1,39 @@
+package cymidb
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LocalSetting holds a value that is only valid for this copy of the DB. Like the LocalKey, it is never part of the
+// nodes that are synchronised with other devices.
+type LocalSetting struct {
+	gorm.Model
+	Key   string
+	Value []byte
+}
+
+// settingActiveDevice holds the NodeID of the device this copy of the DB runs on.
+const settingActiveDevice = "active_device"
+
+// setLocal stores the value for the given key.
+func (db DB) setLocal(key string, value []byte) error {
+	var ls LocalSetting
+	db.gdb.Where(&LocalSetting{Key: key}).First(&ls)
+	ls.Key = key
+	ls.Value = value
+	if err := db.gdb.Save(&ls).Error; err != nil {
+		return fmt.Errorf("couldn't store local setting: %v", err)
+	}
+	return nil
+}
+
+// getLocal returns the value for the given key, or an error if the key is not set.
+func (db DB) getLocal(key string) ([]byte, error) {
+	var ls LocalSetting
+	if err := db.gdb.Where(&LocalSetting{Key: key}).First(&ls).Error; err != nil {
+		return nil, fmt.Errorf("couldn't get local setting %s: %v", key, err)
+	}
+	return ls.Value, nil
+}
@@ -0,0 +1,90 @@
+package cymidb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A DB in the baseline format, from before the nodes have been signed, has no keystore and no active device, its
+// links table has no primary key, and neither its nodes nor its links are signed. It is migrated when it is opened.
+
+// migrateLinks recreates the links table of a baseline DB with all columns of a Link, keeping the links.
+// As sqlite cannot add a primary key to an existing table, AutoMigrate fails on these tables.
+func migrateLinks(gdb *gorm.DB) error {
+	if !gdb.HasTable(&Link{}) || gdb.Dialect().HasColumn("links", "id") {
+		return nil
+	}
+	tx := gdb.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("couldn't start transaction: %v", tx.Error)
+	}
+	err := tx.Exec(`ALTER TABLE links RENAME TO baseline_links`).Error
+	if err == nil {
+		err = tx.AutoMigrate(&Link{}).Error
+	}
+	if err == nil {
+		err = tx.Exec(`INSERT INTO links ("from", "to") SELECT "from", "to" FROM baseline_links`).Error
+	}
+	if err == nil {
+		err = tx.Exec(`DROP TABLE baseline_links`).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("couldn't migrate links: %v", err)
+	}
+	return tx.Commit().Error
+}
+
+// migrateBaseline sets up a baseline DB: it creates the keystore, and gives new keys to the device stored in the
+// first node, which becomes the active device. Then all nodes are signed by this device, and the Data of blob
+// nodes is encrypted. The links are signed afterwards, like all unsigned links.
+func (db *DB) migrateBaseline(file, passphrase string) error {
+	if _, err := db.getLocal(settingActiveDevice); err == nil {
+		return errors.New("DB has an active device, but no keystore")
+	}
+	var first Node
+	if err := db.gdb.Order("id").First(&first).Error; err != nil {
+		return fmt.Errorf("couldn't get first node: %v", err)
+	}
+	dn, err := db.getLatest(first.NodeID)
+	if err != nil {
+		return fmt.Errorf("couldn't get device: %v", err)
+	}
+	dev, err := NewDeviceFromNode(dn)
+	if err != nil {
+		return fmt.Errorf("first node is not a device: %v", err)
+	}
+	var unsigned []Node
+	if err = db.gdb.Where("signature IS NULL").Order("id").Find(&unsigned).Error; err != nil {
+		return fmt.Errorf("couldn't search unsigned nodes: %v", err)
+	}
+	if err = db.createKeystore(file, passphrase); err != nil {
+		return fmt.Errorf("couldn't create keystore: %v", err)
+	}
+	keys := NewDevice(dev.Name)
+	dev.PublicKey, dev.privateKey = keys.PublicKey, keys.privateKey
+	dev.BoxKey, dev.boxKey = keys.BoxKey, keys.boxKey
+	db.Device = dev
+	if err = db.SaveNode(dev); err != nil {
+		return fmt.Errorf("couldn't save device: %v", err)
+	}
+	if err = db.setLocal(settingActiveDevice, dev.node.NodeID); err != nil {
+		return fmt.Errorf("couldn't store active device: %v", err)
+	}
+	keyIDs := map[string]NodeID{}
+	for _, n := range unsigned {
+		if n.Type.Encrypted() {
+			if err = db.encryptNode(&n, Node{KeyID: keyIDs[string(n.NodeID)]}); err != nil {
+				return fmt.Errorf("couldn't encrypt node: %v", err)
+			}
+			keyIDs[string(n.NodeID)] = n.KeyID
+		}
+		n.sign(dev.node.NodeID, dev.privateKey)
+		if err = db.gdb.Save(&n).Error; err != nil {
+			return fmt.Errorf("couldn't sign node: %v", err)
+		}
+	}
+	return nil
+}
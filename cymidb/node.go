@@ -2,6 +2,7 @@ package cymidb
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -26,6 +27,11 @@ const (
 	NodeTag
 )
 
+// Base returns the general node type of a sub-type.
+func (nt NodeType) Base() NodeType {
+	return nt - nt%(1<<56)
+}
+
 func (nt NodeType) SubType(url string) NodeType {
 	sha := sha256.Sum256([]byte(url))
 	sub := binary.LittleEndian.Uint64(sha[:]) % (1 << 56)
@@ -49,6 +55,7 @@ type NodeID []byte
 const NodeIDLen = 32
 
 // Node is the basic type in the DB. Every node can have 0 or more fields that are either Data, or point to other nodes.
+// Every version of a node is signed by the device that wrote it.
 type Node struct {
 	gorm.Model
 	NodeID  NodeID
@@ -56,6 +63,13 @@ type Node struct {
 	Version uint64
 	Date    int64
 	Data    []byte
+	// KeyID is the NodeID of the ContentKey used to encrypt Data, or empty if Data is not encrypted.
+	KeyID NodeID
+	// Signer is the NodeID of the device that signed this version of the node.
+	Signer NodeID
+	// SignedAt is the unix time in nanoseconds when this version has been signed.
+	SignedAt  int64
+	Signature []byte
 }
 
 // Noder can be used for inherited types that need to be stored,
@@ -64,10 +78,67 @@ type Noder interface {
 	GetNode() (Node, error)
 }
 
-// Link is used to link a parent to a child node, or a child to an ancestor.
+// Link is used to link a parent to a child node, or a child to an ancestor. Links are signed by the device that
+// added them, so other DBs can verify them when importing them.
+// When a link is removed, a signed LinkRemoval is stored, so that the removal can be passed on to other DBs.
 type Link struct {
+	gorm.Model
 	From NodeID
 	To   NodeID
+	// Origin is the name of the extractor that created this link, or empty if it has been added manually.
+	Origin string
+	// Signer is the device that added the link.
+	Signer NodeID
+	// SignedAt is the unix time in nanoseconds when the link has been added.
+	SignedAt  int64
+	Signature []byte
+}
+
+func (l Link) hash() []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{l.From, l.To, []byte(l.Origin), l.Signer} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	_ = binary.Write(h, binary.LittleEndian, l.SignedAt)
+	return h.Sum(nil)
+}
+
+// sign sets the signer and signs the link.
+func (l *Link) sign(signer NodeID, priv ed25519.PrivateKey) {
+	l.Signer = signer
+	l.SignedAt = time.Now().UnixNano()
+	l.Signature = ed25519.Sign(priv, l.hash())
+}
+
+// LinkRemoval records that a device removed the links between two nodes. It only removes the links that have
+// been created before it has been signed, so a link added again later is kept.
+type LinkRemoval struct {
+	gorm.Model
+	From NodeID
+	To   NodeID
+	// Signer is the device that removed the link.
+	Signer NodeID
+	// SignedAt is the unix time in nanoseconds when the link has been removed.
+	SignedAt  int64
+	Signature []byte
+}
+
+func (r LinkRemoval) hash() []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{r.From, r.To, r.Signer} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	_ = binary.Write(h, binary.LittleEndian, r.SignedAt)
+	return h.Sum(nil)
+}
+
+// sign sets the signer and signs the removal.
+func (r *LinkRemoval) sign(signer NodeID, priv ed25519.PrivateKey) {
+	r.Signer = signer
+	r.SignedAt = time.Now().UnixNano()
+	r.Signature = ed25519.Sign(priv, r.hash())
 }
 
 // NewNode creates a node and sets up all internal structures accordingly.
@@ -106,6 +177,37 @@ func (n Node) GetNode() (Node, error) {
 	return n, nil
 }
 
+// hash returns the hash of all fields of the node covered by the signature.
+func (n Node) hash() []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{n.NodeID, n.Signer, n.KeyID, n.Data} {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	for _, v := range []uint64{uint64(n.Type), n.Version, uint64(n.Date), uint64(n.SignedAt)} {
+		_ = binary.Write(h, binary.LittleEndian, v)
+	}
+	return h.Sum(nil)
+}
+
+// sign sets the signer and signs this version of the node.
+func (n *Node) sign(signer NodeID, priv ed25519.PrivateKey) {
+	n.Signer = signer
+	n.SignedAt = time.Now().UnixNano()
+	n.Signature = ed25519.Sign(priv, n.hash())
+}
+
+// verifySignature returns an error if the signature of the node doesn't match the given public key.
+func (n Node) verifySignature(pub ed25519.PublicKey) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	if !ed25519.Verify(pub, n.hash(), n.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
 func (n Node) DecodeNodeType(t NodeType, i interface{}) error {
 	if n.Type != t {
 		return errors.New("node is not of correct type")
@@ -0,0 +1,376 @@
+package cymidb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pairing adds a new device to the identity of an existing device. The existing device starts a pairing session
+// and shows the one-time code to the user. The new device connects to the listener of the existing device, and
+// both devices derive a key from the code with SPAKE2 and prove to each other that they know the code. The
+// existing device then endorses the new device with the identity and sends all its data to the new device,
+// encrypted with the derived key. All content keys are wrapped for the new device, so that it can decrypt the data.
+//
+// The code is short, so it can only be used once and only for a limited number of attempts.
+
+// PairingCodeLength is the number of characters in a pairing code.
+const PairingCodeLength = 8
+
+// PairingAttempts is the number of wrong codes after which a pairing session is aborted.
+const PairingAttempts = 3
+
+// pairingAlphabet doesn't contain characters that are easily confused.
+const pairingAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// Pairing is a running pairing session on an existing device.
+type Pairing struct {
+	// Code is the one-time code that has to be entered on the new device.
+	Code string
+	// Addr is the address where the new device has to connect to.
+	Addr     string
+	db       DB
+	ident    Identity
+	expires  time.Time
+	server   *http.Server
+	mutex    sync.Mutex
+	attempts int
+	session  *pairSession
+	done     bool
+	device   Device
+	err      error
+	finished chan struct{}
+}
+
+// pairSession is the SPAKE2 exchange of a new device whose code has not been confirmed yet.
+type pairSession struct {
+	id      []byte
+	device  Node
+	keys    pairingKeys
+	confirm []byte
+}
+
+type pairStartRequest struct {
+	Device Node
+	// Share is the SPAKE2 share of the new device.
+	Share []byte
+}
+
+type pairStartResponse struct {
+	Session []byte
+	// Share is the SPAKE2 share of the existing device.
+	Share   []byte
+	Confirm []byte
+}
+
+type pairFinishRequest struct {
+	Session []byte
+	Confirm []byte
+}
+
+type pairFinishResponse struct {
+	// Sealed is the pairData encrypted with the key of the SPAKE2 exchange.
+	Sealed []byte
+}
+
+type pairData struct {
+	Bundle Bundle
+}
+
+// StartPairing listens on the given address for a new device to pair with. The new device will be endorsed by the
+// given identity, whose private key must be available in this DB. The pairing session ends after the first
+// successful pairing, after PairingAttempts wrong codes, or when the timeout is reached.
+func (db DB) StartPairing(ident Identity, addr string, timeout time.Duration) (*Pairing, error) {
+	if _, err := ident.signer(db); err != nil {
+		return nil, err
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen: %v", err)
+	}
+	p := &Pairing{
+		Code:     code,
+		Addr:     l.Addr().String(),
+		db:       db,
+		ident:    ident,
+		expires:  time.Now().Add(timeout),
+		finished: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pair/start", p.handle(p.start))
+	mux.HandleFunc("/pair/finish", p.handle(p.pair))
+	p.server = &http.Server{Handler: mux}
+	go p.server.Serve(l)
+	go func() {
+		select {
+		case <-time.After(timeout):
+			p.finish(Device{}, errors.New("pairing timed out"))
+		case <-p.finished:
+		}
+	}()
+	return p, nil
+}
+
+// Wait blocks until the pairing session is finished and returns the paired device.
+func (p *Pairing) Wait() (Device, error) {
+	<-p.finished
+	return p.device, p.err
+}
+
+// Close aborts the pairing session, if it is still running.
+func (p *Pairing) Close() error {
+	p.finish(Device{}, errors.New("pairing has been closed"))
+	return nil
+}
+
+// finish ends the pairing session. Only the first call has any effect.
+func (p *Pairing) finish(dev Device, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finishLocked(dev, err)
+}
+
+// finishLocked is finish for callers holding the mutex. Once it returns, the code cannot be used anymore.
+func (p *Pairing) finishLocked(dev Device, err error) {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.session = nil
+	p.device = dev
+	p.err = err
+	close(p.finished)
+	// Shutdown lets the response of a successful pairing be sent before the connection is closed.
+	go p.server.Shutdown(context.Background())
+}
+
+// handle decodes the request, passes it to the step of the pairing, and encodes the response.
+func (p *Pairing) handle(step func(body []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := step(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// check returns an error if the pairing session cannot be used anymore. It must be called with the mutex held.
+func (p *Pairing) check() error {
+	if p.done {
+		return errors.New("pairing session is finished")
+	}
+	if time.Now().After(p.expires) {
+		return errors.New("pairing code expired")
+	}
+	return nil
+}
+
+// start answers the SPAKE2 share of the new device, and proves that this device knows the code. As the new device
+// can test one code with the answer, every start counts as an attempt. A new start replaces the previous session
+// that has not been finished.
+func (p *Pairing) start(body []byte) (interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	if p.attempts >= PairingAttempts {
+		err := errors.New("too many wrong pairing codes")
+		p.finishLocked(Device{}, err)
+		return nil, err
+	}
+	p.attempts++
+	var req pairStartRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("couldn't decode request: %v", err)
+	}
+	s, err := newSpake2(p.Code, false)
+	if err != nil {
+		return nil, err
+	}
+	session := &pairSession{id: make([]byte, 32), device: req.Device}
+	if _, err = rand.Read(session.id); err != nil {
+		return nil, fmt.Errorf("couldn't create session: %v", err)
+	}
+	if session.keys, err = s.finish(req.Share, req.Device.hash()); err != nil {
+		return nil, err
+	}
+	p.session = session
+	return pairStartResponse{Session: session.id, Share: s.share, Confirm: session.keys.confirmExisting}, nil
+}
+
+// pair checks that the new device knows the code, and returns all the data encrypted for the new device.
+// The session is finished before the data is sent, so the code can only be used once.
+func (p *Pairing) pair(body []byte) (interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	var req pairFinishRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("couldn't decode request: %v", err)
+	}
+	s := p.session
+	if s == nil || !hmac.Equal(s.id, req.Session) {
+		return nil, errors.New("unknown pairing session")
+	}
+	p.session = nil
+	if !hmac.Equal(req.Confirm, s.keys.confirmNew) {
+		if p.attempts >= PairingAttempts {
+			p.finishLocked(Device{}, errors.New("too many wrong pairing codes"))
+		}
+		return nil, errors.New("wrong pairing code")
+	}
+
+	dev, data, err := p.transfer(s.device)
+	p.finishLocked(dev, err)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode data: %v", err)
+	}
+	sealed, err := sealSecret(&s.keys.encryption, buf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encrypt data: %v", err)
+	}
+	return pairFinishResponse{Sealed: sealed}, nil
+}
+
+// transfer endorses the new device and returns all the data it needs.
+func (p *Pairing) transfer(dn Node) (dev Device, data pairData, err error) {
+	dev, err = NewDeviceFromNode(dn)
+	if err != nil {
+		return dev, data, err
+	}
+	if bytes.Compare(dn.Signer, dn.NodeID) != 0 {
+		return dev, data, errors.New("device node must be self-signed")
+	}
+	if err = dn.verifySignature(dev.PublicKey); err != nil {
+		return dev, data, fmt.Errorf("couldn't verify device: %v", err)
+	}
+	if err = p.db.Import(Bundle{Nodes: []Node{dn}}); err != nil {
+		return dev, data, fmt.Errorf("couldn't import device: %v", err)
+	}
+	if _, err = p.ident.Endorse(p.db, dev); err != nil {
+		return dev, data, fmt.Errorf("couldn't endorse device: %v", err)
+	}
+	if err = p.db.GrantContentKeys(dev.node.NodeID, dev.BoxKey); err != nil {
+		return dev, data, fmt.Errorf("couldn't grant content keys: %v", err)
+	}
+	data.Bundle, err = p.db.Export()
+	return
+}
+
+// PairDBFile creates a new DB in the given file with a new device, and pairs it with the existing device listening
+// on addr. The code is the one-time code shown by the existing device, and the passphrase protects the private
+// keys of the new DB.
+// On success, the returned DB holds all the data of the existing device, including the endorsement of the new
+// device, and all content keys of the existing device are wrapped for the new device.
+func PairDBFile(file, name, url, passphrase, addr, code string) (db DB, err error) {
+	db, err = CreateDBFilePassphrase(file, name, url, passphrase)
+	if err != nil {
+		return db, err
+	}
+	if err = db.pairWith(addr, code); err != nil {
+		db.Close()
+		return db, fmt.Errorf("couldn't pair: %v", err)
+	}
+	return
+}
+
+func (db DB) pairWith(addr, code string) error {
+	dn, err := db.GetLatest(db.Device.node.NodeID)
+	if err != nil {
+		return fmt.Errorf("couldn't get device node: %v", err)
+	}
+	s, err := newSpake2(code, true)
+	if err != nil {
+		return err
+	}
+	var start pairStartResponse
+	if err = postPairing(addr, "start", pairStartRequest{Device: dn, Share: s.share}, &start); err != nil {
+		return err
+	}
+	keys, err := s.finish(start.Share, dn.hash())
+	if err != nil {
+		return err
+	}
+	var resp pairFinishResponse
+	err = postPairing(addr, "finish", pairFinishRequest{Session: start.Session, Confirm: keys.confirmNew}, &resp)
+	// The other device is always told about a wrong code, so it can count the attempts.
+	if !hmac.Equal(start.Confirm, keys.confirmExisting) {
+		return errors.New("other device doesn't know the pairing code")
+	}
+	if err != nil {
+		return err
+	}
+	buf, err := openSecret(&keys.encryption, resp.Sealed)
+	if err != nil {
+		return fmt.Errorf("couldn't decrypt data: %v", err)
+	}
+	var data pairData
+	if err = json.Unmarshal(buf, &data); err != nil {
+		return fmt.Errorf("couldn't decode data: %v", err)
+	}
+	return db.Import(data.Bundle)
+}
+
+// postPairing sends the request to the step of the pairing session on addr, and decodes the response.
+func postPairing(addr, step string, req, resp interface{}) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("couldn't encode request: %v", err)
+	}
+	client := http.Client{Timeout: time.Minute}
+	r, err := client.Post("http://"+addr+"/pair/"+step, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("couldn't connect: %v", err)
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("couldn't read response: %v", err)
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("pairing refused: %s", bytes.TrimSpace(body))
+	}
+	if err = json.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("couldn't decode response: %v", err)
+	}
+	return nil
+}
+
+func newPairingCode() (string, error) {
+	buf := make([]byte, PairingCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("couldn't create code: %v", err)
+	}
+	for i := range buf {
+		buf[i] = pairingAlphabet[int(buf[i])%len(pairingAlphabet)]
+	}
+	return string(buf), nil
+}
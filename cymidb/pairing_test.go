@@ -0,0 +1,71 @@
+package cymidb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_StartPairing(t *testing.T) {
+	laptop, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer laptop.Close()
+	ident, err := NewIdentity("test", nil)
+	require.NoError(t, err)
+	require.NoError(t, laptop.SaveNode(ident))
+	_, err = ident.Endorse(laptop, laptop.Device)
+	require.NoError(t, err)
+	blob := NewNode(NodeBlob)
+	blob.Data = []byte("blob")
+	require.NoError(t, laptop.SaveNode(blob))
+
+	p, err := laptop.StartPairing(ident, "127.0.0.1:0", time.Minute)
+	require.NoError(t, err)
+	defer p.Close()
+
+	_, err = PairDBFile(":memory:", "phone", "", "", p.Addr, "WRONGCODE")
+	require.Error(t, err)
+
+	phone, err := PairDBFile(":memory:", "phone", "http://phone", "", p.Addr, p.Code)
+	require.NoError(t, err)
+	defer phone.Close()
+	dev, err := p.Wait()
+	require.NoError(t, err)
+	require.Equal(t, phone.Device.node.NodeID, dev.node.NodeID)
+	require.Equal(t, "http://phone", dev.URL)
+
+	// Both devices know about the endorsement of the phone.
+	for _, db := range []DB{laptop, phone} {
+		es, err := db.GetEndorsements(phone.Device.node.NodeID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(es))
+	}
+	n, err := phone.GetLatest(blob.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, blob.Data, n.Data)
+
+	// The code can only be used once.
+	_, err = PairDBFile(":memory:", "tablet", "", "", p.Addr, p.Code)
+	require.Error(t, err)
+}
+
+func TestDB_StartPairingAttempts(t *testing.T) {
+	laptop, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer laptop.Close()
+	ident, err := NewIdentity("test", nil)
+	require.NoError(t, err)
+	require.NoError(t, laptop.SaveNode(ident))
+
+	p, err := laptop.StartPairing(ident, "127.0.0.1:0", time.Minute)
+	require.NoError(t, err)
+	for i := 0; i < PairingAttempts; i++ {
+		_, err = PairDBFile(":memory:", "phone", "", "", p.Addr, "WRONGCODE")
+		require.Error(t, err)
+	}
+	_, err = p.Wait()
+	require.Error(t, err)
+	_, err = PairDBFile(":memory:", "phone", "", "", p.Addr, p.Code)
+	require.Error(t, err)
+}
@@ -1,5 +1,10 @@
 package cymidb
 
+import (
+	"fmt"
+	"strconv"
+)
+
 type PFHOperations uint32
 
 const (
@@ -7,12 +12,65 @@ const (
 	PFHOUpdateDB
 )
 
+// ModuleFile is the module name of file hooks.
+const ModuleFile = "file"
+
+func init() {
+	RegisterHookSettings(ModuleFile, SettingsSchema{
+		{Name: "root", Kind: SettingPath, Description: "directory kept in the DB", Required: true, PerDevice: true},
+		{Name: "update_fs", Kind: SettingBool, Description: "write changes in the DB to the directory",
+			Default: "false"},
+		{Name: "update_db", Kind: SettingBool, Description: "write changes in the directory to the DB",
+			Default: "false"},
+	})
+}
+
+// PluginFileHook is the configuration of a file hook, stored in the settings of its Hook node.
 type PluginFileHook struct {
 	Hook       Hook
 	Root       string
 	Operations PFHOperations
 }
 
+// NewPluginFileHook configures the hook as a file hook. The root directory is set for every device of the hook, or
+// for all devices if the hook has no devices yet. The Hook must be saved to store the configuration.
 func NewPluginFileHook(h Hook, dir string, ops PFHOperations) (pfh PluginFileHook, err error) {
-	return
+	h.Module = ModuleFile
+	if len(h.Devices) == 0 {
+		err = h.SetSetting("root", dir)
+	}
+	for _, dev := range h.Devices {
+		if err == nil {
+			err = h.SetDeviceSetting(dev, "root", dir)
+		}
+	}
+	if err == nil {
+		err = h.SetSetting("update_fs", strconv.FormatBool(ops&PFHOUpdateFS != 0))
+	}
+	if err == nil {
+		err = h.SetSetting("update_db", strconv.FormatBool(ops&PFHOUpdateDB != 0))
+	}
+	if err != nil {
+		return pfh, fmt.Errorf("couldn't configure file hook: %v", err)
+	}
+	return PluginFileHook{Hook: h, Root: dir, Operations: ops}, nil
+}
+
+// NewPluginFileHookFromHook returns the file hook with the settings of the hook on the given device.
+func NewPluginFileHookFromHook(h Hook, device NodeID) (pfh PluginFileHook, err error) {
+	if h.Module != ModuleFile {
+		return pfh, fmt.Errorf("hook of module '%s' is not a file hook", h.Module)
+	}
+	s, err := h.Settings(device)
+	if err != nil {
+		return pfh, fmt.Errorf("couldn't get settings: %v", err)
+	}
+	pfh = PluginFileHook{Hook: h, Root: s.String("root")}
+	if s.Bool("update_fs") {
+		pfh.Operations |= PFHOUpdateFS
+	}
+	if s.Bool("update_db") {
+		pfh.Operations |= PFHOUpdateDB
+	}
+	return pfh, nil
 }
@@ -2,7 +2,6 @@ package cymidb
 
 import (
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"testing"
@@ -35,5 +34,20 @@ func TestNewFileHook(t *testing.T) {
 
 	pfh, err := NewPluginFileHook(hook, root, PFHOUpdateDB|PFHOUpdateFS)
 	require.NoError(t, err)
-	log.Print(pfh)
+	require.NoError(t, db.SaveNode(pfh.Hook))
+
+	// The configuration is read back from the node.
+	n, err := db.GetLatest(hook.node.NodeID)
+	require.NoError(t, err)
+	h, err := NewHookFromNode(db, n)
+	require.NoError(t, err)
+	pfh2, err := NewPluginFileHookFromHook(h, db.Device.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, root, pfh2.Root)
+	require.Equal(t, PFHOUpdateDB|PFHOUpdateFS, pfh2.Operations)
+
+	_, err = NewPluginFileHook(hook, "relative", 0)
+	require.Error(t, err)
+	_, err = NewPluginFileHookFromHook(hook, db.Device.node.NodeID)
+	require.Error(t, err)
 }
@@ -0,0 +1,159 @@
+package cymidb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Project arranges tags, identities and items. Everything linked from the project belongs to it: its tags bring in
+// all nodes tagged with them, its identities are the people working on it, and all other nodes are explicit items.
+type Project struct {
+	Name        string
+	Description string
+	node        Node
+}
+
+var NodeTypeProject = NodeTag.SubType("blue.gasser/cybermind/project")
+
+// ProjectActivity is the number of changes to the items of a project during one period of time.
+type ProjectActivity struct {
+	Start   time.Time
+	Changes int
+}
+
+func NewProjectFromNode(n Node) (p Project, err error) {
+	err = n.DecodeNodeType(NodeTypeProject, &p)
+	if err != nil {
+		return p, fmt.Errorf("couldn't decode project: %v", err)
+	}
+	p.node = n
+	return
+}
+
+func NewProject(name string) (p Project) {
+	p.node = NewNode(NodeTypeProject)
+	p.Name = name
+	return
+}
+
+func (p Project) GetNode() (Node, error) {
+	err := p.node.EncodeData(&p)
+	return p.node, err
+}
+
+// Add adds a tag, an identity or an item to the project.
+func (p Project) Add(db DB, n Noder) error {
+	return db.AddLink(p, n)
+}
+
+// Remove removes a tag, an identity or an item from the project.
+func (p Project) Remove(db DB, n Noder) error {
+	return db.RemoveLink(p, n)
+}
+
+// GetTags returns the tags of the project. Sub-types of tags, like other projects, are returned with the fields
+// they share with a tag.
+func (p Project) GetTags(db DB) (tags []Tag, err error) {
+	children, err := db.GetChildrenNodes(p.node.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get children: %v", err)
+	}
+	for _, c := range children {
+		if !c.Type.Matches([]NodeType{NodeTag}) {
+			continue
+		}
+		var t Tag
+		if err = c.DecodeNodeType(c.Type, &t); err != nil {
+			return nil, fmt.Errorf("couldn't decode tag: %v", err)
+		}
+		t.node = c
+		tags = append(tags, t)
+	}
+	return
+}
+
+// GetIdentities returns the identities of the project.
+func (p Project) GetIdentities(db DB) (idents []Identity, err error) {
+	children, err := db.GetChildrenNodes(p.node.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get children: %v", err)
+	}
+	for _, c := range children {
+		if c.Type == NodeIdentity {
+			ident, err := NewIdentityFromNode(c)
+			if err != nil {
+				return nil, err
+			}
+			idents = append(idents, ident)
+		}
+	}
+	return
+}
+
+// GetItems returns all nodes belonging to the project, either as explicit items, or through one of its tags.
+// If types are given, only nodes of these types are returned.
+func (p Project) GetItems(db DB, types ...NodeType) (items []Node, err error) {
+	children, err := db.GetChildrenNodes(p.node.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get children: %v", err)
+	}
+	seen := map[string]bool{}
+	add := func(n Node) {
+		if !seen[string(n.NodeID)] && n.Type.Matches(types) {
+			seen[string(n.NodeID)] = true
+			items = append(items, n)
+		}
+	}
+	for _, c := range children {
+		switch {
+		case c.Type.Matches([]NodeType{NodeTag}):
+			tagged, err := db.GetTagged(c.NodeID)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range tagged {
+				add(n)
+			}
+		case c.Type.Matches([]NodeType{NodeIdentity}):
+		default:
+			add(c)
+		}
+	}
+	return
+}
+
+// GetActivity returns the number of changes to the items of the project since the given time, counted in periods
+// of the given length. Only periods with changes are returned, sorted by time.
+func (p Project) GetActivity(db DB, since time.Time, period time.Duration) (activity []ProjectActivity, err error) {
+	if period <= 0 {
+		return nil, errors.New("period must be positive")
+	}
+	items, err := p.GetItems(db)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[int64]int{}
+	for _, item := range items {
+		versions, err := db.nodeVersions(item.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			signed := time.Unix(0, v.SignedAt)
+			if signed.Before(since) {
+				continue
+			}
+			changes[int64(signed.Sub(since)/period)]++
+		}
+	}
+	for bucket, count := range changes {
+		start := since.Add(time.Duration(bucket) * period)
+		activity = append(activity, ProjectActivity{Start: start, Changes: count})
+	}
+	sort.Slice(activity, func(i, j int) bool {
+		return activity[i].Start.Before(activity[j].Start)
+	})
+	return
+}
@@ -0,0 +1,75 @@
+package cymidb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProject(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	start := time.Now()
+
+	ident, err := NewIdentity("alice", nil)
+	require.NoError(t, err)
+	house, err := db.CreateTag("house", ident.node.NodeID)
+	require.NoError(t, err)
+	project := NewProject("New roof")
+	plan := NewFile("plan.pdf", 0644)
+	offer := NewFile("offer.pdf", 0644)
+	notes := NewDir("Notes", 0777)
+	require.NoError(t, db.SaveNode(ident, project, plan, offer, notes))
+	require.NoError(t, db.Tag(plan, house))
+	require.NoError(t, db.Tag(offer, house))
+	require.NoError(t, project.Add(db, house))
+	require.NoError(t, project.Add(db, ident))
+	require.NoError(t, project.Add(db, notes))
+	require.NoError(t, project.Add(db, plan))
+
+	tags, err := project.GetTags(db)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tags))
+	idents, err := project.GetIdentities(db)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(idents))
+	items, err := project.GetItems(db)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(items))
+	items, err = project.GetItems(db, NodeTypeFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(items))
+
+	offer.Name = "offer-v2.pdf"
+	require.NoError(t, db.SaveNode(offer))
+	activity, err := project.GetActivity(db, start, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(activity))
+	require.Equal(t, 4, activity[0].Changes)
+	activity, err = project.GetActivity(db, time.Now(), time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(activity))
+	_, err = project.GetActivity(db, start, 0)
+	require.Error(t, err)
+
+	require.NoError(t, project.Remove(db, notes))
+	items, err = project.GetItems(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(items))
+
+	// A sub-project counts as a tag of the project, and brings in its items.
+	roof := NewProject("Roof tiles")
+	tiles := NewFile("tiles.pdf", 0644)
+	require.NoError(t, db.SaveNode(roof, tiles))
+	require.NoError(t, roof.Add(db, tiles))
+	require.NoError(t, project.Add(db, roof))
+	tags, err = project.GetTags(db)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tags))
+	require.Equal(t, "Roof tiles", tags[1].Name)
+	items, err = project.GetItems(db)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(items))
+}
@@ -0,0 +1,38 @@
+package cymidb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	start := time.Date(2020, 1, 15, 10, 30, 0, 0, time.UTC)
+	for _, c := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2020, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 8 * * 6,7", time.Date(2020, 1, 18, 8, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2020, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */2 * 4", time.Date(2020, 1, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2020, 1, 15, 10, 31, 30, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := ParseSchedule(c.expr)
+		require.NoError(t, err, c.expr)
+		require.Equal(t, c.next, s.Next(start), c.expr)
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *",
+		"@every", "@every -1s", "a * * * *"} {
+		_, err := ParseSchedule(expr)
+		require.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,233 @@
+package cymidb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrAccessDenied is returned by the ScopedDB if the ACLs don't allow an operation.
+var ErrAccessDenied = errors.New("access denied")
+
+// ScopedDB gives access to the DB as a given identity. Reads only return the nodes the identity is allowed to read,
+// and writes are rejected if the ACLs don't allow them.
+// It is used for sync peers, friends and hooks, so they can only touch what they have been granted.
+type ScopedDB struct {
+	db       DB
+	identity NodeID
+	acl      ACLEvaluator
+	// created holds the nodes created through this view, which can be linked once without further rights.
+	created *sync.Map
+}
+
+// As returns a view of the DB for the given identity.
+func (db DB) As(identity NodeID) ScopedDB {
+	return ScopedDB{db: db, identity: identity, acl: NewACLEvaluator(db), created: &sync.Map{}}
+}
+
+// Identity returns the identity of this view.
+func (s ScopedDB) Identity() NodeID {
+	return s.identity
+}
+
+func (s ScopedDB) can(action ACLAction, id NodeID) error {
+	ok, err := s.acl.Can(s.identity, action, id)
+	if err != nil {
+		return fmt.Errorf("couldn't evaluate acl: %v", err)
+	}
+	if !ok {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// exists returns whether there is any version of the node in the DB.
+func (s ScopedDB) exists(id NodeID) (bool, error) {
+	versions, err := s.db.nodeVersions(id)
+	if err != nil {
+		return false, err
+	}
+	return len(versions) > 0, nil
+}
+
+// orphan returns whether the node is not linked from any other node, which is the case for new nodes.
+func (s ScopedDB) orphan(id NodeID) (bool, error) {
+	ancestors, err := s.db.GetAncestors(id)
+	if err != nil {
+		return false, err
+	}
+	return len(ancestors) == 0, nil
+}
+
+// filter returns only the nodes that can be read.
+func (s ScopedDB) filter(nodes []Node) (readable []Node, err error) {
+	for _, n := range nodes {
+		ok, err := s.acl.Can(s.identity, ACLRead, n.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't evaluate acl: %v", err)
+		}
+		if ok {
+			readable = append(readable, n)
+		}
+	}
+	return
+}
+
+// filterIDs returns only the ids of nodes that can be read.
+func (s ScopedDB) filterIDs(ids []NodeID) (readable []NodeID, err error) {
+	for _, id := range ids {
+		ok, err := s.acl.Can(s.identity, ACLRead, id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't evaluate acl: %v", err)
+		}
+		if ok {
+			readable = append(readable, id)
+		}
+	}
+	return
+}
+
+// SaveNode stores new versions of the nodes. Existing nodes can only be written with write rights. ACL nodes can
+// only be changed with admin rights on all the nodes they protect. New nodes can always be saved, but they are not
+// accessible until they're linked to a node.
+func (s ScopedDB) SaveNode(ns ...Noder) error {
+	var created []NodeID
+	for _, n := range ns {
+		node, err := n.GetNode()
+		if err != nil {
+			return fmt.Errorf("couldn't get node: %v", err)
+		}
+		exists, err := s.exists(node.NodeID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			created = append(created, node.NodeID)
+			continue
+		}
+		if node.Type == NodeACL {
+			protected, err := s.db.GetChildren(node.NodeID)
+			if err != nil {
+				return fmt.Errorf("couldn't get protected nodes: %v", err)
+			}
+			for _, p := range protected {
+				if err = s.can(ACLAdmin, p); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err = s.can(ACLWrite, node.NodeID); err != nil {
+			return err
+		}
+	}
+	for _, id := range created {
+		s.created.Store(string(id), true)
+	}
+	return s.db.SaveNode(ns...)
+}
+
+// AddLink links the two nodes. Linking an ACL to a node needs admin rights on the node. Else 'from' needs
+// write rights, and 'to' needs admin rights, unless it has been created through this view and is not linked yet.
+func (s ScopedDB) AddLink(from, to Noder) error {
+	fromNode, err := from.GetNode()
+	if err != nil {
+		return fmt.Errorf("couldn't get node 'from': %v", err)
+	}
+	toNode, err := to.GetNode()
+	if err != nil {
+		return fmt.Errorf("couldn't get node 'to': %v", err)
+	}
+	if fromNode.Type == NodeACL {
+		if err = s.can(ACLAdmin, toNode.NodeID); err != nil {
+			return err
+		}
+		return s.db.AddLink(from, to)
+	}
+	if err = s.can(ACLWrite, fromNode.NodeID); err != nil {
+		return err
+	}
+	if _, created := s.created.Load(string(toNode.NodeID)); created {
+		orphan, err := s.orphan(toNode.NodeID)
+		if err != nil {
+			return err
+		}
+		if orphan {
+			return s.db.AddLink(from, to)
+		}
+	}
+	if err = s.can(ACLAdmin, toNode.NodeID); err != nil {
+		return err
+	}
+	return s.db.AddLink(from, to)
+}
+
+// GetNodes returns the nodes given by the ids that can be read.
+func (s ScopedDB) GetNodes(ids []NodeID) (nodes []Node, err error) {
+	ids, err = s.filterIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetNodes(ids)
+}
+
+// GetLatest returns the latest version of the node, if it can be read.
+func (s ScopedDB) GetLatest(id NodeID) (n Node, err error) {
+	if err = s.can(ACLRead, id); err != nil {
+		return n, err
+	}
+	return s.db.GetLatest(id)
+}
+
+// GetNodeVersions returns all versions of the node, if it can be read.
+func (s ScopedDB) GetNodeVersions(id NodeID) (nodes []Node, err error) {
+	if err = s.can(ACLRead, id); err != nil {
+		return nil, err
+	}
+	return s.db.GetNodeVersions(id)
+}
+
+// GetNodesByType returns the latest version of all nodes of the given type that can be read.
+func (s ScopedDB) GetNodesByType(t NodeType) (nodes []Node, err error) {
+	nodes, err = s.db.GetNodesByType(t)
+	if err != nil {
+		return nil, err
+	}
+	return s.filter(nodes)
+}
+
+// GetChildren returns the ids of the children of the node that can be read.
+func (s ScopedDB) GetChildren(from NodeID) (children []NodeID, err error) {
+	children, err = s.db.GetChildren(from)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterIDs(children)
+}
+
+// GetChildrenNodes returns the children of the node that can be read.
+func (s ScopedDB) GetChildrenNodes(from NodeID) (children []Node, err error) {
+	ids, err := s.GetChildren(from)
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetNodes(ids)
+}
+
+// GetAncestors returns the ids of the ancestors of the node that can be read.
+func (s ScopedDB) GetAncestors(to NodeID) (ancestors []NodeID, err error) {
+	ancestors, err = s.db.GetAncestors(to)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterIDs(ancestors)
+}
+
+// GetAncestorsNodes returns the ancestors of the node that can be read.
+func (s ScopedDB) GetAncestorsNodes(to NodeID) (ancestors []Node, err error) {
+	ids, err := s.GetAncestors(to)
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetNodes(ids)
+}
@@ -0,0 +1,70 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_As(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "tmp", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	owner, err := NewIdentity("owner", nil)
+	require.NoError(t, err)
+	friend, err := NewIdentity("friend", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveNode(owner, friend))
+
+	root := NewDir("/", 0777)
+	shared := NewDir("Shared", 0777)
+	private := NewDir("Private", 0777)
+	require.NoError(t, db.SaveNode(root, shared, private))
+	require.NoError(t, root.AddSubdir(db, shared))
+	require.NoError(t, root.AddSubdir(db, private))
+	require.NoError(t, NewACL(owner.node.NodeID, ACLAdmin).Protect(db, root))
+	require.NoError(t, NewACL(friend.node.NodeID, ACLWrite).Protect(db, shared))
+
+	fdb := db.As(friend.node.NodeID)
+	children, err := fdb.GetChildren(root.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, []NodeID{shared.node.NodeID}, children)
+	nodes, err := fdb.GetNodes([]NodeID{root.node.NodeID, shared.node.NodeID, private.node.NodeID})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(nodes))
+	dirs, err := fdb.GetNodesByType(NodeTypeDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(dirs))
+	_, err = fdb.GetLatest(private.node.NodeID)
+	require.Equal(t, ErrAccessDenied, err)
+
+	// The friend can add new files to the shared directory, but not to the private one.
+	file := NewFile("file.txt", 0777)
+	require.NoError(t, fdb.SaveNode(file))
+	require.NoError(t, fdb.AddLink(shared, file))
+	file.Name = "renamed.txt"
+	require.NoError(t, fdb.SaveNode(file))
+	require.Equal(t, ErrAccessDenied, fdb.AddLink(private, file))
+	private.Name = "Hacked"
+	require.Equal(t, ErrAccessDenied, fdb.SaveNode(private))
+	// Linking an existing node needs admin rights on it, even if it is not linked anywhere.
+	require.Equal(t, ErrAccessDenied, fdb.AddLink(shared, private))
+	require.Equal(t, ErrAccessDenied, fdb.AddLink(shared, root))
+	top := NewDir("Top", 0777)
+	require.NoError(t, db.SaveNode(top))
+	require.Equal(t, ErrAccessDenied, fdb.AddLink(shared, top))
+	require.NoError(t, db.As(owner.node.NodeID).AddLink(shared, private))
+
+	// Only admins can change ACLs.
+	acl := NewACL(friend.node.NodeID, ACLRead)
+	require.NoError(t, fdb.SaveNode(acl))
+	require.Equal(t, ErrAccessDenied, fdb.AddLink(acl, root))
+	odb := db.As(owner.node.NodeID)
+	require.NoError(t, odb.AddLink(acl, private))
+	_, err = fdb.GetLatest(private.node.NodeID)
+	require.NoError(t, err)
+	acl.Actions = ACLAdmin
+	require.Equal(t, ErrAccessDenied, fdb.SaveNode(acl))
+	require.NoError(t, odb.SaveNode(acl))
+}
@@ -0,0 +1,202 @@
+package cymidb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SettingKind is the type of the value of a setting. All values are stored as strings.
+type SettingKind int
+
+const (
+	SettingString = SettingKind(iota)
+	SettingInt
+	SettingBool
+	SettingDuration
+	// SettingPath is an absolute path on the device.
+	SettingPath
+)
+
+// SettingSpec describes one setting of a hook module.
+type SettingSpec struct {
+	Name        string
+	Kind        SettingKind
+	Description string
+	// Default is used if the setting is not set.
+	Default  string
+	Required bool
+	// PerDevice settings can have a different value on every device the hook runs on.
+	PerDevice bool
+}
+
+// SettingsSchema holds all settings of a hook module.
+type SettingsSchema []SettingSpec
+
+// Settings are the values of the settings of a hook on one device.
+type Settings map[string]string
+
+var hookSchemas = struct {
+	sync.Mutex
+	schemas map[string]SettingsSchema
+}{schemas: map[string]SettingsSchema{}}
+
+// RegisterHookSettings registers the schema of the settings of the hook module. Hooks of this module only accept
+// the settings of the schema, and are not started if a setting is invalid.
+func RegisterHookSettings(module string, schema SettingsSchema) {
+	hookSchemas.Lock()
+	defer hookSchemas.Unlock()
+	hookSchemas.schemas[module] = schema
+}
+
+// HookSettingsSchema returns the schema registered for the module, or nil.
+func HookSettingsSchema(module string) SettingsSchema {
+	hookSchemas.Lock()
+	defer hookSchemas.Unlock()
+	return hookSchemas.schemas[module]
+}
+
+func (s SettingsSchema) spec(name string) (SettingSpec, bool) {
+	for _, spec := range s {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return SettingSpec{}, false
+}
+
+// check returns an error if the value is not valid for the setting.
+func (spec SettingSpec) check(value string) (err error) {
+	switch spec.Kind {
+	case SettingInt:
+		_, err = strconv.Atoi(value)
+	case SettingBool:
+		_, err = strconv.ParseBool(value)
+	case SettingDuration:
+		_, err = time.ParseDuration(value)
+	case SettingPath:
+		if !filepath.IsAbs(value) {
+			err = fmt.Errorf("'%s' is not an absolute path", value)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid setting %s: %v", spec.Name, err)
+	}
+	return nil
+}
+
+// SetSetting sets the setting for all devices. Settings of modules with a schema are checked.
+func (h *Hook) SetSetting(name, value string) error {
+	if schema := HookSettingsSchema(h.Module); schema != nil {
+		spec, ok := schema.spec(name)
+		if !ok {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if err := spec.check(value); err != nil {
+			return err
+		}
+	}
+	if h.Config == nil {
+		h.Config = map[string]string{}
+	}
+	h.Config[name] = value
+	return nil
+}
+
+// SetDeviceSetting sets the setting for one device, overriding the value for all devices. Only settings declared
+// as PerDevice can be set per device.
+func (h *Hook) SetDeviceSetting(device NodeID, name, value string) error {
+	if schema := HookSettingsSchema(h.Module); schema != nil {
+		spec, ok := schema.spec(name)
+		if !ok {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if !spec.PerDevice {
+			return fmt.Errorf("setting %s cannot be set per device", name)
+		}
+		if err := spec.check(value); err != nil {
+			return err
+		}
+	}
+	if h.DeviceConfig == nil {
+		h.DeviceConfig = map[string]map[string]string{}
+	}
+	dev := hex.EncodeToString(device)
+	if h.DeviceConfig[dev] == nil {
+		h.DeviceConfig[dev] = map[string]string{}
+	}
+	h.DeviceConfig[dev][name] = value
+	return nil
+}
+
+// Settings returns the settings of the hook on the device: the defaults of the schema, overridden by the settings
+// for all devices, overridden by the settings for the device. If the module has a schema, the settings are
+// validated.
+func (h Hook) Settings(device NodeID) (Settings, error) {
+	schema := HookSettingsSchema(h.Module)
+	s := Settings{}
+	for _, spec := range schema {
+		if spec.Default != "" {
+			s[spec.Name] = spec.Default
+		}
+	}
+	for k, v := range h.Config {
+		s[k] = v
+	}
+	for k, v := range h.DeviceConfig[hex.EncodeToString(device)] {
+		s[k] = v
+	}
+	if schema == nil {
+		return s, nil
+	}
+	for _, spec := range schema {
+		v, ok := s[spec.Name]
+		if !ok {
+			if spec.Required {
+				return nil, fmt.Errorf("missing setting %s", spec.Name)
+			}
+			continue
+		}
+		if err := spec.check(v); err != nil {
+			return nil, err
+		}
+	}
+	var unknown []string
+	for k := range s {
+		if _, ok := schema.spec(k); !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown settings %v", unknown)
+	}
+	return s, nil
+}
+
+// String returns the value of the setting.
+func (s Settings) String(name string) string {
+	return s[name]
+}
+
+// Int returns the value of the setting, or 0 if it is not set.
+func (s Settings) Int(name string) int {
+	i, _ := strconv.Atoi(s[name])
+	return i
+}
+
+// Bool returns the value of the setting, or false if it is not set.
+func (s Settings) Bool(name string) bool {
+	b, _ := strconv.ParseBool(s[name])
+	return b
+}
+
+// Duration returns the value of the setting, or 0 if it is not set.
+func (s Settings) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(s[name])
+	return d
+}
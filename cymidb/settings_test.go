@@ -0,0 +1,66 @@
+package cymidb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHook_Settings(t *testing.T) {
+	RegisterHookSettings("settings", SettingsSchema{
+		{Name: "root", Kind: SettingPath, Required: true, PerDevice: true},
+		{Name: "interval", Kind: SettingDuration, Default: "1m"},
+		{Name: "depth", Kind: SettingInt},
+		{Name: "verbose", Kind: SettingBool},
+	})
+	laptop, server := RandomNodeID(), RandomNodeID()
+	h := NewHook("settings", []NodeID{laptop, server}, nil)
+	h.Module = "settings"
+
+	_, err := h.Settings(laptop)
+	require.Error(t, err)
+	require.NoError(t, h.SetSetting("root", "/home/user"))
+	require.NoError(t, h.SetDeviceSetting(server, "root", "/srv/data"))
+	require.NoError(t, h.SetSetting("depth", "3"))
+	require.Error(t, h.SetSetting("depth", "deep"))
+	require.Error(t, h.SetSetting("unknown", ""))
+	require.Error(t, h.SetDeviceSetting(server, "depth", "4"))
+	require.Error(t, h.SetSetting("root", "home"))
+
+	// Settings survive saving and are validated on load.
+	n, err := h.GetNode()
+	require.NoError(t, err)
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	h, err = NewHookFromNode(db, n)
+	require.NoError(t, err)
+	s, err := h.Settings(laptop)
+	require.NoError(t, err)
+	require.Equal(t, "/home/user", s.String("root"))
+	require.Equal(t, time.Minute, s.Duration("interval"))
+	require.Equal(t, 3, s.Int("depth"))
+	require.False(t, s.Bool("verbose"))
+	s, err = h.Settings(server)
+	require.NoError(t, err)
+	require.Equal(t, "/srv/data", s.String("root"))
+
+	h.Config["depth"] = "deep"
+	_, err = h.Settings(laptop)
+	require.Error(t, err)
+
+	// Hooks with invalid settings are not started.
+	running := &sync.Map{}
+	RegisterHookModule("settings", func(hdb HookDB) (HookModule, error) {
+		return testModule{name: hdb.Hook().Name, running: running}, nil
+	})
+	invalid := NewHook("invalid", []NodeID{db.Device.node.NodeID}, nil)
+	invalid.Module = "settings"
+	require.NoError(t, db.SaveNode(invalid))
+	require.Eventually(t, func() bool { return db.Hooks().Error(invalid.node.NodeID) != nil }, time.Second,
+		10*time.Millisecond)
+	_, ok := running.Load("invalid")
+	require.False(t, ok)
+}
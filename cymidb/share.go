@@ -0,0 +1,276 @@
+package cymidb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Share gives the principal, an identity or a group, access to the node and the whole subgraph below it.
+// A new content key is wrapped for the active device and all identities of the principal, and all nodes of the
+// subgraph that are encrypted with a subgraph content key are encrypted again with this new key. Nodes that are
+// already shared with another content key are encrypted again with a new key for the recipients of their key and
+// the principal, as the other key can be used outside of the subgraph, too. Finally an ACL gives the principal the
+// actions on the node.
+// Nodes linked to the subgraph later on are encrypted with the new key, too.
+func (db DB) Share(root Noder, principal NodeID, actions ACLAction) (ck ContentKey, err error) {
+	rootNode, err := root.GetNode()
+	if err != nil {
+		return ck, fmt.Errorf("couldn't get root: %v", err)
+	}
+	ck, err = NewContentKey()
+	if err != nil {
+		return ck, err
+	}
+	if err = ck.AddRecipient(db.Device.node.NodeID, db.Device.BoxKey); err != nil {
+		return ck, fmt.Errorf("couldn't wrap key for device: %v", err)
+	}
+	if err = db.shareContentKey(&ck, principal); err != nil {
+		return ck, err
+	}
+	if err = db.SaveNode(ck); err != nil {
+		return ck, fmt.Errorf("couldn't save content key: %v", err)
+	}
+
+	ids, err := db.subgraph(rootNode.NodeID)
+	if err != nil {
+		return ck, err
+	}
+	// others maps the other content keys found in the subgraph to the keys replacing them.
+	others := map[string]NodeID{}
+	for _, id := range ids {
+		n, err := db.getLatest(id)
+		if err != nil {
+			return ck, fmt.Errorf("couldn't get node: %v", err)
+		}
+		if !n.Type.Encrypted() {
+			continue
+		}
+		if db.isSubgraphContentKey(n.KeyID) {
+			if err = db.reencryptNode(id, ck.node.NodeID); err != nil {
+				return ck, err
+			}
+			continue
+		}
+		if others[string(n.KeyID)] == nil {
+			if others[string(n.KeyID)], err = db.extendContentKey(n.KeyID, principal); err != nil {
+				return ck, err
+			}
+		}
+		if err = db.reencryptNode(id, others[string(n.KeyID)]); err != nil {
+			return ck, err
+		}
+	}
+
+	if err = NewACL(principal, actions).Protect(db, root); err != nil {
+		return ck, fmt.Errorf("couldn't add acl: %v", err)
+	}
+	return ck, nil
+}
+
+// extendContentKey creates and saves a new content key for all recipients and groups of the other key and for the
+// principal, and returns its id.
+func (db DB) extendContentKey(other, principal NodeID) (NodeID, error) {
+	old, err := db.GetContentKey(other)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get content key: %v", err)
+	}
+	ck, err := NewContentKey()
+	if err != nil {
+		return nil, err
+	}
+	ck.Groups = append([]NodeID{}, old.Groups...)
+	for _, e := range old.Envelopes {
+		if err = db.wrapFor(&ck, e.Recipient); err != nil {
+			return nil, err
+		}
+	}
+	if err = db.shareContentKey(&ck, principal); err != nil {
+		return nil, err
+	}
+	if err = db.SaveNode(ck); err != nil {
+		return nil, fmt.Errorf("couldn't save content key: %v", err)
+	}
+	return ck.node.NodeID, nil
+}
+
+// shareContentKey wraps the content key for all identities of the principal. If the principal is a group, it is
+// remembered in the key, so that later changes of its members are applied to the key.
+func (db DB) shareContentKey(ck *ContentKey, principal NodeID) error {
+	if db.isGroup(principal) {
+		found := false
+		for _, g := range ck.Groups {
+			found = found || bytes.Compare(g, principal) == 0
+		}
+		if !found {
+			ck.Groups = append(ck.Groups, principal)
+		}
+	}
+	return db.wrapFor(ck, principal)
+}
+
+// ExportShared returns a bundle with the latest version of all nodes the identity can read through the ACLs that
+// allow it or one of its groups access, together with the content keys, ACLs and devices needed to verify and decrypt them.
+// Nothing else of the DB is part of the bundle.
+func (db DB) ExportShared(identity NodeID) (b Bundle, err error) {
+	acl := NewACLEvaluator(db)
+	acls, err := db.GetNodesByType(NodeACL)
+	if err != nil {
+		return b, fmt.Errorf("couldn't get acls: %v", err)
+	}
+	included := map[string]bool{}
+	var ids []NodeID
+	include := func(id NodeID) {
+		if !included[string(id)] {
+			included[string(id)] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, an := range acls {
+		a, err := NewACLFromNode(an)
+		if err != nil {
+			return b, err
+		}
+		if a.Deny {
+			continue
+		}
+		match, err := acl.matches(a.Principal, identity)
+		if err != nil {
+			return b, err
+		}
+		if !match {
+			continue
+		}
+		if db.isGroup(a.Principal) {
+			// The groups and their members are needed to evaluate the ACL.
+			groups, identities, err := db.expandGroup(a.Principal)
+			if err != nil {
+				return b, err
+			}
+			for _, id := range append(groups, identities...) {
+				include(id)
+			}
+		}
+		roots, err := db.GetChildren(an.NodeID)
+		if err != nil {
+			return b, fmt.Errorf("couldn't get protected nodes: %v", err)
+		}
+		for _, root := range roots {
+			sub, err := db.subgraph(root)
+			if err != nil {
+				return b, err
+			}
+			for _, id := range sub {
+				can, err := acl.Can(identity, ACLRead, id)
+				if err != nil {
+					return b, err
+				}
+				if can {
+					include(an.NodeID)
+					include(id)
+				}
+			}
+		}
+	}
+
+	for _, id := range ids {
+		var links []Link
+		if err = db.gdb.Find(&links, &Link{From: id}).Error; err != nil {
+			return b, fmt.Errorf("couldn't get links: %v", err)
+		}
+		for _, l := range links {
+			if included[string(l.To)] {
+				b.Links = append(b.Links, l)
+			}
+		}
+	}
+	for _, id := range append([]NodeID{}, ids...) {
+		n, err := db.getLatest(id)
+		if err != nil {
+			return b, fmt.Errorf("couldn't get node: %v", err)
+		}
+		if len(n.KeyID) > 0 {
+			include(n.KeyID)
+		}
+	}
+	nodes, err := db.ExportNodes(ids...)
+	if err != nil {
+		return b, err
+	}
+	b.Nodes = nodes.Nodes
+	return b, nil
+}
+
+// ExportNodes returns a bundle with the latest version of the given nodes, and the devices needed to verify them.
+// This is used to send an identity to a friend.
+func (db DB) ExportNodes(ids ...NodeID) (b Bundle, err error) {
+	exported := map[string]bool{}
+	var signers []NodeID
+	for _, id := range ids {
+		if exported[string(id)] {
+			continue
+		}
+		n, err := db.getLatest(id)
+		if err != nil {
+			return b, fmt.Errorf("couldn't get node %x: %v", id, err)
+		}
+		exported[string(id)] = true
+		b.Nodes = append(b.Nodes, n)
+		signers = append(signers, n.Signer)
+	}
+	var devices []Node
+	for _, id := range signers {
+		if exported[string(id)] {
+			continue
+		}
+		n, err := db.getLatest(id)
+		if err != nil {
+			return b, fmt.Errorf("couldn't get signer %x: %v", id, err)
+		}
+		exported[string(id)] = true
+		devices = append(devices, n)
+	}
+	// Devices first, so they're available to verify the other nodes.
+	b.Nodes = append(devices, b.Nodes...)
+	return
+}
+
+// subgraph returns the ids of the node and all its descendants.
+func (db DB) subgraph(root NodeID) (ids []NodeID, err error) {
+	visited := map[string]bool{string(root): true}
+	ids = []NodeID{root}
+	for i := 0; i < len(ids); i++ {
+		children, err := db.GetChildren(ids[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get children: %v", err)
+		}
+		for _, c := range children {
+			if !visited[string(c)] {
+				visited[string(c)] = true
+				ids = append(ids, c)
+			}
+		}
+	}
+	return
+}
+
+// inSubgraph returns true if the node is the root or one of its descendants.
+func (db DB) inSubgraph(root, id NodeID) (bool, error) {
+	visited := map[string]bool{string(id): true}
+	ids := []NodeID{id}
+	for i := 0; i < len(ids); i++ {
+		if bytes.Compare(ids[i], root) == 0 {
+			return true, nil
+		}
+		ancestors, err := db.GetAncestors(ids[i])
+		if err != nil {
+			return false, fmt.Errorf("couldn't get ancestors: %v", err)
+		}
+		for _, a := range ancestors {
+			if !visited[string(a)] {
+				visited[string(a)] = true
+				ids = append(ids, a)
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,106 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Share(t *testing.T) {
+	alice, err := CreateDBFile(":memory:", "alice", "")
+	require.NoError(t, err)
+	defer alice.Close()
+	bob, err := CreateDBFile(":memory:", "bob", "")
+	require.NoError(t, err)
+	defer bob.Close()
+
+	// Bob sends his identity to Alice.
+	bobIdent, err := NewIdentity("bob", nil)
+	require.NoError(t, err)
+	require.NoError(t, bob.SaveNode(bobIdent))
+	b, err := bob.ExportNodes(bobIdent.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, alice.Import(b))
+	n, err := alice.GetLatest(bobIdent.node.NodeID)
+	require.NoError(t, err)
+	friend, err := NewIdentityFromNode(n)
+	require.NoError(t, err)
+
+	project := NewDir("Project", 0777)
+	private := NewDir("Private", 0777)
+	require.NoError(t, alice.SaveNode(project, private))
+	file := NewFile("plan.txt", 0644)
+	plan := NewFileData([]byte("the plan"))
+	require.NoError(t, alice.SaveNode(file, plan))
+	require.NoError(t, project.AddFile(alice, file))
+	require.NoError(t, file.AddData(alice, plan))
+	secret := NewFileData([]byte("private"))
+	require.NoError(t, alice.SaveNode(secret))
+	require.NoError(t, alice.AddLink(private, secret))
+
+	ck, err := alice.Share(project, friend.node.NodeID, ACLRead)
+	require.NoError(t, err)
+	raw, err := alice.getLatest(plan.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, ck.node.NodeID, raw.KeyID)
+	raw, err = alice.getLatest(secret.node.NodeID)
+	require.NoError(t, err)
+	require.NotEqual(t, ck.node.NodeID, raw.KeyID)
+
+	// Data added to the shared subgraph after sharing uses the shared key.
+	later := NewFileData([]byte("added later"))
+	require.NoError(t, alice.SaveNode(later))
+	require.NoError(t, file.AddData(alice, later))
+	raw, err = alice.getLatest(later.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, ck.node.NodeID, raw.KeyID)
+
+	b, err = alice.ExportShared(bobIdent.node.NodeID)
+	require.NoError(t, err)
+	require.NoError(t, bob.Import(b))
+	_, err = bob.GetLatest(private.node.NodeID)
+	require.Error(t, err)
+	files, err := project.GetFiles(bob)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+	for _, fd := range []FileData{plan, later} {
+		n, err = bob.GetLatest(fd.node.NodeID)
+		require.NoError(t, err)
+		fd2, err := NewFileDataFromNode(n)
+		require.NoError(t, err)
+		require.Equal(t, fd.Data, fd2.Data)
+	}
+
+	// Even with all nodes of Alice, Bob can only decrypt the shared ones.
+	b, err = alice.Export()
+	require.NoError(t, err)
+	require.NoError(t, bob.Import(b))
+	_, err = bob.GetLatest(secret.node.NodeID)
+	require.Error(t, err)
+	_, err = bob.GetLatest(plan.node.NodeID)
+	require.NoError(t, err)
+
+	// Sharing a subgraph holding nodes of another share uses a new key for both principals, and doesn't give the
+	// new principal the other key.
+	carol, err := NewIdentity("carol", nil)
+	require.NoError(t, err)
+	require.NoError(t, alice.SaveNode(carol))
+	team := NewDir("Team", 0777)
+	require.NoError(t, alice.SaveNode(team))
+	require.NoError(t, alice.AddLink(team, file))
+	_, err = alice.Share(team, carol.node.NodeID, ACLRead)
+	require.NoError(t, err)
+	raw, err = alice.getLatest(plan.node.NodeID)
+	require.NoError(t, err)
+	require.NotEqual(t, ck.node.NodeID, raw.KeyID)
+	extended, err := alice.GetContentKey(raw.KeyID)
+	require.NoError(t, err)
+	require.True(t, extended.HasRecipient(carol.node.NodeID))
+	require.True(t, extended.HasRecipient(bobIdent.node.NodeID))
+	ck, err = alice.GetContentKey(ck.node.NodeID)
+	require.NoError(t, err)
+	require.False(t, ck.HasRecipient(carol.node.NodeID))
+	raw, err = alice.getLatest(project.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, ck.node.NodeID, raw.KeyID)
+}
@@ -0,0 +1,122 @@
+package cymidb
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The pairing code is too short to be used as a key directly, as an attacker who sees the messages could try all
+// codes offline. SPAKE2 (RFC 9382) over P-256 derives a strong key from the code: an attacker can only test one
+// code per exchange, by taking part in it.
+
+// spake2M and spake2N are the fixed points of RFC 9382 for P-256, whose discrete logs are unknown.
+var (
+	spake2M = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spake2N = mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+type point struct {
+	x, y *big.Int
+}
+
+func mustPoint(s string) point {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), buf)
+	if x == nil {
+		panic("invalid point")
+	}
+	return point{x, y}
+}
+
+// spake2 is one side of a SPAKE2 exchange. The new device uses M, the existing device uses N.
+type spake2 struct {
+	newDevice bool
+	w         *big.Int
+	x         []byte
+	share     []byte
+	// own and other are the blinding points of this side and the other side.
+	own, other point
+}
+
+// pairingKeys are the keys derived from a SPAKE2 exchange.
+type pairingKeys struct {
+	// encryption encrypts the data sent to the new device.
+	encryption [32]byte
+	// confirmNew and confirmExisting are the MACs each side sends to prove it knows the code.
+	confirmNew      []byte
+	confirmExisting []byte
+}
+
+// newSpake2 starts an exchange for the code. If newDevice is true, it is the side of the new device.
+func newSpake2(code string, newDevice bool) (s spake2, err error) {
+	curve := elliptic.P256()
+	h := hmac.New(sha256.New, []byte("cymidb pairing"))
+	h.Write([]byte(code))
+	s.w = new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), curve.Params().N)
+	s.newDevice = newDevice
+	s.own, s.other = spake2N, spake2M
+	if newDevice {
+		s.own, s.other = spake2M, spake2N
+	}
+	var px, py *big.Int
+	s.x, px, py, err = elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return s, fmt.Errorf("couldn't create key: %v", err)
+	}
+	bx, by := curve.ScalarMult(s.own.x, s.own.y, s.w.Bytes())
+	px, py = curve.Add(px, py, bx, by)
+	s.share = elliptic.Marshal(curve, px, py)
+	return
+}
+
+// finish computes the keys from the share of the other side. The transcript holds the messages both sides have
+// seen, so the keys differ if one of them has been changed.
+func (s spake2) finish(other []byte, transcript ...[]byte) (keys pairingKeys, err error) {
+	curve := elliptic.P256()
+	ox, oy := elliptic.Unmarshal(curve, other)
+	if ox == nil {
+		return keys, errors.New("invalid share")
+	}
+	bx, by := curve.ScalarMult(s.other.x, s.other.y, s.w.Bytes())
+	by.Sub(curve.Params().P, by)
+	kx, ky := curve.Add(ox, oy, bx, by)
+	kx, ky = curve.ScalarMult(kx, ky, s.x)
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return keys, errors.New("invalid share")
+	}
+	shareNew, shareExisting := s.share, other
+	if !s.newDevice {
+		shareNew, shareExisting = other, s.share
+	}
+	h := sha256.New()
+	parts := append(transcript, shareNew, shareExisting, elliptic.Marshal(curve, kx, ky), s.w.Bytes())
+	for _, p := range parts {
+		_ = binary.Write(h, binary.LittleEndian, uint64(len(p)))
+		h.Write(p)
+	}
+	tt := h.Sum(nil)
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, tt)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	copy(keys.encryption[:], derive("encryption"))
+	confirm := func(label string) []byte {
+		mac := hmac.New(sha256.New, derive(label))
+		mac.Write(tt)
+		return mac.Sum(nil)
+	}
+	keys.confirmNew = confirm("confirm new device")
+	keys.confirmExisting = confirm("confirm existing device")
+	return
+}
@@ -0,0 +1,33 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpake2(t *testing.T) {
+	exchange := func(codeNew, codeExisting string) (pairingKeys, pairingKeys) {
+		a, err := newSpake2(codeNew, true)
+		require.NoError(t, err)
+		b, err := newSpake2(codeExisting, false)
+		require.NoError(t, err)
+		ka, err := a.finish(b.share, []byte("device"))
+		require.NoError(t, err)
+		kb, err := b.finish(a.share, []byte("device"))
+		require.NoError(t, err)
+		return ka, kb
+	}
+	ka, kb := exchange("ABCD2345", "ABCD2345")
+	require.Equal(t, ka, kb)
+	require.NotEqual(t, ka.confirmNew, ka.confirmExisting)
+
+	ka, kb = exchange("ABCD2345", "ABCD2346")
+	require.NotEqual(t, ka.encryption, kb.encryption)
+	require.NotEqual(t, ka.confirmNew, kb.confirmNew)
+
+	a, err := newSpake2("ABCD2345", true)
+	require.NoError(t, err)
+	_, err = a.finish([]byte("not a point"))
+	require.Error(t, err)
+}
@@ -0,0 +1,374 @@
+package cymidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Tag is a label that can be added to any number of nodes. The tag is linked to all the nodes it tags.
+// A tag can have parent tags, which are linked to it: the nodes tagged with a tag are also tagged with its parents.
+type Tag struct {
+	Name        string
+	Description string
+	// Color is an optional colour for showing the tag, like "#ff8800".
+	Color string
+	// Aliases are other names of the tag, like synonyms. They are unique for the owner, like the names.
+	Aliases []string
+	// Owner is the identity that created the tag. The names of the tags of one owner are unique.
+	Owner NodeID
+	// MergedInto is set if this tag has been merged into another tag, and is not used anymore.
+	MergedInto NodeID
+	node       Node
+}
+
+// ErrTagExists is returned when a tag with the same name already exists for the owner.
+var ErrTagExists = errors.New("tag with this name already exists")
+
+func NewTagFromNode(n Node) (t Tag, err error) {
+	err = n.DecodeNodeType(NodeTag, &t)
+	if err != nil {
+		return t, fmt.Errorf("couldn't decode tag: %v", err)
+	}
+	t.node = n
+	return
+}
+
+// NewTag returns a new tag. Use DB.CreateTag to make sure the name is unique for the owner.
+func NewTag(name string, owner NodeID) (t Tag) {
+	t.node = NewNode(NodeTag)
+	t.Name = name
+	t.Owner = owner
+	return
+}
+
+func (t Tag) GetNode() (Node, error) {
+	err := t.node.EncodeData(&t)
+	return t.node, err
+}
+
+// CreateTag creates and saves a new tag for the owner. If the owner already has a tag with this name,
+// ErrTagExists is returned. Names are compared case-insensitively.
+func (db DB) CreateTag(name string, owner NodeID) (t Tag, err error) {
+	if _, err = db.FindTag(name, owner); err == nil {
+		return t, ErrTagExists
+	}
+	t = NewTag(name, owner)
+	if err = db.SaveNode(t); err != nil {
+		return t, fmt.Errorf("couldn't save tag: %v", err)
+	}
+	return
+}
+
+// HasName returns true if the name or one of the aliases of the tag is equal to name, ignoring the case.
+func (t Tag) HasName(name string) bool {
+	if strings.EqualFold(t.Name, name) {
+		return true
+	}
+	for _, a := range t.Aliases {
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddAlias adds another name to the tag and saves it, if the owner has no other tag with this name.
+func (t *Tag) AddAlias(db DB, alias string) error {
+	if t.HasName(alias) {
+		return nil
+	}
+	if _, err := db.FindTag(alias, t.Owner); err == nil {
+		return ErrTagExists
+	}
+	t.Aliases = append(t.Aliases, alias)
+	return db.SaveNode(t)
+}
+
+// AddParent makes the parent tag include all nodes tagged with this tag. Loops between tags are refused.
+func (t Tag) AddParent(db DB, parent Tag) error {
+	subtags, err := db.subtags(t.node.NodeID)
+	if err != nil {
+		return err
+	}
+	for _, id := range subtags {
+		if bytes.Compare(id, parent.node.NodeID) == 0 {
+			return errors.New("parent tag is already a sub-tag of this tag")
+		}
+	}
+	return db.AddLink(parent, t)
+}
+
+// RemoveParent removes the parent tag from this tag.
+func (t Tag) RemoveParent(db DB, parent Tag) error {
+	return db.RemoveLink(parent, t)
+}
+
+// Rename changes the name of the tag and saves it, if the owner has no other tag with this name.
+func (t *Tag) Rename(db DB, name string) error {
+	if other, err := db.FindTag(name, t.Owner); err == nil && bytes.Compare(other.node.NodeID, t.node.NodeID) != 0 {
+		return ErrTagExists
+	}
+	t.Name = name
+	return db.SaveNode(t)
+}
+
+// FindTag returns the tag of the owner with the given name or alias. Merged tags are ignored.
+func (db DB) FindTag(name string, owner NodeID) (t Tag, err error) {
+	tags, err := db.GetAllTags()
+	if err != nil {
+		return t, err
+	}
+	for _, t := range tags {
+		if bytes.Compare(t.Owner, owner) == 0 && t.MergedInto == nil && t.HasName(name) {
+			return t, nil
+		}
+	}
+	return t, errors.New("no tag with this name")
+}
+
+// GetAllTags returns all tags of the DB.
+func (db DB) GetAllTags() (tags []Tag, err error) {
+	nodes, err := db.GetNodesByType(NodeTag)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get tags: %v", err)
+	}
+	return tagsFromNodes(nodes)
+}
+
+// Tag adds the tag to the node. If the tag has been merged, the tag it has been merged into is added.
+func (db DB) Tag(n Noder, t Tag) error {
+	t, err := db.resolveTag(t)
+	if err != nil {
+		return err
+	}
+	return db.AddLink(t, n)
+}
+
+// resolveTag follows the merges of the tag and returns the tag that is still in use.
+func (db DB) resolveTag(t Tag) (Tag, error) {
+	visited := map[string]bool{}
+	for t.MergedInto != nil && !visited[string(t.node.NodeID)] {
+		visited[string(t.node.NodeID)] = true
+		n, err := db.GetLatest(t.MergedInto)
+		if err != nil {
+			return t, fmt.Errorf("couldn't get merged tag: %v", err)
+		}
+		if t, err = NewTagFromNode(n); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// Untag removes the tag from the node.
+func (db DB) Untag(n Noder, t Tag) error {
+	return db.RemoveLink(t, n)
+}
+
+// GetTags returns the tags of the node, without their parent tags.
+func (db DB) GetTags(id NodeID) (tags []Tag, err error) {
+	nodes, err := db.GetAncestorsNodes(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get ancestors: %v", err)
+	}
+	var tagNodes []Node
+	for _, n := range nodes {
+		if n.Type == NodeTag {
+			tagNodes = append(tagNodes, n)
+		}
+	}
+	return tagsFromNodes(tagNodes)
+}
+
+// GetTagged returns all nodes tagged with the tag or one of its sub-tags. If types are given, only nodes of these
+// types are returned. A general type like NodeBlob includes all its sub-types.
+func (db DB) GetTagged(tag NodeID, types ...NodeType) (nodes []Node, err error) {
+	subtags, err := db.subtags(tag)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, st := range subtags {
+		children, err := db.GetChildrenNodes(st)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get tagged nodes: %v", err)
+		}
+		for _, n := range children {
+			if n.Type == NodeTag || seen[string(n.NodeID)] || !n.Type.Matches(types) {
+				continue
+			}
+			seen[string(n.NodeID)] = true
+			nodes = append(nodes, n)
+		}
+	}
+	return
+}
+
+// Matches returns true if the type is one of the types, or a sub-type of one of the general types.
+// If no types are given, all types match.
+func (nt NodeType) Matches(types []NodeType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if nt == t || (t.Base() == t && nt.Base() == t) {
+			return true
+		}
+	}
+	return false
+}
+
+// subtags returns the tag and all tags below it.
+func (db DB) subtags(tag NodeID) (tags []NodeID, err error) {
+	visited := map[string]bool{string(tag): true}
+	tags = []NodeID{tag}
+	for i := 0; i < len(tags); i++ {
+		children, err := db.GetChildren(tags[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get children: %v", err)
+		}
+		for _, c := range children {
+			if visited[string(c)] {
+				continue
+			}
+			if n, err := db.getLatest(c); err == nil && n.Type == NodeTag {
+				visited[string(c)] = true
+				tags = append(tags, c)
+			}
+		}
+	}
+	return
+}
+
+// MergeTags folds the tag 'from' into 'into': all nodes and sub-tags of 'from' are linked to 'into', the parents
+// of 'from' become parents of 'into', and the name and aliases of 'from' become aliases of 'into'. The links of
+// 'from' are removed, and 'from' is kept with MergedInto pointing to 'into', so the history is preserved. The moved
+// links keep their Origin. A merge that would make a tag its own sub-tag is rejected.
+func (db DB) MergeTags(from Tag, into *Tag) error {
+	fromID, intoID := from.node.NodeID, into.node.NodeID
+	if bytes.Compare(fromID, intoID) == 0 {
+		return errors.New("cannot merge a tag into itself")
+	}
+	loop, err := db.mergeLoops(fromID, intoID)
+	if err != nil {
+		return err
+	}
+	if loop {
+		return errors.New("merging these tags would make a tag its own sub-tag")
+	}
+	var children []Link
+	if err = db.gdb.Find(&children, &Link{From: fromID}).Error; err != nil {
+		return fmt.Errorf("couldn't get tagged nodes: %v", err)
+	}
+	for _, l := range children {
+		if bytes.Compare(l.To, intoID) != 0 {
+			if err = db.ensureLink(intoID, l.To, l.Origin); err != nil {
+				return err
+			}
+			if err = db.inheritContentKey(intoID, l.To); err != nil {
+				return err
+			}
+		}
+		if err = db.removeLinks(Link{From: l.From, To: l.To}); err != nil {
+			return err
+		}
+	}
+	var parents []Link
+	if err = db.gdb.Find(&parents, &Link{To: fromID}).Error; err != nil {
+		return fmt.Errorf("couldn't get parent tags: %v", err)
+	}
+	for _, l := range parents {
+		if p, err := db.getLatest(l.From); err != nil || !p.Type.Matches([]NodeType{NodeTag}) {
+			continue
+		}
+		if bytes.Compare(l.From, intoID) != 0 {
+			if err = db.ensureLink(l.From, intoID, l.Origin); err != nil {
+				return err
+			}
+			if err = db.inheritContentKey(l.From, intoID); err != nil {
+				return err
+			}
+		}
+		if err = db.removeLinks(Link{From: l.From, To: l.To}); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range append([]string{from.Name}, from.Aliases...) {
+		if !into.HasName(name) {
+			into.Aliases = append(into.Aliases, name)
+		}
+	}
+	if err = db.SaveNode(into); err != nil {
+		return fmt.Errorf("couldn't save tag: %v", err)
+	}
+	from.MergedInto = into.node.NodeID
+	if err = db.SaveNode(from); err != nil {
+		return fmt.Errorf("couldn't save merged tag: %v", err)
+	}
+	return nil
+}
+
+// mergeLoops returns true if merging the two tags would create a loop, that is if a sub-tag of one of them, other
+// than the tags themselves, has one of them as a sub-tag.
+func (db DB) mergeLoops(from, into NodeID) (bool, error) {
+	merged := func(id NodeID) bool {
+		return bytes.Compare(id, from) == 0 || bytes.Compare(id, into) == 0
+	}
+	visited := map[string]bool{}
+	var tags []NodeID
+	for _, start := range []NodeID{from, into} {
+		children, err := db.GetChildren(start)
+		if err != nil {
+			return false, fmt.Errorf("couldn't get children: %v", err)
+		}
+		for _, c := range children {
+			if !merged(c) && !visited[string(c)] {
+				visited[string(c)] = true
+				tags = append(tags, c)
+			}
+		}
+	}
+	for i := 0; i < len(tags); i++ {
+		children, err := db.GetChildren(tags[i])
+		if err != nil {
+			return false, fmt.Errorf("couldn't get children: %v", err)
+		}
+		for _, c := range children {
+			if merged(c) {
+				return true, nil
+			}
+			if visited[string(c)] {
+				continue
+			}
+			if n, err := db.getLatest(c); err == nil && n.Type.Matches([]NodeType{NodeTag}) {
+				visited[string(c)] = true
+				tags = append(tags, c)
+			}
+		}
+	}
+	return false, nil
+}
+
+func tagsFromNodes(nodes []Node) (tags []Tag, err error) {
+	for _, n := range nodes {
+		t, err := NewTagFromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return
+}
+
+// containsID returns true if the id is in the list of ids.
+func containsID(ids []NodeID, id NodeID) bool {
+	for _, i := range ids {
+		if bytes.Compare(i, id) == 0 {
+			return true
+		}
+	}
+	return false
+}
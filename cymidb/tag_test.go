@@ -0,0 +1,173 @@
+package cymidb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Tag(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	owner := RandomNodeID()
+
+	invoice, err := db.CreateTag("invoice", owner)
+	require.NoError(t, err)
+	_, err = db.CreateTag("Invoice", owner)
+	require.Equal(t, ErrTagExists, err)
+	_, err = db.CreateTag("invoice", RandomNodeID())
+	require.NoError(t, err)
+	urgent, err := db.CreateTag("urgent", owner)
+	require.NoError(t, err)
+	require.Equal(t, ErrTagExists, urgent.Rename(db, "INVOICE"))
+	urgent.Color = "#ff0000"
+	require.NoError(t, urgent.Rename(db, "important"))
+
+	dir := NewDir("Bills", 0777)
+	file := NewFile("bill.pdf", 0644)
+	require.NoError(t, db.SaveNode(dir, file))
+	require.NoError(t, db.Tag(dir, invoice))
+	require.NoError(t, db.Tag(file, invoice))
+	require.NoError(t, db.Tag(file, urgent))
+
+	tags, err := db.GetTags(file.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tags))
+	require.Equal(t, "important", tags[1].Name)
+	require.Equal(t, "#ff0000", tags[1].Color)
+	tagged, err := db.GetTagged(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tagged))
+	tagged, err = db.GetTagged(invoice.node.NodeID, NodeTypeFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tagged))
+	tagged, err = db.GetTagged(invoice.node.NodeID, NodeBlob)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tagged))
+
+	require.NoError(t, db.Untag(file, invoice))
+	tags, err = db.GetTags(file.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tags))
+
+	// The removal of the tag is passed on to other DBs, even if they can't decrypt the nodes.
+	other, err := CreateDBFile(":memory:", "other", "")
+	require.NoError(t, err)
+	defer other.Close()
+	b, err := db.Export()
+	require.NoError(t, err)
+	require.NoError(t, other.Import(b))
+	children, err := other.GetChildren(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(children))
+	require.NoError(t, db.Untag(dir, invoice))
+	b, err = db.Export()
+	require.NoError(t, err)
+	require.NoError(t, other.Import(b))
+	children, err = other.GetChildren(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(children))
+
+	// The removal is only applied to older links, so replaying it doesn't remove a link added again.
+	require.NoError(t, other.AddLink(invoice, dir))
+	require.NoError(t, other.Import(b))
+	children, err = other.GetChildren(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(children))
+
+	// Removals must be signed by a known device.
+	forged := b.Removals[len(b.Removals)-1]
+	forged.SignedAt++
+	require.Error(t, other.Import(Bundle{Removals: []LinkRemoval{forged}}))
+	children, err = other.GetChildren(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(children))
+
+	// Links must be signed, too.
+	forgedLink := b.Links[0]
+	forgedLink.To = dir.node.NodeID
+	forgedLink.From = urgent.node.NodeID
+	forgedLink.Origin = "forged"
+	require.Error(t, other.Import(Bundle{Links: []Link{forgedLink}}))
+}
+
+func TestDB_MergeTags(t *testing.T) {
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	owner := RandomNodeID()
+
+	finance, err := db.CreateTag("finance", owner)
+	require.NoError(t, err)
+	invoice, err := db.CreateTag("invoice", owner)
+	require.NoError(t, err)
+	invoices, err := db.CreateTag("invoices", owner)
+	require.NoError(t, err)
+	billing, err := db.CreateTag("billing", owner)
+	require.NoError(t, err)
+	require.NoError(t, invoice.AddParent(db, finance))
+	require.Error(t, finance.AddParent(db, invoice))
+	require.NoError(t, invoice.AddAlias(db, "bill"))
+	require.Equal(t, ErrTagExists, billing.AddAlias(db, "Bill"))
+	found, err := db.FindTag("BILL", owner)
+	require.NoError(t, err)
+	require.Equal(t, invoice.node.NodeID, found.node.NodeID)
+
+	f1 := NewFile("one.pdf", 0644)
+	f2 := NewFile("two.pdf", 0644)
+	f3 := NewFile("three.pdf", 0644)
+	require.NoError(t, db.SaveNode(f1, f2, f3))
+	require.NoError(t, db.Tag(f1, invoice))
+	require.NoError(t, db.Tag(f2, invoices))
+	require.NoError(t, db.Tag(f1, invoices))
+	require.NoError(t, db.Tag(f3, finance))
+	tagged, err := db.GetTagged(finance.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tagged))
+
+	require.NoError(t, db.MergeTags(invoices, &invoice))
+	tagged, err = db.GetTagged(invoice.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tagged))
+	tagged, err = db.GetTagged(finance.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(tagged))
+	tagged, err = db.GetTagged(invoices.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(tagged))
+	found, err = db.FindTag("invoices", owner)
+	require.NoError(t, err)
+	require.Equal(t, invoice.node.NodeID, found.node.NodeID)
+
+	// The merged tag is kept, and new tags with its name go to the merged tag.
+	versions, err := db.GetNodeVersions(invoices.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(versions))
+	old, err := NewTagFromNode(versions[1])
+	require.NoError(t, err)
+	require.Equal(t, invoice.node.NodeID, old.MergedInto)
+	f4 := NewFile("four.pdf", 0644)
+	require.NoError(t, db.SaveNode(f4))
+	require.NoError(t, db.Tag(f4, old))
+	tags, err := db.GetTags(f4.node.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, "invoice", tags[0].Name)
+
+	// Links moved by the merge keep their origin.
+	scans, err := db.CreateTag("scans", owner)
+	require.NoError(t, err)
+	require.NoError(t, db.ensureLink(scans.node.NodeID, f3.node.NodeID, "ocr"))
+	require.NoError(t, db.MergeTags(scans, &invoice))
+	var links []Link
+	require.NoError(t, db.gdb.Find(&links, &Link{From: invoice.node.NodeID, To: f3.node.NodeID}).Error)
+	require.Equal(t, 1, len(links))
+	require.Equal(t, "ocr", links[0].Origin)
+
+	// Merging a tag with a tag below one of its sub-tags would create a loop.
+	year, err := db.CreateTag("2019", owner)
+	require.NoError(t, err)
+	require.NoError(t, year.AddParent(db, invoice))
+	require.Error(t, db.MergeTags(finance, &year))
+	require.Error(t, db.MergeTags(year, &finance))
+}
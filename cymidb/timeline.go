@@ -0,0 +1,218 @@
+package cymidb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Change is one entry in the timeline of the DB. Every event is recorded as a change before it is sent, so that
+// hooks can get the events they missed while they were not running. The ID of the change is the position in the
+// timeline. Like the LocalSettings, the timeline is local to this copy of the DB.
+type Change struct {
+	gorm.Model
+	Kind EventKind
+	// NodeID is the changed node, or the node a link points to.
+	NodeID  NodeID
+	Version uint64
+	Type    NodeType
+	// From, FromType and Origin are only set for link changes.
+	From     NodeID
+	FromType NodeType
+	Origin   string
+	Device   NodeID
+}
+
+// HookCursor is the position in the timeline up to which a hook has acknowledged all events.
+type HookCursor struct {
+	gorm.Model
+	Hook NodeID
+	Seq  uint
+}
+
+// HookLag shows how far a hook is behind the timeline.
+type HookLag struct {
+	// Cursor is the position of the last acknowledged event.
+	Cursor uint
+	// Latest is the position of the last change in the timeline.
+	Latest uint
+	// Pending is the number of changes of the types of the hook that have not been acknowledged.
+	Pending int
+	// Oldest is the time of the oldest pending change, or zero if nothing is pending.
+	Oldest time.Time
+}
+
+// timelinePage is the number of changes read at once when replaying the timeline.
+var timelinePage = 100
+
+// SubscribeDurable returns a subscription to the events of the types of the hook, which starts with all events
+// that have not been acknowledged by the hook. Events are delivered at least once: an event that has not been
+// acknowledged with Subscription.Ack is delivered again when the hook subscribes the next time.
+// The timeline is read one page after the other, as the events are received.
+func (h Hook) SubscribeDurable() (*Subscription, error) {
+	cursor, err := h.db.hookCursor(h.node.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	s := h.db.Subscribe(h.Types...)
+	s.hook = h.node.NodeID
+
+	// Events happening while the timeline is read are dropped, as they're read from the timeline, too.
+	s.cond.L.Lock()
+	s.after = cursor
+	s.replaying = true
+	err = s.readTimeline()
+	var queue []Event
+	if !s.replaying {
+		for _, e := range s.queue {
+			if e.Seq > s.after {
+				queue = append(queue, e)
+			}
+		}
+	}
+	s.queue = queue
+	s.cond.L.Unlock()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.cond.Signal()
+	return s, nil
+}
+
+// readTimeline adds the next page of the timeline to the replay. Once the end of the timeline is reached, new
+// events are queued again. Pushing new events waits for the lock of the subscription, which must be held, so no
+// event is missed between the end of the timeline and the queue.
+func (s *Subscription) readTimeline() error {
+	changes, err := s.db.changesAfter(s.after, s.types, timelinePage)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		s.replay = append(s.replay, s.db.changeEvent(c))
+		s.after = c.ID
+	}
+	if len(changes) < timelinePage {
+		s.replaying = false
+	}
+	return nil
+}
+
+// Ack acknowledges all events up to the given position in the timeline, so they're not delivered again.
+// It is only available for subscriptions returned by Hook.SubscribeDurable.
+func (s *Subscription) Ack(seq uint) error {
+	if s.hook == nil {
+		return errors.New("only durable subscriptions can acknowledge events")
+	}
+	var hc HookCursor
+	s.db.gdb.Where(&HookCursor{Hook: s.hook}).First(&hc)
+	if seq <= hc.Seq {
+		return nil
+	}
+	hc.Hook = s.hook
+	hc.Seq = seq
+	if err := s.db.gdb.Save(&hc).Error; err != nil {
+		return fmt.Errorf("couldn't store cursor: %v", err)
+	}
+	return nil
+}
+
+// Lag returns how far the hook is behind the timeline.
+func (h Hook) Lag() (lag HookLag, err error) {
+	if lag.Cursor, err = h.db.hookCursor(h.node.NodeID); err != nil {
+		return
+	}
+	var last Change
+	if err = h.db.gdb.Last(&last).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return lag, fmt.Errorf("couldn't get last change: %v", err)
+	}
+	lag.Latest = last.ID
+	query, args := changesQuery(lag.Cursor, h.Types)
+	if err = h.db.gdb.Model(&Change{}).Where(query, args...).Count(&lag.Pending).Error; err != nil {
+		return lag, fmt.Errorf("couldn't count changes: %v", err)
+	}
+	oldest, err := h.db.changesAfter(lag.Cursor, h.Types, 1)
+	if err != nil {
+		return
+	}
+	if len(oldest) > 0 {
+		lag.Oldest = oldest[0].CreatedAt
+	}
+	return lag, nil
+}
+
+// hookCursor returns the position of the last event acknowledged by the hook, or 0.
+func (db DB) hookCursor(hook NodeID) (uint, error) {
+	var hc HookCursor
+	err := db.gdb.Where(&HookCursor{Hook: hook}).First(&hc).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, fmt.Errorf("couldn't get cursor: %v", err)
+	}
+	return hc.Seq, nil
+}
+
+// changesAfter returns at most limit changes after the given position that match the types.
+func (db DB) changesAfter(seq uint, types []NodeType, limit int) (changes []Change, err error) {
+	query, args := changesQuery(seq, types)
+	if err = db.gdb.Where(query, args...).Order("id").Limit(limit).Find(&changes).Error; err != nil {
+		return nil, fmt.Errorf("couldn't get changes: %v", err)
+	}
+	return
+}
+
+// changesQuery returns the condition for the changes after the given position that match the types. Like for
+// events, link changes match if one of the two nodes matches.
+func changesQuery(seq uint, types []NodeType) (string, []interface{}) {
+	if len(types) == 0 {
+		return "id > ?", []interface{}{seq}
+	}
+	node, nodeArgs := typeCondition("type", types)
+	from, fromArgs := typeCondition("from_type", types)
+	args := append([]interface{}{seq}, nodeArgs...)
+	args = append(append(args, EventLinkAdded, EventLinkRemoved), fromArgs...)
+	return "id > ? AND (" + node + " OR (kind IN (?, ?) AND " + from + "))", args
+}
+
+// typeCondition returns the condition for the column to hold one of the types, where a general type includes all
+// its sub-types, like in NodeType.Matches.
+func typeCondition(column string, types []NodeType) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, t := range types {
+		if t.Base() == t {
+			conds = append(conds, "("+column+" >= ? AND "+column+" < ?)")
+			args = append(args, uint64(t), uint64(t+1<<56))
+		} else {
+			conds = append(conds, column+" = ?")
+			args = append(args, uint64(t))
+		}
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// changeEvent returns the event of the change, with the versions of the node as far as they are still available.
+func (db DB) changeEvent(c Change) Event {
+	e := Event{Seq: c.ID, Kind: c.Kind, Device: c.Device}
+	var versions []Node
+	db.gdb.Unscoped().Order("version").Find(&versions, &Node{NodeID: c.NodeID})
+	switch c.Kind {
+	case EventLinkAdded, EventLinkRemoved:
+		e.Link = Link{From: c.From, To: c.NodeID, Origin: c.Origin}
+		if len(versions) > 0 {
+			e.Node = db.tryDecrypt(versions[len(versions)-1])
+		}
+	default:
+		for i, v := range versions {
+			if v.Version == c.Version {
+				e.Node = db.tryDecrypt(v)
+				if i > 0 && c.Kind == EventNodeSaved {
+					e.Old = db.tryDecrypt(versions[i-1])
+				}
+			}
+		}
+	}
+	return e
+}
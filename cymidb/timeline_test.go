@@ -0,0 +1,132 @@
+package cymidb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHook_SubscribeDurable(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "db")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".key")
+	db, err := CreateDBFile(f.Name(), "laptop", "")
+	require.NoError(t, err)
+
+	h := NewHook("files", nil, []NodeType{NodeTypeFileData})
+	require.NoError(t, db.SaveNode(h))
+	loadHook := func(db DB) Hook {
+		n, err := db.GetLatest(h.node.NodeID)
+		require.NoError(t, err)
+		h, err := NewHookFromNode(db, n)
+		require.NoError(t, err)
+		return h
+	}
+	recv := func(s *Subscription) Event {
+		select {
+		case e := <-s.C:
+			return e
+		case <-time.After(time.Second):
+			require.Fail(t, "no event received")
+		}
+		return Event{}
+	}
+
+	// Changes before the first subscription are replayed.
+	fds := []FileData{NewFileData([]byte("one")), NewFileData([]byte("two")), NewFileData([]byte("three"))}
+	require.NoError(t, db.SaveNode(fds[0], fds[1]))
+	require.NoError(t, db.SaveNode(NewDir("ignored", 0777)))
+	hook := loadHook(db)
+	lag, err := hook.Lag()
+	require.NoError(t, err)
+	require.Equal(t, 2, lag.Pending)
+	require.Equal(t, uint(0), lag.Cursor)
+
+	sub, err := hook.SubscribeDurable()
+	require.NoError(t, err)
+	e := recv(sub)
+	require.Equal(t, fds[0].node.NodeID, e.Node.NodeID)
+	fd, err := NewFileDataFromNode(e.Node)
+	require.NoError(t, err)
+	require.Equal(t, "one", string(fd.Data))
+	require.NoError(t, sub.Ack(e.Seq))
+	require.Equal(t, fds[1].node.NodeID, recv(sub).Node.NodeID)
+	require.NoError(t, db.SaveNode(fds[2]))
+	require.Equal(t, fds[2].node.NodeID, recv(sub).Node.NodeID)
+	sub.Close()
+
+	lag, err = hook.Lag()
+	require.NoError(t, err)
+	require.Equal(t, 2, lag.Pending)
+	require.Equal(t, e.Seq, lag.Cursor)
+	require.True(t, lag.Latest > lag.Cursor)
+	require.NoError(t, db.Close())
+
+	// After a restart, all events that have not been acknowledged are delivered again.
+	db, err = OpenDBFile(f.Name())
+	require.NoError(t, err)
+	defer db.Close()
+	hook = loadHook(db)
+	sub, err = hook.SubscribeDurable()
+	require.NoError(t, err)
+	defer sub.Close()
+	require.Equal(t, fds[1].node.NodeID, recv(sub).Node.NodeID)
+	e = recv(sub)
+	require.Equal(t, fds[2].node.NodeID, e.Node.NodeID)
+	require.NoError(t, sub.Ack(e.Seq))
+	lag, err = hook.Lag()
+	require.NoError(t, err)
+	require.Equal(t, 0, lag.Pending)
+	require.True(t, lag.Oldest.IsZero())
+
+	require.Error(t, db.Subscribe().Ack(1))
+}
+
+func TestHook_SubscribeDurablePages(t *testing.T) {
+	defer func(page, max int) { timelinePage, subscriptionQueueMax = page, max }(timelinePage, subscriptionQueueMax)
+	timelinePage = 2
+	subscriptionQueueMax = 2
+	db, err := CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := NewHook("files", nil, []NodeType{NodeTypeFileData})
+	require.NoError(t, db.SaveNode(h))
+	var ids []NodeID
+	for i := 0; i < 5; i++ {
+		fd := NewFileData([]byte{byte(i)})
+		require.NoError(t, db.SaveNode(fd, NewDir("ignored", 0777)))
+		ids = append(ids, fd.node.NodeID)
+	}
+	n, err := db.GetLatest(h.node.NodeID)
+	require.NoError(t, err)
+	h, err = NewHookFromNode(db, n)
+	require.NoError(t, err)
+	sub, err := h.SubscribeDurable()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// The timeline is longer than the queue of the subscription, and new events are not lost while it is read.
+	for i := 0; i < 3; i++ {
+		fd := NewFileData([]byte{byte(5 + i)})
+		require.NoError(t, db.SaveNode(fd))
+		ids = append(ids, fd.node.NodeID)
+	}
+	for _, id := range ids {
+		select {
+		case e, ok := <-sub.C:
+			require.True(t, ok)
+			require.Equal(t, id, e.Node.NodeID)
+		case <-time.After(time.Second):
+			require.Fail(t, "no event received")
+		}
+	}
+	lag, err := h.Lag()
+	require.NoError(t, err)
+	require.Equal(t, 8, lag.Pending)
+}
@@ -0,0 +1,105 @@
+// Hookclient is a minimal external hook using the REST interface of cymidb. It registers itself, long-polls for new
+// FileData nodes, and adds a FileData node with the first line of each text as a child. As hooks can only write in
+// their own subgraph, only the texts linked below the directory created for the hook get a summary. The hook can
+// only write once the user granted it the FileData type with DB.GrantHookTypes.
+//
+//	hookclient -url http://localhost:8080 -secret <registration secret>
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ineiti/cybermind/cymidb"
+)
+
+type client struct {
+	url   string
+	creds cymidb.HookCredentials
+	// written holds the nodes written by this hook, which come back as events, too.
+	written map[string]bool
+}
+
+// do sends the JSON encoded 'in' to the API and decodes the answer into 'out'.
+func (c client) do(method, path, token string, in, out interface{}) error {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(in); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (c client) hook(method, path string, in, out interface{}) error {
+	return c.do(method, "/v1/hooks/"+c.creds.ID+path, c.creds.Token, in, out)
+}
+
+// summarize adds the first line of the FileData as a new child node.
+func (c client) summarize(n cymidb.APINode) error {
+	fd, err := cymidb.NewFileDataFromNode(cymidb.Node{NodeID: n.NodeID, Type: n.Type, Data: n.Data})
+	if err != nil {
+		return err
+	}
+	line, _ := bufio.NewReader(bytes.NewReader(fd.Data)).ReadString('\n')
+	summary, err := cymidb.NewFileData([]byte(line)).GetNode()
+	if err != nil {
+		return err
+	}
+	var saved cymidb.APINode
+	if err = c.hook(http.MethodPost, "/nodes", cymidb.APINode{Type: summary.Type, Data: summary.Data},
+		&saved); err != nil {
+		return err
+	}
+	c.written[string(saved.NodeID)] = true
+	return c.hook(http.MethodPost, "/links", cymidb.APILink{From: n.NodeID, To: saved.NodeID}, nil)
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "URL of the cymidb API")
+	secret := flag.String("secret", "", "registration secret of the API")
+	flag.Parse()
+
+	c := client{url: *url, written: map[string]bool{}}
+	reg := cymidb.HookRegistration{Name: "first-line", Types: []cymidb.NodeType{cymidb.NodeTypeFileData}}
+	if err := c.do(http.MethodPost, "/v1/hooks", *secret, reg, &c.creds); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("registered hook %s", c.creds.ID)
+
+	for {
+		var events []cymidb.APIEvent
+		if err := c.hook(http.MethodGet, "/events?wait=30s", nil, &events); err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range events {
+			if e.Kind == cymidb.EventNodeSaved && e.Old == nil && !c.written[string(e.Node.NodeID)] {
+				if err := c.summarize(e.Node); err != nil {
+					log.Printf("couldn't summarize %x: %v", e.Node.NodeID, err)
+				}
+			}
+			if err := c.hook(http.MethodPost, "/ack", cymidb.APIAck{Seq: e.Seq}, nil); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/jinzhu/gorm v1.9.11
 	github.com/stretchr/testify v1.4.0
 	go.dedis.ch/protobuf v1.0.11
+	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd
 )
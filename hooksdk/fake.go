@@ -0,0 +1,171 @@
+package hooksdk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ineiti/cybermind/cymidb"
+)
+
+// Fake is a backend keeping all nodes and links in memory, to test hooks without a DB. Events are added with
+// Send, and a hook handles them with Hook.Step.
+type Fake struct {
+	mutex  sync.Mutex
+	info   Info
+	nodes  map[string]cymidb.Node
+	links  []cymidb.APILink
+	events chan Event
+	seq    uint
+	acked  uint
+	logs   []string
+}
+
+// NewFake returns an empty fake backend for a hook with the name and configuration.
+func NewFake(name string, config map[string]string) *Fake {
+	return &Fake{
+		info:   Info{ID: cymidb.RandomNodeID(), Name: name, Config: config},
+		nodes:  map[string]cymidb.Node{},
+		events: make(chan Event, 1024),
+	}
+}
+
+// Send stores the node as if it had been saved by another hook or device, and sends the event to the hook.
+func (f *Fake) Send(n cymidb.Noder) (cymidb.Node, error) {
+	node, err := n.GetNode()
+	if err != nil {
+		return node, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e := Event{Kind: cymidb.EventNodeSaved}
+	if old, ok := f.nodes[string(node.NodeID)]; ok {
+		node.Version = old.Version + 1
+		e.Old = &old
+	}
+	f.nodes[string(node.NodeID)] = node
+	f.seq++
+	e.Seq = f.seq
+	e.Node = node
+	f.events <- e
+	return node, nil
+}
+
+// Info returns the description of the hook.
+func (f *Fake) Info() (Info, error) {
+	return f.info, nil
+}
+
+// Events returns the events sent, waiting for the first one.
+func (f *Fake) Events(stop <-chan struct{}) (events []Event, err error) {
+	select {
+	case e := <-f.events:
+		events = append(events, e)
+	case <-stop:
+		return nil, nil
+	}
+	for len(events) < maxEvents {
+		select {
+		case e := <-f.events:
+			events = append(events, e)
+		default:
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// Ack acknowledges the events.
+func (f *Fake) Ack(seq uint) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if seq > f.acked {
+		f.acked = seq
+	}
+	return nil
+}
+
+// Acked returns the last acknowledged event.
+func (f *Fake) Acked() uint {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.acked
+}
+
+// SaveNode stores a new version of the node. Unlike the DB, it doesn't send an event.
+func (f *Fake) SaveNode(n cymidb.Node) (cymidb.Node, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n.Version = 0
+	if old, ok := f.nodes[string(n.NodeID)]; ok {
+		if old.Type != n.Type {
+			return n, errors.New("cannot change the type of a node")
+		}
+		n.Version = old.Version + 1
+	}
+	f.nodes[string(n.NodeID)] = n
+	return n, nil
+}
+
+// Node returns the latest version of the node.
+func (f *Fake) Node(id cymidb.NodeID) (cymidb.Node, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, ok := f.nodes[string(id)]
+	return n, ok
+}
+
+// Nodes returns the number of nodes.
+func (f *Fake) Nodes() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.nodes)
+}
+
+// Link adds a link between two existing nodes.
+func (f *Fake) Link(from, to cymidb.NodeID) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range []cymidb.NodeID{from, to} {
+		if _, ok := f.nodes[string(id)]; !ok {
+			return fmt.Errorf("unknown node %x", id)
+		}
+	}
+	f.links = append(f.links, cymidb.APILink{From: from, To: to})
+	return nil
+}
+
+// Unlink removes the link between the two nodes.
+func (f *Fake) Unlink(from, to cymidb.NodeID) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, l := range f.links {
+		if bytes.Equal(l.From, from) && bytes.Equal(l.To, to) {
+			f.links = append(f.links[:i], f.links[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such link")
+}
+
+// Links returns all links.
+func (f *Fake) Links() []cymidb.APILink {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]cymidb.APILink{}, f.links...)
+}
+
+// Logf stores the message.
+func (f *Fake) Logf(format string, args ...interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+}
+
+// Logs returns all logged messages.
+func (f *Fake) Logs() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.logs...)
+}
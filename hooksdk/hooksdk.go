@@ -0,0 +1,220 @@
+// Package hooksdk helps to write hooks for cymidb. A hook written with this package runs the same way in-process,
+// as a module registered with Register, or out-of-process, using the REST interface with a Remote backend. For
+// tests, the Fake backend keeps the nodes in memory.
+//
+//	h, err := hooksdk.New(backend)
+//	h.OnEvent(func(e hooksdk.Event) error {
+//		_, err := h.Upsert("some-external-id", cymidb.NewFileData(data))
+//		return err
+//	}, cymidb.NodeTypeFileData)
+//	err = h.Run(stop)
+package hooksdk
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ineiti/cybermind/cymidb"
+)
+
+// Info describes the hook. Root is the node whose subgraph the hook can write.
+type Info struct {
+	ID     cymidb.NodeID
+	Name   string
+	Config map[string]string
+	Root   cymidb.NodeID
+}
+
+// Event is a change in the DB. For link events, Node only has the NodeID set.
+type Event struct {
+	Seq    uint
+	Kind   cymidb.EventKind
+	Node   cymidb.Node
+	Old    *cymidb.Node
+	Link   *cymidb.APILink
+	Device cymidb.NodeID
+}
+
+// Backend connects a hook to the DB.
+type Backend interface {
+	// Info returns the description of the hook.
+	Info() (Info, error)
+	// Events waits for the next events, or returns no events once stop is closed. Events are sent again until
+	// they're acknowledged.
+	Events(stop <-chan struct{}) ([]Event, error)
+	// Ack acknowledges all events up to seq.
+	Ack(seq uint) error
+	// SaveNode saves a new version of the node and returns the saved version.
+	SaveNode(n cymidb.Node) (cymidb.Node, error)
+	Link(from, to cymidb.NodeID) error
+	Unlink(from, to cymidb.NodeID) error
+	Logf(format string, args ...interface{})
+}
+
+// Hook is a hook using a backend.
+type Hook struct {
+	backend  Backend
+	info     Info
+	handlers []handler
+	runs     []func(stop <-chan struct{}) error
+}
+
+type handler struct {
+	types []cymidb.NodeType
+	f     func(Event) error
+}
+
+// New returns a hook using the backend.
+func New(b Backend) (*Hook, error) {
+	info, err := b.Info()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get hook info: %v", err)
+	}
+	return &Hook{backend: b, info: info}, nil
+}
+
+// Info returns the description of the hook.
+func (h *Hook) Info() Info {
+	return h.info
+}
+
+// Config returns the value of the configuration key, or an empty string.
+func (h *Hook) Config(key string) string {
+	return h.info.Config[key]
+}
+
+// Logf logs a message of the hook.
+func (h *Hook) Logf(format string, args ...interface{}) {
+	h.backend.Logf(format, args...)
+}
+
+// OnEvent calls f for every event of a node matching the types. Without types, f is called for all events.
+// If f returns an error, the event is not acknowledged and Run returns the error.
+func (h *Hook) OnEvent(f func(Event) error, types ...cymidb.NodeType) {
+	h.handlers = append(h.handlers, handler{types: types, f: f})
+}
+
+// OnRun calls f for every scheduled run of the hook, as given by the Schedule of the hook. It is used by hooks
+// polling their source, like a mailbox. f should return early once stop is closed.
+func (h *Hook) OnRun(f func(stop <-chan struct{}) error) {
+	h.runs = append(h.runs, f)
+}
+
+// RunScheduled does one scheduled run by calling all functions added with OnRun.
+func (h *Hook) RunScheduled(stop <-chan struct{}) error {
+	if len(h.runs) == 0 {
+		return errors.New("hook has no scheduled runs")
+	}
+	for _, f := range h.runs {
+		if err := f(stop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertID returns the NodeID used by the hook for the external ID.
+func UpsertID(hook cymidb.NodeID, externalID string) cymidb.NodeID {
+	id := sha256.Sum256(append(append([]byte{}, hook...), externalID...))
+	return id[:]
+}
+
+// Upsert saves the node with a NodeID derived from the ID of the hook and the external ID. Calling Upsert again
+// with the same external ID stores a new version of the same node.
+func (h *Hook) Upsert(externalID string, n cymidb.Noder) (cymidb.NodeID, error) {
+	node, err := n.GetNode()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get node: %v", err)
+	}
+	node.NodeID = UpsertID(h.info.ID, externalID)
+	saved, err := h.backend.SaveNode(node)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't save node: %v", err)
+	}
+	return saved.NodeID, nil
+}
+
+// Save saves a new version of the node.
+func (h *Hook) Save(n cymidb.Noder) (cymidb.NodeID, error) {
+	node, err := n.GetNode()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get node: %v", err)
+	}
+	saved, err := h.backend.SaveNode(node)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't save node: %v", err)
+	}
+	return saved.NodeID, nil
+}
+
+// Link adds a link between the two nodes.
+func (h *Hook) Link(from, to cymidb.NodeID) error {
+	return h.backend.Link(from, to)
+}
+
+// Unlink removes the link between the two nodes.
+func (h *Hook) Unlink(from, to cymidb.NodeID) error {
+	return h.backend.Unlink(from, to)
+}
+
+// Step waits for the next events, passes them to the handlers and acknowledges them.
+func (h *Hook) Step(stop <-chan struct{}) error {
+	events, err := h.backend.Events(stop)
+	if err != nil {
+		return fmt.Errorf("couldn't get events: %v", err)
+	}
+	for _, e := range events {
+		for _, hd := range h.handlers {
+			if !e.Node.Type.Matches(hd.types) {
+				continue
+			}
+			if err := hd.f(e); err != nil {
+				return fmt.Errorf("couldn't handle event %d: %v", e.Seq, err)
+			}
+		}
+		if err := h.backend.Ack(e.Seq); err != nil {
+			return fmt.Errorf("couldn't acknowledge event: %v", err)
+		}
+	}
+	return nil
+}
+
+// Run handles events until stop is closed, or a handler returns an error.
+func (h *Hook) Run(stop <-chan struct{}) error {
+	for {
+		if err := h.Step(stop); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+	}
+}
+
+// fromAPI converts an event received from the DB.
+func fromAPI(ae cymidb.APIEvent) Event {
+	e := Event{Seq: ae.Seq, Kind: ae.Kind, Node: toNode(ae.Node), Link: ae.Link, Device: ae.Device}
+	if ae.Old != nil {
+		old := toNode(*ae.Old)
+		e.Old = &old
+	}
+	return e
+}
+
+func toNode(an cymidb.APINode) cymidb.Node {
+	return cymidb.Node{NodeID: an.NodeID, Type: an.Type, Version: an.Version, Data: an.Data}
+}
+
+func toAPINode(n cymidb.Node) cymidb.APINode {
+	return cymidb.APINode{NodeID: n.NodeID, Type: n.Type, Version: n.Version, Data: n.Data}
+}
+
+// pollGrace is how long Events waits for more events once an event has been received.
+const pollGrace = 10 * time.Millisecond
+
+// maxEvents is the maximum number of events returned by Events.
+const maxEvents = 100
@@ -0,0 +1,92 @@
+package hooksdk
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/ineiti/cybermind/cymidb"
+	"github.com/stretchr/testify/require"
+)
+
+// setupUpper adds a handler that stores an upper-case copy of every new FileData as its child.
+func setupUpper(h *Hook) error {
+	h.OnEvent(func(e Event) error {
+		fd, err := cymidb.NewFileDataFromNode(e.Node)
+		if err != nil || e.Kind != cymidb.EventNodeSaved || bytes.Equal(fd.Data, bytes.ToUpper(fd.Data)) {
+			return err
+		}
+		id, err := h.Upsert(hex.EncodeToString(e.Node.NodeID), cymidb.NewFileData(bytes.ToUpper(fd.Data)))
+		if err != nil {
+			return err
+		}
+		h.Logf("upper %x", id)
+		return h.Link(e.Node.NodeID, id)
+	}, cymidb.NodeTypeFileData)
+	return nil
+}
+
+func TestHook_Fake(t *testing.T) {
+	fake := NewFake("upper", map[string]string{"lang": "en"})
+	h, err := New(fake)
+	require.NoError(t, err)
+	require.Equal(t, "en", h.Config("lang"))
+	require.NoError(t, setupUpper(h))
+
+	fd, err := fake.Send(cymidb.NewFileData([]byte("hello")))
+	require.NoError(t, err)
+	_, err = fake.Send(cymidb.NewNode(cymidb.NodeTag))
+	require.NoError(t, err)
+	require.NoError(t, h.Step(nil))
+	require.Equal(t, uint(2), fake.Acked())
+	require.Equal(t, 3, fake.Nodes())
+	require.Equal(t, 1, len(fake.Logs()))
+
+	upperID := UpsertID(h.Info().ID, hex.EncodeToString(fd.NodeID))
+	upper, ok := fake.Node(upperID)
+	require.True(t, ok)
+	upperFD, err := cymidb.NewFileDataFromNode(upper)
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO"), upperFD.Data)
+	require.Equal(t, []cymidb.APILink{{From: fd.NodeID, To: upperID}}, fake.Links())
+
+	// A new version of the source updates the same node.
+	again, err := cymidb.NewFileData([]byte("hello again")).GetNode()
+	require.NoError(t, err)
+	again.NodeID = fd.NodeID
+	_, err = fake.Send(again)
+	require.NoError(t, err)
+	require.NoError(t, h.Step(nil))
+	upper, _ = fake.Node(upperID)
+	require.Equal(t, uint64(1), upper.Version)
+	require.Equal(t, 3, fake.Nodes())
+
+	// Events failing are not acknowledged.
+	h.OnEvent(func(Event) error { return errors.New("failed") })
+	_, err = fake.Send(cymidb.NewNode(cymidb.NodeTag))
+	require.NoError(t, err)
+	require.Error(t, h.Step(nil))
+	require.Equal(t, uint(3), fake.Acked())
+}
+
+func TestHook_RunScheduled(t *testing.T) {
+	fake := NewFake("poller", nil)
+	h, err := New(fake)
+	require.NoError(t, err)
+	require.Error(t, h.RunScheduled(nil))
+
+	polls := 0
+	h.OnRun(func(stop <-chan struct{}) error {
+		polls++
+		_, err := h.Upsert("inbox", cymidb.NewFileData([]byte("mail")))
+		return err
+	})
+	require.NoError(t, h.RunScheduled(nil))
+	require.NoError(t, h.RunScheduled(nil))
+	require.Equal(t, 2, polls)
+	require.Equal(t, 1, fake.Nodes())
+	inbox, ok := fake.Node(UpsertID(h.Info().ID, "inbox"))
+	require.True(t, ok)
+	require.Equal(t, uint64(1), inbox.Version)
+}
@@ -0,0 +1,186 @@
+package hooksdk
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ineiti/cybermind/cymidb"
+)
+
+// InProcess is the backend of hooks running in the same process as the DB.
+type InProcess struct {
+	hook cymidb.Hook
+	hdb  cymidb.HookDB
+	id   cymidb.NodeID
+
+	mutex sync.Mutex
+	sub   *cymidb.Subscription
+}
+
+// NewInProcess returns the backend for the hook of the HookDB, which must have been read from the DB.
+func NewInProcess(hdb cymidb.HookDB) (*InProcess, error) {
+	h := hdb.Hook()
+	n, err := h.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	return &InProcess{hook: h, hdb: hdb, id: n.NodeID}, nil
+}
+
+// Info returns the description of the hook, with its settings on the active device.
+func (ip *InProcess) Info() (Info, error) {
+	settings, err := ip.hdb.Settings()
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{ID: ip.id, Name: ip.hook.Name, Config: settings, Root: ip.hook.Scope.Root}, nil
+}
+
+// Events waits for the events of the types of the hook.
+func (ip *InProcess) Events(stop <-chan struct{}) (events []Event, err error) {
+	ip.mutex.Lock()
+	if ip.sub == nil {
+		if ip.sub, err = ip.hook.SubscribeDurable(); err != nil {
+			ip.mutex.Unlock()
+			return nil, err
+		}
+	}
+	sub := ip.sub
+	ip.mutex.Unlock()
+
+	wait := (<-chan time.Time)(nil)
+	for len(events) < maxEvents {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return events, errors.New("subscription closed")
+			}
+			events = append(events, fromAPI(cymidb.NewAPIEvent(e)))
+			wait = time.After(pollGrace)
+			continue
+		case <-wait:
+		case <-stop:
+		}
+		break
+	}
+	return events, nil
+}
+
+// Ack acknowledges the events.
+func (ip *InProcess) Ack(seq uint) error {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	if ip.sub == nil {
+		return errors.New("not subscribed")
+	}
+	return ip.sub.Ack(seq)
+}
+
+// SaveNode saves the node through the HookDB of the hook.
+func (ip *InProcess) SaveNode(n cymidb.Node) (cymidb.Node, error) {
+	if err := ip.hdb.SaveNode(n); err != nil {
+		return n, err
+	}
+	return ip.hdb.GetLatest(n.NodeID)
+}
+
+// Link adds the link through the HookDB of the hook.
+func (ip *InProcess) Link(from, to cymidb.NodeID) error {
+	return ip.hdb.AddLink(cymidb.Node{NodeID: from}, cymidb.Node{NodeID: to})
+}
+
+// Unlink removes the link through the HookDB of the hook.
+func (ip *InProcess) Unlink(from, to cymidb.NodeID) error {
+	return ip.hdb.RemoveLink(cymidb.Node{NodeID: from}, cymidb.Node{NodeID: to})
+}
+
+// Logf logs with the standard logger.
+func (ip *InProcess) Logf(format string, args ...interface{}) {
+	log.Printf("hook %s: "+format, append([]interface{}{ip.hook.Name}, args...)...)
+}
+
+// Close stops the subscription to the events.
+func (ip *InProcess) Close() {
+	ip.mutex.Lock()
+	defer ip.mutex.Unlock()
+	if ip.sub != nil {
+		ip.sub.Close()
+		ip.sub = nil
+	}
+}
+
+// retryDelay is the time to wait before a hook is run again after an error.
+var retryDelay = time.Second
+
+// Register registers a hook module with the name. When a hook with this module is started, setup is called to
+// add the event and run handlers, and the hook runs until it is stopped. If a handler returns an error, the hook
+// is run again after a delay. If schema is not nil, it is registered as the settings schema of the module.
+func Register(name string, schema cymidb.SettingsSchema, setup func(h *Hook) error) {
+	if schema != nil {
+		cymidb.RegisterHookSettings(name, schema)
+	}
+	cymidb.RegisterHookModule(name, func(hdb cymidb.HookDB) (cymidb.HookModule, error) {
+		return &module{hdb: hdb, setup: setup}, nil
+	})
+}
+
+// module runs a hook of the SDK as a cymidb.HookModule, and as a cymidb.HookRunner for scheduled hooks.
+type module struct {
+	hdb     cymidb.HookDB
+	setup   func(h *Hook) error
+	backend *InProcess
+	h       *Hook
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (m *module) Start() error {
+	var err error
+	if m.backend, err = NewInProcess(m.hdb); err != nil {
+		return err
+	}
+	h, err := New(m.backend)
+	if err != nil {
+		return err
+	}
+	if err = m.setup(h); err != nil {
+		return err
+	}
+	m.h = h
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(h)
+	return nil
+}
+
+func (m *module) run(h *Hook) {
+	defer close(m.done)
+	for {
+		err := h.Run(m.stop)
+		if err == nil {
+			return
+		}
+		h.Logf("%v", err)
+		m.hdb.Report(err)
+		// Events that haven't been acknowledged are only sent again to a new subscription.
+		m.backend.Close()
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (m *module) Run(stop <-chan struct{}) error {
+	return m.h.RunScheduled(stop)
+}
+
+func (m *module) Stop() error {
+	close(m.stop)
+	<-m.done
+	m.backend.Close()
+	return nil
+}
@@ -0,0 +1,48 @@
+package hooksdk
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/ineiti/cybermind/cymidb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	schema := cymidb.SettingsSchema{{Name: "lang", Kind: cymidb.SettingString, Default: "en"}}
+	Register("sdk-upper", schema, setupUpper)
+	require.Equal(t, schema, cymidb.HookSettingsSchema("sdk-upper"))
+	db, err := cymidb.CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	dev, err := db.Device.GetNode()
+	require.NoError(t, err)
+	root := cymidb.NewDir("Texts", 0777)
+	fd := cymidb.NewFileData([]byte("hello"))
+	require.NoError(t, db.SaveNode(root, fd))
+	require.NoError(t, db.AddLink(root, fd))
+	rootNode, err := root.GetNode()
+	require.NoError(t, err)
+	fdNode, err := fd.GetNode()
+	require.NoError(t, err)
+
+	h := cymidb.NewHook("upper", []cymidb.NodeID{dev.NodeID}, []cymidb.NodeType{cymidb.NodeTypeFileData})
+	h.Module = "sdk-upper"
+	h.Scope = cymidb.HookScope{Types: []cymidb.NodeType{cymidb.NodeTypeFileData}, Root: rootNode.NodeID}
+	require.NoError(t, db.SaveNode(h))
+	hook, err := h.GetNode()
+	require.NoError(t, err)
+	upperID := UpsertID(hook.NodeID, hex.EncodeToString(fdNode.NodeID))
+	require.Eventually(t, func() bool {
+		children, err := db.GetChildren(fdNode.NodeID)
+		return err == nil && len(children) == 1 && bytes.Equal(children[0], upperID)
+	}, 5*time.Second, 10*time.Millisecond)
+	upper, err := db.GetLatest(upperID)
+	require.NoError(t, err)
+	upperFD, err := cymidb.NewFileDataFromNode(upper)
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO"), upperFD.Data)
+	require.Nil(t, db.Hooks().Error(hook.NodeID))
+}
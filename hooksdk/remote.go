@@ -0,0 +1,133 @@
+package hooksdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/ineiti/cybermind/cymidb"
+)
+
+// Remote is the backend of hooks running in another process, using the REST interface of the DB.
+type Remote struct {
+	url    string
+	creds  cymidb.HookCredentials
+	client *http.Client
+}
+
+// RegisterRemote registers a new hook with the API at url, and returns the credentials to be used with NewRemote.
+func RegisterRemote(url, secret string, reg cymidb.HookRegistration) (creds cymidb.HookCredentials, err error) {
+	r := &Remote{url: url, client: http.DefaultClient}
+	err = r.do(context.Background(), http.MethodPost, "/v1/hooks", secret, reg, &creds)
+	return
+}
+
+// NewRemote returns the backend for the hook registered with the API at url.
+func NewRemote(url string, creds cymidb.HookCredentials) *Remote {
+	return &Remote{url: url, creds: creds, client: http.DefaultClient}
+}
+
+func (r *Remote) do(ctx context.Context, method, path, token string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.url+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (r *Remote) hook(ctx context.Context, method, path string, in, out interface{}) error {
+	return r.do(ctx, method, "/v1/hooks/"+r.creds.ID+path, r.creds.Token, in, out)
+}
+
+// Info returns the description of the hook.
+func (r *Remote) Info() (Info, error) {
+	var ah cymidb.APIHook
+	if err := r.hook(context.Background(), http.MethodGet, "", nil, &ah); err != nil {
+		return Info{}, err
+	}
+	id, err := hex.DecodeString(ah.ID)
+	if err != nil {
+		return Info{}, fmt.Errorf("invalid hook ID: %v", err)
+	}
+	return Info{ID: id, Name: ah.Name, Config: ah.Config, Root: ah.Root}, nil
+}
+
+// Events long-polls the events of the hook.
+func (r *Remote) Events(stop <-chan struct{}) ([]Event, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var aes []cymidb.APIEvent
+	if err := r.hook(ctx, http.MethodGet, fmt.Sprintf("/events?max=%d", maxEvents), nil, &aes); err != nil {
+		select {
+		case <-stop:
+			return nil, nil
+		default:
+		}
+		return nil, err
+	}
+	events := make([]Event, len(aes))
+	for i, ae := range aes {
+		events[i] = fromAPI(ae)
+	}
+	return events, nil
+}
+
+// Ack acknowledges the events.
+func (r *Remote) Ack(seq uint) error {
+	return r.hook(context.Background(), http.MethodPost, "/ack", cymidb.APIAck{Seq: seq}, nil)
+}
+
+// SaveNode saves the node.
+func (r *Remote) SaveNode(n cymidb.Node) (cymidb.Node, error) {
+	var saved cymidb.APINode
+	if err := r.hook(context.Background(), http.MethodPost, "/nodes", toAPINode(n), &saved); err != nil {
+		return n, err
+	}
+	return toNode(saved), nil
+}
+
+// Link adds the link.
+func (r *Remote) Link(from, to cymidb.NodeID) error {
+	return r.hook(context.Background(), http.MethodPost, "/links", cymidb.APILink{From: from, To: to}, nil)
+}
+
+// Unlink removes the link.
+func (r *Remote) Unlink(from, to cymidb.NodeID) error {
+	return r.hook(context.Background(), http.MethodDelete, "/links", cymidb.APILink{From: from, To: to}, nil)
+}
+
+// Logf logs with the standard logger.
+func (r *Remote) Logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
@@ -0,0 +1,52 @@
+package hooksdk
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ineiti/cybermind/cymidb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemote(t *testing.T) {
+	db, err := cymidb.CreateDBFile(":memory:", "laptop", "")
+	require.NoError(t, err)
+	defer db.Close()
+	api := cymidb.NewAPI(db)
+	api.AllowHookRegistration("secret")
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	creds, err := RegisterRemote(srv.URL, "secret", cymidb.HookRegistration{Name: "upper",
+		Types: []cymidb.NodeType{cymidb.NodeTypeFileData}})
+	require.NoError(t, err)
+	h, err := New(NewRemote(srv.URL, creds))
+	require.NoError(t, err)
+	require.Equal(t, "upper", h.Info().Name)
+	require.NoError(t, db.GrantHookTypes(h.Info().ID, cymidb.NodeTypeFileData))
+	require.NoError(t, setupUpper(h))
+
+	// The hook can only write below its root directory.
+	fd := cymidb.NewFileData([]byte("hello"))
+	require.NoError(t, db.SaveNode(fd))
+	require.NoError(t, db.AddLink(cymidb.Node{NodeID: h.Info().Root}, fd))
+	require.NoError(t, h.Step(nil))
+	fdNode, err := fd.GetNode()
+	require.NoError(t, err)
+	children, err := db.GetChildrenNodes(fdNode.NodeID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(children))
+	upper, err := cymidb.NewFileDataFromNode(children[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO"), upper.Data)
+
+	// The event of the upper-case node is handled, too, and nothing is left.
+	require.NoError(t, h.Step(nil))
+	hook, err := db.GetLatest(h.Info().ID)
+	require.NoError(t, err)
+	ch, err := cymidb.NewHookFromNode(db, hook)
+	require.NoError(t, err)
+	lag, err := ch.Lag()
+	require.NoError(t, err)
+	require.Equal(t, 0, lag.Pending)
+}